@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/FactomWyomingEntity/prosper-pool/config"
 	"github.com/FactomWyomingEntity/prosper-pool/difficulty"
@@ -20,6 +21,15 @@ var (
 
 const AccountingPrecision = 8
 
+// RewardDelayMargin is added to the grace window, for the shares accepted at
+// the end of the window that are still on their way to the accountant.
+const RewardDelayMargin = time.Second
+
+type delayedReward struct {
+	reward *Reward
+	due    time.Time
+}
+
 type Accountant struct {
 	DB *gorm.DB
 
@@ -28,16 +38,33 @@ type Accountant struct {
 	JobsByMiner map[int32]*ShareMap
 	JobsByUser  map[int32]*ShareMap
 
+	// dirty are the share sums that changed since the last checkpoint
+	dirty              map[checkpointKey]struct{}
+	checkpointInterval time.Duration
+
 	newJobs     chan int32
 	rewards     chan *Reward
 	submissions <-chan *stratum.ShareSubmission
+	// flushes are requests to credit the queued submissions and checkpoint
+	flushes chan chan error
+	// done is closed once Listen has returned, and written its last
+	// checkpoint
+	done chan struct{}
 
 	// shares is mainly used for debug/testing. Most submissions come from
 	// Stratum.
 	shares chan *Share
 
+	// RewardDelay holds rewards back so shares for the previous job,
+	// accepted in the stratum grace window, are still credited.
+	RewardDelay time.Duration
+	delayed     []delayedReward
+
 	// Pool Configuration
 	PoolFeeRate decimal.Decimal
+	Scheme      PayoutScheme
+	// MinimumPayout is the smallest balance paid out, in factoshis
+	MinimumPayout int64
 }
 
 func NewAccountant(conf *viper.Viper, db *gorm.DB) (*Accountant, error) {
@@ -46,12 +73,23 @@ func NewAccountant(conf *viper.Viper, db *gorm.DB) (*Accountant, error) {
 	a.shares = make(chan *Share, 100)
 	a.rewards = make(chan *Reward, 1000)
 	a.newJobs = make(chan int32, 100)
+	a.flushes = make(chan chan error)
+	a.done = make(chan struct{})
 	a.JobsByMiner = make(map[int32]*ShareMap)
 	a.JobsByUser = make(map[int32]*ShareMap)
+	a.dirty = make(map[checkpointKey]struct{})
+	a.checkpointInterval = conf.GetDuration(config.ConfigAccountingCheckpointInterval)
+	if a.checkpointInterval <= 0 {
+		a.checkpointInterval = time.Second * 5
+	}
+	if grace := conf.GetDuration(config.ConfigStratumPreviousJobGrace); grace > 0 {
+		a.RewardDelay = grace + RewardDelayMargin
+	}
 
 	a.DB.AutoMigrate(&UserOwedPayouts{})
 	a.DB.AutoMigrate(&OwedPayouts{})
 	a.DB.AutoMigrate(&Paid{})
+	a.DB.AutoMigrate(&ShareCheckpoint{})
 
 	cut := conf.GetString(config.ConfigPoolCut)
 
@@ -73,6 +111,23 @@ func NewAccountant(conf *viper.Viper, db *gorm.DB) (*Accountant, error) {
 
 	a.PoolFeeRate = a.PoolFeeRate.Truncate(AccountingPrecision)
 
+	var err error
+	a.Scheme, err = NewPayoutScheme(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	min, err := decimal.NewFromString(conf.GetString(config.ConfigPoolMinimumPayout))
+	if err != nil {
+		return nil, fmt.Errorf("minimum payout: %s", err.Error())
+	}
+	a.MinimumPayout = min.Shift(AccountingPrecision).IntPart()
+
+	// Any work from before a restart should still be paid out
+	if err := a.RecoverCheckpoints(); err != nil {
+		return nil, fmt.Errorf("failed to recover share checkpoints: %s", err.Error())
+	}
+
 	return a, nil
 }
 
@@ -92,35 +147,59 @@ func (a *Accountant) SetSubmissions(subs <-chan *stratum.ShareSubmission) {
 	a.submissions = subs
 }
 
+// Done is closed once Listen has returned. The database must stay open
+// until then.
+func (a *Accountant) Done() <-chan struct{} {
+	return a.done
+}
+
 // Listen accepts new shares and shares for handling the payout accounting.
 func (a *Accountant) Listen(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(a.checkpointInterval)
+	defer ticker.Stop()
+	// delayTimer fires when the first delayed reward is due
+	var delayTimer <-chan time.Time
 	for {
 		select {
 		case <-ctx.Done():
+			a.processDelayed()
+
+			// Save any work that has not been checkpointed
+			if err := a.Checkpoint(); err != nil {
+				acctLog.WithError(err).Error("failed to checkpoint shares")
+			}
 			return
+		case <-ticker.C:
+			if err := a.Checkpoint(); err != nil {
+				acctLog.WithError(err).Error("failed to checkpoint shares")
+			}
 		case submit := <-a.submissions:
 			// A new share from a miner that we need to account for
-			if !a.JobExists(submit.JobID) {
-				acctLog.WithFields(log.Fields{
-					"job":     submit.JobID,
-					"minerid": submit.MinerID,
-					"userid":  submit.Username,
-				}).Debugf("share submitted, but no job exits")
-				continue // Nothing to do if the job does not exist
+			a.ProcessSubmission(submit)
+		case done := <-a.flushes:
+			// Credit everything stratum already accepted
+			for queued := true; queued; {
+				select {
+				case submit := <-a.submissions:
+					a.ProcessSubmission(submit)
+				default:
+					queued = false
+				}
 			}
-
-			share := Share{
-				JobID:      submit.JobID,
-				Nonce:      submit.Nonce,
-				Difficulty: difficulty.DifficultyFromTarget(submit.Target, difficulty.PDiff),
-				Target:     submit.Target,
-				// The share will be rejected if sealed
-				Accepted: true,
-				MinerID:  submit.MinerID,
-				UserID:   submit.Username,
+			// Stratum takes no more shares, so the rewards do not need to
+			// wait out the grace window
+			for queued := true; queued; {
+				select {
+				case reward := <-a.rewards:
+					a.delayed = append(a.delayed, delayedReward{reward: reward, due: time.Now()})
+				default:
+					queued = false
+				}
 			}
-
-			a.AddShare(share)
+			a.processDelayed()
+			delayTimer = nil
+			done <- a.Checkpoint()
 		case share := <-a.shares:
 			// A share from somewhere internal (probably a test)
 			if !a.JobExists(share.JobID) {
@@ -143,60 +222,182 @@ func (a *Accountant) Listen(ctx context.Context) {
 			}
 			a.NewJob(newJob)
 		case reward := <-a.rewards:
-			rLog := acctLog.WithFields(log.Fields{
-				"job": reward.JobID,
-				"peg": reward.PoolReward / 1e8,
-			})
-			// Indication of a block being completed and us earning rewards
-			if !a.JobExists(reward.JobID) {
-				// TODO: We will still do the accounting so our numbers add up.
-				// 		But we should really see if we can do something to
-				//		payout our users if this happens. Like if we reboot
-				//		the pool, and didn't keep the user's pow. We could
-				//		just use the last blocks proportions or something.
-				rLog.Warnf("reward for job that does not exist")
-				a.JobsByMiner[reward.JobID] = NewShareMap()
-				a.JobsByUser[reward.JobID] = NewShareMap()
+			if a.RewardDelay <= 0 {
+				a.ProcessReward(reward)
+				continue
 			}
-
-			a.jobLock.Lock()
-			us := a.JobsByUser[reward.JobID]
-			ms := a.JobsByMiner[reward.JobID]
-
-			if us.TotalDiff != ms.TotalDiff {
-				rLog.Error("miner job sum and user job sum differ")
+			// Every reward is delayed the same, so they stay in order
+			a.delayed = append(a.delayed, delayedReward{reward: reward, due: time.Now().Add(a.RewardDelay)})
+			if delayTimer == nil {
+				delayTimer = time.After(a.RewardDelay)
 			}
-			us.Seal()
-			ms.Seal()
-
-			// Setup the payout struct with all the proportional payouts.
-			// This will also calculate the pool cut
-			pays := NewPayout(*reward, a.PoolFeeRate, *us)
-
-			dbErr := a.DB.FirstOrCreate(pays)
-			if dbErr.Error != nil {
-				// TODO: This is pretty bad. This means payments failed.
-				// 		We don't want to just panic and kill the pool.
-				//		Maybe, we can just write everything to a file,
-				//		and try to notify someone?
-
-				// TODO: Write to a file all the details so we can recover the payments
-				rLog.WithError(dbErr.Error).Error("failed to write payouts to database")
+		case <-delayTimer:
+			delayTimer = nil
+			now := time.Now()
+			for len(a.delayed) > 0 && !a.delayed[0].due.After(now) {
+				a.ProcessReward(a.delayed[0].reward)
+				a.delayed = a.delayed[1:]
+			}
+			if len(a.delayed) > 0 {
+				delayTimer = time.After(a.delayed[0].due.Sub(now))
 			}
-
-			rLog.WithFields(log.Fields{"pool-diff": us.TotalDiff}).Infof("pool stats")
-			a.jobLock.Unlock()
 		}
 	}
 }
 
+// processDelayed processes every delayed reward, due or not. Delayed rewards
+// would be lost on a shutdown, as their blocks are already synced.
+func (a *Accountant) processDelayed() {
+	for _, d := range a.delayed {
+		a.ProcessReward(d.reward)
+	}
+	a.delayed = nil
+}
+
+// ProcessSubmission credits a share stratum accepted, or takes back the
+// credit of a miner caught with invalid work.
+func (a *Accountant) ProcessSubmission(submit *stratum.ShareSubmission) {
+	if !a.JobExists(submit.JobID) {
+		acctLog.WithFields(log.Fields{
+			"job":     submit.JobID,
+			"minerid": submit.MinerID,
+			"userid":  submit.Username,
+		}).Debugf("share submitted, but no job exits")
+		return // Nothing to do if the job does not exist
+	}
+
+	if submit.Forfeit != nil {
+		// The miner was caught with invalid work for the job
+		a.ForfeitShares(submit.JobID, submit.MinerID, submit.Username, *submit.Forfeit)
+		return
+	}
+
+	// Shares are credited at the target the miner was assigned, not the
+	// target of the hash. Vardiff can change a miner's target partway
+	// through a job, and the assigned target is what keeps the credit
+	// proportional to the work done.
+	credit := submit.MinerTarget
+	if credit == 0 {
+		credit = submit.Target
+	}
+
+	share := Share{
+		JobID:      submit.JobID,
+		Nonce:      submit.Nonce,
+		Difficulty: difficulty.DifficultyFromTarget(credit, difficulty.PDiff),
+		Target:     submit.Target,
+		// The share will be rejected if sealed
+		Accepted: true,
+		MinerID:  submit.MinerID,
+		UserID:   submit.Username,
+	}
+
+	a.AddShare(share)
+}
+
+// Flush credits the shares stratum has accepted but the accountant has not
+// seen yet, processes the rewards still waiting out the grace window, and
+// checkpoints every open job. It is done by Listen, so it
+// returns once Listen gets to it, or when the context is done. Stratum should
+// stop accepting shares first, or more can arrive after the flush.
+func (a *Accountant) Flush(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case a.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ProcessReward seals the job the reward is for, and records what is owed
+// to each user.
+func (a *Accountant) ProcessReward(reward *Reward) {
+	rLog := acctLog.WithFields(log.Fields{
+		"job": reward.JobID,
+		"peg": reward.PoolReward / 1e8,
+	})
+	// Indication of a block being completed and us earning rewards
+	if !a.JobExists(reward.JobID) {
+		// TODO: We will still do the accounting so our numbers add up.
+		// 		But we should really see if we can do something to
+		//		payout our users if this happens. Like if we reboot
+		//		the pool, and didn't keep the user's pow. We could
+		//		just use the last blocks proportions or something.
+		rLog.Warnf("reward for job that does not exist")
+		a.JobsByMiner[reward.JobID] = NewShareMap()
+		a.JobsByUser[reward.JobID] = NewShareMap()
+	}
+
+	a.jobLock.Lock()
+	us := a.JobsByUser[reward.JobID]
+	ms := a.JobsByMiner[reward.JobID]
+
+	if us.TotalDiff != ms.TotalDiff {
+		rLog.Error("miner job sum and user job sum differ")
+	}
+	us.Seal()
+	ms.Seal()
+
+	// Setup the payout struct with all the proportional payouts.
+	// This will also calculate the pool cut
+	work := a.Scheme.Work(reward.JobID, a.JobsByUser)
+	pays := NewPayout(*reward, a.PoolFeeRate, work)
+	pays.Scheme = a.Scheme.Name()
+
+	dbErr := a.DB.FirstOrCreate(pays)
+	if dbErr.Error != nil {
+		// TODO: This is pretty bad. This means payments failed.
+		// 		We don't want to just panic and kill the pool.
+		//		Maybe, we can just write everything to a file,
+		//		and try to notify someone?
+
+		// TODO: Write to a file all the details so we can recover the payments
+		rLog.WithError(dbErr.Error).Error("failed to write payouts to database")
+	} else if err := a.retireCheckpoints(reward.JobID); err != nil {
+		// The miner checkpoints are ignored on recovery once the
+		// payouts exist, so this is just some extra rows.
+		rLog.WithError(err).Warn("failed to retire share checkpoints")
+	}
+
+	rLog.WithFields(log.Fields{"pool-diff": us.TotalDiff, "scheme": pays.Scheme, "paid-diff": work.TotalDiff}).Infof("pool stats")
+	a.jobLock.Unlock()
+}
+
 func (a *Accountant) AddShare(share Share) {
 	a.jobLock.Lock()
 	a.JobsByMiner[share.JobID].AddShare(share.MinerID, share)
 	a.JobsByUser[share.JobID].AddShare(share.UserID, share)
+	a.markDirty(share.JobID, CheckpointMiner, share.MinerID)
+	a.markDirty(share.JobID, CheckpointUser, share.UserID)
 	a.jobLock.Unlock()
 }
 
+// ForfeitShares takes back the credit a miner was given for a job. Stratum
+// forfeits the credit of miners caught with invalid work.
+func (a *Accountant) ForfeitShares(jobid int32, minerID, userID string, f stratum.Forfeit) {
+	a.jobLock.Lock()
+	defer a.jobLock.Unlock()
+	if _, ok := a.JobsByMiner[jobid]; !ok {
+		return
+	}
+	a.JobsByMiner[jobid].RemoveWork(minerID, f.Shares, f.Difficulty)
+	a.JobsByUser[jobid].RemoveWork(userID, f.Shares, f.Difficulty)
+	a.markDirty(jobid, CheckpointMiner, minerID)
+	a.markDirty(jobid, CheckpointUser, userID)
+	acctLog.WithFields(log.Fields{
+		"job":     jobid,
+		"minerid": minerID,
+		"userid":  userID,
+		"shares":  f.Shares,
+	}).Warnf("shares forfeited")
+}
+
 // NewJob adds a new job to the maps
 func (a *Accountant) NewJob(jobid int32) {
 	a.jobLock.Lock()
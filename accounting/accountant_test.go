@@ -0,0 +1,127 @@
+package accounting_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountant_RewardDelay(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	// Each connection to :memory: is a new database
+	db.DB().SetMaxOpenConns(1)
+
+	a := accountantForTests(t, db)
+	a.RewardDelay = 200 * time.Millisecond
+	subs := make(chan *stratum.ShareSubmission, 10)
+	a.SetSubmissions(subs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Listen(ctx)
+
+	a.JobChannel() <- 10
+	require.Eventually(func() bool { return a.JobExists(10) }, time.Second, 10*time.Millisecond)
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m1", Target: 0xffff000000000000}
+	a.RewardChannel() <- &Reward{JobID: 10, PoolReward: 100e8}
+
+	// A share in the grace window arrives after the block is rewarded
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m2", Target: 0xffff000000000000, Stale: true}
+
+	var pays OwedPayouts
+	require.Eventually(func() bool {
+		return db.Preload("UserPayouts").Where("job_id = ?", 10).First(&pays).Error == nil
+	}, 2*time.Second, 20*time.Millisecond)
+	require.Len(pays.UserPayouts, 1)
+	require.Equal(2, pays.UserPayouts[0].TotalSubmissions)
+}
+
+func TestAccountant_Forfeit(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	db.DB().SetMaxOpenConns(1)
+
+	a := accountantForTests(t, db)
+	// Leave time for the queued shares to be credited before the reward
+	a.RewardDelay = 200 * time.Millisecond
+	subs := make(chan *stratum.ShareSubmission, 10)
+	a.SetSubmissions(subs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Listen(ctx)
+
+	a.JobChannel() <- 10
+	require.Eventually(func() bool { return a.JobExists(10) }, time.Second, 10*time.Millisecond)
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m1", Target: 0xffff000000000000}
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m1", Target: 0xffff000000000000}
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u2", MinerID: "m2", Target: 0xffff000000000000}
+	// u1 was caught with invalid work, and loses the job's credit
+	subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m1", Forfeit: &stratum.Forfeit{Shares: 2, Difficulty: 2}}
+	a.RewardChannel() <- &Reward{JobID: 10, PoolReward: 100e8}
+
+	var pays OwedPayouts
+	require.Eventually(func() bool {
+		return db.Preload("UserPayouts").Where("job_id = ?", 10).First(&pays).Error == nil
+	}, 2*time.Second, 20*time.Millisecond)
+	require.Len(pays.UserPayouts, 1)
+	require.Equal("u2", pays.UserPayouts[0].UserID)
+	require.Equal(float64(1), pays.PoolDifficuty)
+}
+
+func TestAccountant_Flush(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	db.DB().SetMaxOpenConns(1)
+
+	a := accountantForTests(t, db)
+	a.RewardDelay = time.Hour
+	subs := make(chan *stratum.ShareSubmission, 10)
+	a.SetSubmissions(subs)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing flushes if the accountant is not listening
+	short, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stop()
+	require.Equal(context.DeadlineExceeded, a.Flush(short))
+
+	go a.Listen(ctx)
+	a.JobChannel() <- 10
+	require.Eventually(func() bool { return a.JobExists(10) }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		subs <- &stratum.ShareSubmission{JobID: 10, Username: "u1", MinerID: "m1", Target: 0xffff000000000000}
+	}
+
+	// The queued shares are credited and checkpointed
+	require.NoError(a.Flush(ctx))
+	b := accountantForTests(t, db)
+	require.True(b.JobExists(10))
+	require.Equal(3, b.JobsByUser[10].Sums["u1"].TotalShares)
+
+	// Rewards waiting out the grace window are not lost on shutdown
+	a.RewardChannel() <- &Reward{JobID: 10, PoolReward: 100e8}
+	require.NoError(a.Flush(ctx))
+	var pays OwedPayouts
+	require.NoError(db.Preload("UserPayouts").Where("job_id = ?", 10).First(&pays).Error)
+	require.Len(pays.UserPayouts, 1)
+
+	// The database is only closed once the accountant is done with it
+	cancel()
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second):
+		t.Fatal("accountant did not stop")
+	}
+}
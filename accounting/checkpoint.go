@@ -0,0 +1,235 @@
+package accounting
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	CheckpointUser  = "user"
+	CheckpointMiner = "miner"
+)
+
+// ShareCheckpoint is a ShareSum for a single user or miner on an open job.
+// The checkpoints are written as shares arrive, so a pool restart does not
+// lose the work done on the current block.
+type ShareCheckpoint struct {
+	JobID int32  `gorm:"primary_key;auto_increment:false"`
+	Kind  string `gorm:"primary_key"` // 'user' or 'miner'
+	Key   string `gorm:"primary_key"` // The userid or minerid
+
+	TotalDifficulty float64
+	TotalShares     int
+	FirstShare      time.Time
+	LastShare       time.Time
+	// Targets are hex encoded to avoid sql uint64 errors
+	Targets string
+}
+
+func NewShareCheckpoint(jobID int32, kind, key string, sum *ShareSum) ShareCheckpoint {
+	targets := make([]byte, TargetsKept*8)
+	for i, t := range sum.Targets {
+		binary.BigEndian.PutUint64(targets[i*8:], t)
+	}
+
+	return ShareCheckpoint{
+		JobID:           jobID,
+		Kind:            kind,
+		Key:             key,
+		TotalDifficulty: sum.TotalDifficulty,
+		TotalShares:     sum.TotalShares,
+		FirstShare:      sum.FirstShare,
+		LastShare:       sum.LastShare,
+		Targets:         hex.EncodeToString(targets),
+	}
+}
+
+// ShareSum rebuilds the sum the checkpoint was made from
+func (c ShareCheckpoint) ShareSum() (*ShareSum, error) {
+	sum := &ShareSum{
+		TotalDifficulty: c.TotalDifficulty,
+		TotalShares:     c.TotalShares,
+		FirstShare:      c.FirstShare,
+		LastShare:       c.LastShare,
+	}
+
+	targets, err := hex.DecodeString(c.Targets)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) != TargetsKept*8 {
+		return nil, fmt.Errorf("exp %d bytes of targets, found %d", TargetsKept*8, len(targets))
+	}
+	for i := range sum.Targets {
+		sum.Targets[i] = binary.BigEndian.Uint64(targets[i*8:])
+	}
+	return sum, nil
+}
+
+type checkpointKey struct {
+	JobID int32
+	Kind  string
+	Key   string
+}
+
+// markDirty notes a sum has changed since the last checkpoint.
+// The caller must hold the jobLock.
+func (a *Accountant) markDirty(jobID int32, kind, key string) {
+	a.dirty[checkpointKey{JobID: jobID, Kind: kind, Key: key}] = struct{}{}
+}
+
+// Checkpoint writes all changed share sums to the database
+func (a *Accountant) Checkpoint() error {
+	a.jobLock.Lock()
+	if len(a.dirty) == 0 {
+		a.jobLock.Unlock()
+		return nil
+	}
+
+	checkpoints := make([]ShareCheckpoint, 0, len(a.dirty))
+	for k := range a.dirty {
+		jobs := a.JobsByUser
+		if k.Kind == CheckpointMiner {
+			jobs = a.JobsByMiner
+		}
+		m, ok := jobs[k.JobID]
+		if !ok || m.Sealed {
+			continue // Job is complete, nothing to save
+		}
+		sum, ok := m.Sums[k.Key]
+		if !ok {
+			continue
+		}
+		checkpoints = append(checkpoints, NewShareCheckpoint(k.JobID, k.Kind, k.Key, sum))
+	}
+	a.dirty = make(map[checkpointKey]struct{})
+	a.jobLock.Unlock()
+
+	tx := a.DB.Begin()
+	for i := range checkpoints {
+		if dbErr := tx.Save(&checkpoints[i]); dbErr.Error != nil {
+			tx.Rollback()
+			return dbErr.Error
+		}
+	}
+	return tx.Commit().Error
+}
+
+// ClearCheckpoints removes the checkpoints for a job. Once the payouts for a
+// job are written, we no longer need them.
+func (a *Accountant) ClearCheckpoints(jobID int32) error {
+	return a.DB.Where("job_id = ?", jobID).Delete(ShareCheckpoint{}).Error
+}
+
+// retireCheckpoints replaces the checkpoints of a paid job with its final
+// user sums, as later payouts may still include its work. The checkpoints of
+// paid jobs outside every future payout window are removed.
+// The caller must hold the jobLock.
+func (a *Accountant) retireCheckpoints(jobID int32) error {
+	// The next payout is at least for the next job, so any job at or
+	// before the cutoff is never paid on again.
+	cutoff := jobID + 1 - a.Scheme.Window()
+
+	tx := a.DB.Begin()
+	if jobID > cutoff {
+		if dbErr := tx.Where("job_id = ?", jobID).Delete(ShareCheckpoint{}); dbErr.Error != nil {
+			tx.Rollback()
+			return dbErr.Error
+		}
+		if us, ok := a.JobsByUser[jobID]; ok {
+			for user, sum := range us.Sums {
+				c := NewShareCheckpoint(jobID, CheckpointUser, user, sum)
+				if dbErr := tx.Save(&c); dbErr.Error != nil {
+					tx.Rollback()
+					return dbErr.Error
+				}
+			}
+		}
+	}
+
+	dbErr := tx.Where("job_id <= ? AND job_id IN (?)", cutoff,
+		a.DB.Table("owed_payouts").Select("job_id").QueryExpr()).
+		Delete(ShareCheckpoint{})
+	if dbErr.Error != nil {
+		tx.Rollback()
+		return dbErr.Error
+	}
+	return tx.Commit().Error
+}
+
+// RecoverCheckpoints rebuilds the share maps of any jobs that were open
+// when the pool stopped. Paid jobs only have their user sums recovered, so
+// the payout window is whole again, and they stay sealed.
+func (a *Accountant) RecoverCheckpoints() error {
+	var checkpoints []ShareCheckpoint
+	if err := a.DB.Find(&checkpoints).Error; err != nil {
+		return err
+	}
+
+	var paidIDs []int32
+	if err := a.DB.Table("owed_payouts").Pluck("job_id", &paidIDs).Error; err != nil {
+		return err
+	}
+	paid := make(map[int32]bool)
+	for _, id := range paidIDs {
+		paid[id] = true
+	}
+
+	a.jobLock.Lock()
+	defer a.jobLock.Unlock()
+	recovered := make(map[int32]int)
+	for _, c := range checkpoints {
+		if paid[c.JobID] && c.Kind != CheckpointUser {
+			continue
+		}
+
+		sum, err := c.ShareSum()
+		if err != nil {
+			acctLog.WithError(err).WithFields(log.Fields{"job": c.JobID, "key": c.Key}).Errorf("bad checkpoint")
+			continue
+		}
+
+		if paid[c.JobID] {
+			// Only kept for the payout window. The job does not
+			// exist, as it takes no more shares.
+			if _, ok := a.JobsByUser[c.JobID]; !ok {
+				a.JobsByUser[c.JobID] = NewShareMap()
+			}
+			m := a.JobsByUser[c.JobID]
+			m.Sums[c.Key] = sum
+			m.TotalDiff += sum.TotalDifficulty
+			continue
+		}
+
+		jobs := a.JobsByUser
+		if c.Kind == CheckpointMiner {
+			jobs = a.JobsByMiner
+		}
+		if _, ok := jobs[c.JobID]; !ok {
+			a.JobsByUser[c.JobID] = NewShareMap()
+			a.JobsByMiner[c.JobID] = NewShareMap()
+		}
+
+		m := jobs[c.JobID]
+		m.Sums[c.Key] = sum
+		m.TotalDiff += sum.TotalDifficulty
+		if c.Kind == CheckpointUser {
+			recovered[c.JobID]++
+		}
+	}
+
+	for id := range paid {
+		if m, ok := a.JobsByUser[id]; ok {
+			m.Seal()
+		}
+	}
+
+	for job, users := range recovered {
+		acctLog.WithFields(log.Fields{"job": job, "users": users}).Infof("recovered shares from checkpoint")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package accounting_test
+
+import (
+	"testing"
+
+	. "github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func accountantForTests(t *testing.T, db *gorm.DB) *Accountant {
+	conf := viper.New()
+	config.SetDefaults(conf)
+	a, err := NewAccountant(conf, db)
+	require.NoError(t, err)
+	return a
+}
+
+func TestAccountant_RecoverCheckpoints(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+
+	a := accountantForTests(t, db)
+	a.NewJob(10)
+	a.NewJob(11)
+	for i := 0; i < 5; i++ {
+		a.AddShare(Share{JobID: 10, Difficulty: 2, Target: 0xffff000000000000 + uint64(i), MinerID: "m1", UserID: "u1"})
+		a.AddShare(Share{JobID: 10, Difficulty: 1, Target: 0xffff000000000000, MinerID: "m2", UserID: "u2"})
+		a.AddShare(Share{JobID: 11, Difficulty: 1, Target: 0xffff000000000000, MinerID: "m1", UserID: "u1"})
+	}
+	require.NoError(a.Checkpoint())
+
+	// Job 11 was paid out before the restart
+	require.NoError(db.Create(&OwedPayouts{Reward: Reward{JobID: 11}}).Error)
+
+	// "Restart" the pool
+	b := accountantForTests(t, db)
+	require.True(b.JobExists(10))
+	require.False(b.JobExists(11))
+
+	for _, m := range []*ShareMap{a.JobsByUser[10], a.JobsByMiner[10]} {
+		require.Equal(float64(15), m.TotalDiff)
+	}
+	require.Equal(a.JobsByUser[10].TotalDiff, b.JobsByUser[10].TotalDiff)
+	require.Equal(a.JobsByMiner[10].TotalDiff, b.JobsByMiner[10].TotalDiff)
+	for k, exp := range a.JobsByUser[10].Sums {
+		found := b.JobsByUser[10].Sums[k]
+		require.NotNil(found)
+		require.Equal(exp.TotalShares, found.TotalShares)
+		require.Equal(exp.TotalDifficulty, found.TotalDifficulty)
+		require.Equal(exp.Targets, found.Targets)
+	}
+
+	// New shares are added on top of the recovered work
+	b.AddShare(Share{JobID: 10, Difficulty: 1, MinerID: "m1", UserID: "u1"})
+	require.Equal(float64(11), b.JobsByUser[10].Sums["u1"].TotalDifficulty)
+	require.NoError(b.Checkpoint())
+	c := accountantForTests(t, db)
+	require.Equal(float64(11), c.JobsByUser[10].Sums["u1"].TotalDifficulty)
+
+	// Once paid, the checkpoints are cleared
+	require.NoError(b.ClearCheckpoints(10))
+	d := accountantForTests(t, db)
+	require.False(d.JobExists(10))
+}
+
+func TestAccountant_PPLNSRestart(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	db.DB().SetMaxOpenConns(1)
+
+	a := accountantForTests(t, db)
+	a.Scheme = PPLNS{Blocks: 2}
+	a.NewJob(10)
+	a.AddShare(Share{JobID: 10, Difficulty: 10, MinerID: "m1", UserID: "u1"})
+	require.NoError(a.Checkpoint())
+	a.ProcessReward(&Reward{JobID: 10, PoolReward: 100e8})
+
+	// "Restart" the pool. The paid job is still in the window, but takes
+	// no more shares.
+	b := accountantForTests(t, db)
+	b.Scheme = PPLNS{Blocks: 2}
+	require.False(b.JobExists(10))
+	require.Equal(float64(10), b.JobsByUser[10].Sums["u1"].TotalDifficulty)
+
+	b.NewJob(11)
+	b.AddShare(Share{JobID: 11, Difficulty: 5, MinerID: "m1", UserID: "u1"})
+	b.ProcessReward(&Reward{JobID: 11, PoolReward: 100e8})
+
+	var pays OwedPayouts
+	require.NoError(db.Preload("UserPayouts").Where("job_id = ?", 11).First(&pays).Error)
+	require.Len(pays.UserPayouts, 1)
+	require.Equal(float64(15), pays.PoolDifficuty)
+	require.Equal(float64(15), pays.UserPayouts[0].UserDifficuty, "work from before the restart is paid")
+
+	// Job 10 is outside every future window
+	var count int
+	require.NoError(db.Model(&ShareCheckpoint{}).Where("job_id = ?", 10).Count(&count).Error)
+	require.Equal(0, count)
+	require.NoError(db.Model(&ShareCheckpoint{}).Where("job_id = ?", 11).Count(&count).Error)
+	require.Equal(1, count, "only the user sum is kept")
+}
@@ -6,6 +6,19 @@ import (
 
 	"github.com/FactomWyomingEntity/prosper-pool/authentication"
 	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// Payment statuses
+const (
+	// PaidConfirmed payments were checked to be on chain when recorded
+	PaidConfirmed = "confirmed"
+	// PaidPending payments could not be confirmed when recorded. They still
+	// count against the user's balance, so they are never paid twice.
+	PaidPending = "pending"
+	// PaidFailed payments were rejected by pegnetd. They do not count
+	// against the user's balance, so they are paid again.
+	PaidFailed = "failed"
 )
 
 type Paid struct {
@@ -14,6 +27,7 @@ type Paid struct {
 	UserID        string `gorm:"index:user_id"`
 	PayoutAddress string
 	PaymentAmount int64
+	Status        string `gorm:"default:'confirmed'"`
 
 	// tmp fields for debugging
 	TotalOwed int64 `gorm:"-"`
@@ -21,28 +35,34 @@ type Paid struct {
 }
 
 // CalculatePayments does not insert the payments. It just preps them for
-// insert
+// insert. Only balances at or above the user's minimum payout are included.
 func (a *Accountant) CalculatePayments() ([]Paid, error) {
+	payments, _, err := a.CalculatePaymentsWithheld()
+	return payments, err
+}
+
+// CalculatePaymentsWithheld returns the payments to make, and the balances
+// withheld for being below the user's minimum payout. Withheld balances
+// carry forward to the next payout.
+func (a *Accountant) CalculatePaymentsWithheld() (payments []Paid, withheld []Paid, err error) {
 	var users []authentication.User
-	err := a.DB.Find(&users).Error
+	err = a.DB.Find(&users).Error
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Entryhash will not be filled out, since we don't know it yet
-	var payments []Paid
-
 	for _, u := range users {
 		var p Paid
 		p.UserID = u.UID
 		p.PayoutAddress = u.PayoutAddress
-		// Sum up what we paid
+		// Sum up what we paid, including pending payments
 		var paid sql.NullInt64
 		paidRow := a.DB.Table("paids").
-			Where("user_id = ?", u.UID).Select("sum(payment_amount)").Row()
+			Where("user_id = ? AND status <> ?", u.UID, PaidFailed).Select("sum(payment_amount)").Row()
 		err = paidRow.Scan(&paid)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		p.TotalPaid = paid.Int64
 
@@ -52,17 +72,31 @@ func (a *Accountant) CalculatePayments() ([]Paid, error) {
 			Where("user_id = ?", u.UID).Select("sum(payout)").Row()
 		err = owedRow.Scan(&owed)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		p.TotalOwed = owed.Int64
 
 		p.PaymentAmount = p.TotalOwed - p.TotalPaid
-		if p.PaymentAmount != 0 { // Don't include 0 payments
+		switch {
+		case p.PaymentAmount == 0: // Don't include 0 payments
+		case p.PaymentAmount < 0:
+			acctLog.WithFields(log.Fields{"user": u.UID, "balance": p.PaymentAmount}).Warn("user has been overpaid")
+		case p.PaymentAmount < a.minimumPayout(u):
+			withheld = append(withheld, p)
+		default:
 			payments = append(payments, p)
 		}
 	}
 
-	return payments, nil
+	return payments, withheld, nil
+}
+
+// minimumPayout is the user's minimum if set, otherwise the pool's
+func (a *Accountant) minimumPayout(u authentication.User) int64 {
+	if u.MinimumPayout > 0 {
+		return u.MinimumPayout
+	}
+	return a.MinimumPayout
 }
 
 func (a *Accountant) WritePayments(payments []Paid) error {
@@ -70,13 +104,21 @@ func (a *Accountant) WritePayments(payments []Paid) error {
 		return fmt.Errorf("no payments to record")
 	}
 
-	if payments[0].EntryHash == "" {
-		return fmt.Errorf("this is not a receipt, no entryhash")
+	// A receipt can span many entries. Every one must be new.
+	hashes := make(map[string]struct{})
+	for _, payment := range payments {
+		if payment.EntryHash == "" {
+			return fmt.Errorf("this is not a receipt, the payment to %s has no entryhash", payment.UserID)
+		}
+		hashes[payment.EntryHash] = struct{}{}
 	}
-	var f Paid
-	res := a.DB.Model(&Paid{}).Where("entry_hash = ?", payments[0].EntryHash).First(&f)
-	if res.RowsAffected > 0 {
-		return fmt.Errorf("this tx is already recorded")
+
+	for hash := range hashes {
+		var f Paid
+		res := a.DB.Model(&Paid{}).Where("entry_hash = ?", hash).First(&f)
+		if res.RowsAffected > 0 {
+			return fmt.Errorf("the tx %s is already recorded", hash)
+		}
 	}
 
 	tx := a.DB.Begin()
@@ -90,3 +132,20 @@ func (a *Accountant) WritePayments(payments []Paid) error {
 
 	return tx.Commit().Error
 }
+
+// SetPaymentStatus updates the status of all the payments in an entry
+func (a *Accountant) SetPaymentStatus(entryHash, status string) error {
+	return a.DB.Model(&Paid{}).Where("entry_hash = ?", entryHash).Update("status", status).Error
+}
+
+// RemovePayments removes the payments of an entry that was never submitted
+func (a *Accountant) RemovePayments(entryHash string) error {
+	return a.DB.Unscoped().Where("entry_hash = ?", entryHash).Delete(&Paid{}).Error
+}
+
+// PendingPayments returns all payments that are not yet confirmed
+func (a *Accountant) PendingPayments() ([]Paid, error) {
+	var pending []Paid
+	err := a.DB.Where("status = ?", PaidPending).Find(&pending).Error
+	return pending, err
+}
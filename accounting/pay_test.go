@@ -0,0 +1,122 @@
+package accounting_test
+
+import (
+	"testing"
+
+	. "github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/authentication"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountant_CalculatePaymentsWithheld(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	db.AutoMigrate(&authentication.User{})
+
+	a := accountantForTests(t, db)
+	// Nothing is withheld unless the pool sets a minimum
+	require.Equal(int64(0), a.MinimumPayout)
+	a.MinimumPayout = 1e8
+
+	users := []struct {
+		User authentication.User
+		Owed int64
+	}{
+		{authentication.User{UID: "paid"}, 2e8},
+		{authentication.User{UID: "dust"}, 5e7},
+		{authentication.User{UID: "lowered", MinimumPayout: 1e7}, 5e7},
+		{authentication.User{UID: "raised", MinimumPayout: 5e8}, 2e8},
+		{authentication.User{UID: "empty"}, 0},
+	}
+	for i, u := range users {
+		require.NoError(db.Create(&u.User).Error)
+		require.NoError(db.Create(&UserOwedPayouts{JobID: int32(i + 1), UserID: u.User.UID, Payout: u.Owed}).Error)
+	}
+
+	uids := func(pays []Paid) []string {
+		var ids []string
+		for _, p := range pays {
+			ids = append(ids, p.UserID)
+		}
+		return ids
+	}
+
+	payments, withheld, err := a.CalculatePaymentsWithheld()
+	require.NoError(err)
+	require.ElementsMatch([]string{"paid", "lowered"}, uids(payments))
+	require.ElementsMatch([]string{"dust", "raised"}, uids(withheld))
+
+	// Withheld balances carry forward until they reach the minimum
+	for i := range payments {
+		payments[i].EntryHash = "e1"
+	}
+	require.NoError(a.WritePayments(payments))
+	require.NoError(db.Create(&UserOwedPayouts{JobID: 10, UserID: "dust", Payout: 5e7}).Error)
+
+	payments, withheld, err = a.CalculatePaymentsWithheld()
+	require.NoError(err)
+	require.ElementsMatch([]string{"dust"}, uids(payments))
+	require.Equal(int64(1e8), payments[0].PaymentAmount)
+	require.ElementsMatch([]string{"raised"}, uids(withheld))
+
+	// Pending payments count against the balance, failed ones do not
+	for i := range payments {
+		payments[i].EntryHash = "e2"
+		payments[i].Status = PaidPending
+	}
+	require.NoError(a.WritePayments(payments))
+	payments, _, err = a.CalculatePaymentsWithheld()
+	require.NoError(err)
+	require.Empty(payments)
+
+	require.NoError(a.SetPaymentStatus("e2", PaidFailed))
+	payments, _, err = a.CalculatePaymentsWithheld()
+	require.NoError(err)
+	require.ElementsMatch([]string{"dust"}, uids(payments))
+
+	// Payments that were never submitted are removed
+	require.NoError(a.RemovePayments("e2"))
+	var count int
+	require.NoError(db.Model(&Paid{}).Unscoped().Where("entry_hash = ?", "e2").Count(&count).Error)
+	require.Equal(0, count)
+}
+
+func TestAccountant_WritePayments(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+
+	a := accountantForTests(t, db)
+
+	// A receipt split across entries
+	receipt := []Paid{
+		{UserID: "u1", PaymentAmount: 1, EntryHash: "e1"},
+		{UserID: "u2", PaymentAmount: 2, EntryHash: "e1"},
+		{UserID: "u3", PaymentAmount: 3, EntryHash: "e2"},
+	}
+	require.NoError(a.WritePayments(receipt))
+
+	var count int
+	require.NoError(db.Model(&Paid{}).Count(&count).Error)
+	require.Equal(3, count)
+
+	// Any entry already recorded refuses the whole receipt
+	require.Error(a.WritePayments([]Paid{
+		{UserID: "u1", PaymentAmount: 1, EntryHash: "e3"},
+		{UserID: "u3", PaymentAmount: 3, EntryHash: "e2"},
+	}))
+
+	// Every payment needs an entryhash
+	require.Error(a.WritePayments([]Paid{
+		{UserID: "u1", PaymentAmount: 1, EntryHash: "e4"},
+		{UserID: "u3", PaymentAmount: 3},
+	}))
+
+	require.NoError(db.Model(&Paid{}).Count(&count).Error)
+	require.Equal(3, count)
+}
@@ -0,0 +1,104 @@
+package accounting
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/spf13/viper"
+)
+
+const (
+	SchemeProportional = "proportional"
+	SchemePPLNS        = "pplns"
+)
+
+// PayoutScheme decides the work a block reward is distributed over.
+type PayoutScheme interface {
+	// Name is recorded on every payout, so past payouts can be audited
+	Name() string
+	// Window is the number of blocks, up to and including the rewarded
+	// one, that the reward is split over. The work of a paid block is kept
+	// until it is outside every future window.
+	Window() int32
+	// Work returns the work the reward for the job is split by. The jobs
+	// are all the user share maps the accountant has, indexed by job id.
+	Work(jobID int32, jobs map[int32]*ShareMap) ShareMap
+}
+
+func NewPayoutScheme(conf *viper.Viper) (PayoutScheme, error) {
+	switch strings.ToLower(conf.GetString(config.ConfigPoolPayoutScheme)) {
+	case "", SchemeProportional:
+		return new(Proportional), nil
+	case SchemePPLNS:
+		window := conf.GetFloat64(config.ConfigPoolPPLNSWindow)
+		if window < 1 || window != math.Trunc(window) {
+			return nil, fmt.Errorf("pplns window must be a whole number of blocks, at least 1, found %v", window)
+		}
+		return &PPLNS{Blocks: int32(window)}, nil
+	default:
+		return nil, fmt.Errorf("unknown payout scheme '%s'", conf.GetString(config.ConfigPoolPayoutScheme))
+	}
+}
+
+// Proportional pays each block by the work done on that block alone.
+type Proportional struct{}
+
+func (Proportional) Name() string { return SchemeProportional }
+
+func (Proportional) Window() int32 { return 1 }
+
+func (Proportional) Work(jobID int32, jobs map[int32]*ShareMap) ShareMap {
+	if work, ok := jobs[jobID]; ok {
+		return *work
+	}
+	return *NewShareMap()
+}
+
+// PPLNS is Pay-Per-Last-N-Shares. The reward is split by the work done on
+// the last N blocks, so a miner that joins late in a block is still paid for
+// their work on the next block, and hopping in and out of the pool does not
+// pay off.
+//
+// N is a number of blocks, up to and including the rewarded one. A window of
+// 2 pays on the work of the rewarded block and the block before it. The
+// window is the same size no matter how much work was done on the rewarded
+// block, even none at all.
+type PPLNS struct {
+	Blocks int32
+}
+
+func (PPLNS) Name() string { return SchemePPLNS }
+
+func (p PPLNS) Window() int32 { return p.Blocks }
+
+func (p PPLNS) Work(jobID int32, jobs map[int32]*ShareMap) ShareMap {
+	work := NewShareMap()
+
+	// The current job's sums are kept as is, as they are used to estimate
+	// the user hashrates. Older jobs only add to the difficulty.
+	if current, ok := jobs[jobID]; ok {
+		for user, sum := range current.Sums {
+			cpy := *sum
+			work.Sums[user] = &cpy
+		}
+		work.TotalDiff = current.TotalDiff
+	}
+
+	for id := jobID - p.Blocks + 1; id < jobID; id++ {
+		job, ok := jobs[id]
+		if !ok {
+			continue // The pool was not mining
+		}
+		for user, sum := range job.Sums {
+			if _, ok := work.Sums[user]; !ok {
+				work.Sums[user] = new(ShareSum)
+			}
+			work.Sums[user].TotalDifficulty += sum.TotalDifficulty
+		}
+		work.TotalDiff += job.TotalDiff
+	}
+
+	return *work
+}
@@ -0,0 +1,105 @@
+package accounting_test
+
+import (
+	"testing"
+
+	. "github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPayoutScheme(t *testing.T) {
+	conf := viper.New()
+	config.SetDefaults(conf)
+	s, err := NewPayoutScheme(conf)
+	require.NoError(t, err)
+	require.Equal(t, SchemeProportional, s.Name())
+
+	conf.Set(config.ConfigPoolPayoutScheme, "PPLNS")
+	s, err = NewPayoutScheme(conf)
+	require.NoError(t, err)
+	require.Equal(t, SchemePPLNS, s.Name())
+
+	conf.Set(config.ConfigPoolPPLNSWindow, 3)
+	s, err = NewPayoutScheme(conf)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), s.Window())
+
+	// The window is a number of blocks
+	for _, window := range []float64{0.5, 2.5} {
+		conf.Set(config.ConfigPoolPPLNSWindow, window)
+		_, err = NewPayoutScheme(conf)
+		require.Error(t, err)
+	}
+
+	conf.Set(config.ConfigPoolPayoutScheme, "unknown")
+	_, err = NewPayoutScheme(conf)
+	require.Error(t, err)
+}
+
+func TestPPLNS_Work(t *testing.T) {
+	require := require.New(t)
+	jobs := make(map[int32]*ShareMap)
+	for _, id := range []int32{8, 9, 10} {
+		jobs[id] = NewShareMap()
+	}
+
+	// Job 8: u1 did everything
+	jobs[8].AddShare("u1", Share{Difficulty: 100})
+	// Job 9: u2 joined late, only mining the end of the block
+	jobs[9].AddShare("u1", Share{Difficulty: 80})
+	jobs[9].AddShare("u2", Share{Difficulty: 20})
+	// Job 10: both mine the whole block
+	jobs[10].AddShare("u1", Share{Difficulty: 50})
+	jobs[10].AddShare("u2", Share{Difficulty: 50})
+
+	t.Run("proportional", func(t *testing.T) {
+		work := Proportional{}.Work(10, jobs)
+		require.Equal(float64(100), work.TotalDiff)
+		require.Equal(float64(50), work.Sums["u1"].TotalDifficulty)
+	})
+
+	t.Run("window of 1 is proportional", func(t *testing.T) {
+		work := PPLNS{Blocks: 1}.Work(10, jobs)
+		require.Equal(float64(100), work.TotalDiff)
+		require.Equal(float64(50), work.Sums["u1"].TotalDifficulty)
+		require.Equal(float64(50), work.Sums["u2"].TotalDifficulty)
+	})
+
+	t.Run("window spans jobs", func(t *testing.T) {
+		work := PPLNS{Blocks: 3}.Work(10, jobs)
+		require.Equal(float64(300), work.TotalDiff)
+		// 50 + 80 + 100
+		require.Equal(float64(230), work.Sums["u1"].TotalDifficulty)
+		require.Equal(float64(70), work.Sums["u2"].TotalDifficulty)
+
+		// The current job's sums are untouched
+		require.Equal(float64(50), jobs[10].Sums["u1"].TotalDifficulty)
+		require.Equal(1, work.Sums["u1"].TotalShares)
+	})
+
+	t.Run("window larger than history", func(t *testing.T) {
+		work := PPLNS{Blocks: 10}.Work(10, jobs)
+		require.Equal(float64(300), work.TotalDiff)
+	})
+
+	t.Run("window is the same size for an empty block", func(t *testing.T) {
+		jobs[11] = NewShareMap()
+		work := PPLNS{Blocks: 2}.Work(11, jobs)
+		require.Equal(float64(100), work.TotalDiff)
+		require.Equal(float64(50), work.Sums["u1"].TotalDifficulty)
+		delete(jobs, 11)
+	})
+
+	t.Run("users only in older jobs are paid", func(t *testing.T) {
+		jobs[9].AddShare("u3", Share{Difficulty: 100})
+		work := PPLNS{Blocks: 2}.Work(10, jobs)
+		require.NotNil(work.Sums["u3"])
+
+		// Users without shares this block should not break the payouts
+		pays := NewPayout(Reward{JobID: 10, PoolReward: 100e8}, decimal.New(0, 0), work)
+		require.Len(pays.UserPayouts, 3)
+	})
+}
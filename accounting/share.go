@@ -19,6 +19,9 @@ type OwedPayouts struct {
 	// to a user or to the pool. We should account for it if it happens.
 	Dust int64 `json:"dust"`
 
+	// Scheme is the payout scheme used to split the reward
+	Scheme string `gorm:"default:'proportional'" json:"scheme"`
+
 	PoolDifficuty float64 `json:"pooldifficulty"`
 	PDiff         string  `gorm:"default:'ffff000000000000'" json:"pdiff"` // String to avoid sql uint64 errors
 	TotalHashrate float64 `gorm:"default:0" json:"totalhashrate"`
@@ -41,14 +44,17 @@ func (p *OwedPayouts) Payouts(work ShareMap, remaining int64) {
 	p.PoolDifficuty = work.TotalDiff
 	var totalPayout int64
 	for user, work := range work.Sums {
+		if work.TotalDifficulty <= 0 {
+			continue // All of their work was forfeited
+		}
 		prop := decimal.NewFromFloat(work.TotalDifficulty).Div(decimal.NewFromFloat(p.PoolDifficuty))
 		prop = prop.Truncate(AccountingPrecision)
 
 		// Last hashrate is the best guess
-		hashrate := work.LastHashrate()
-		if work.TotalShares < 5 {
-			// If there is too few shares, don't bother trying to calc a hashrate
-			hashrate = 0
+		// If there is too few shares, don't bother trying to calc a hashrate
+		var hashrate float64
+		if work.TotalShares >= 5 {
+			hashrate = work.LastHashrate()
 		}
 
 		pay := UserOwedPayouts{
@@ -153,6 +159,28 @@ func (m *ShareMap) AddShare(key string, s Share) {
 	m.Sums[key].AddShare(s)
 }
 
+// RemoveWork takes shares back from the key's sum. A sum never goes below
+// zero, so only what was credited can be taken back.
+func (m *ShareMap) RemoveWork(key string, shares int, diff float64) {
+	if m.Sealed {
+		return
+	}
+
+	sum, ok := m.Sums[key]
+	if !ok {
+		return
+	}
+	if diff > sum.TotalDifficulty {
+		diff = sum.TotalDifficulty
+	}
+	if shares > sum.TotalShares {
+		shares = sum.TotalShares
+	}
+	m.TotalDiff -= diff
+	sum.TotalDifficulty -= diff
+	sum.TotalShares -= shares
+}
+
 const (
 	TargetsKept = 30
 )
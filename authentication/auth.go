@@ -2,6 +2,7 @@ package authentication
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/qor/roles"
@@ -10,6 +11,7 @@ import (
 	"github.com/qor/auth"
 	"github.com/qor/auth/auth_identity"
 	"github.com/qor/auth/authority"
+	"github.com/qor/auth/providers/password"
 	"github.com/qor/auth_themes/clean"
 	"github.com/qor/session/manager"
 	log "github.com/sirupsen/logrus"
@@ -34,6 +36,12 @@ type User struct {
 	UID           string `gorm:"column:uid"`
 	Role          string
 	PayoutAddress string `gorm:"default:''"`
+	// MinimumPayout overrides the pool minimum payout if it is above 0.
+	// In factoshis.
+	MinimumPayout int64 `gorm:"default:0"`
+	// StratumPasswordRequired will reject any miner that does not
+	// authorize with the user's password
+	StratumPasswordRequired bool `gorm:"default:false"`
 }
 
 type HotfixedAuthIdentity auth_identity.AuthIdentity
@@ -84,6 +92,34 @@ func (a Authenticator) Exists(uid string) bool {
 	return false
 }
 
+// CheckPassword returns true if the password is the user's login password
+func (a Authenticator) CheckPassword(uid, pass string) bool {
+	provider, ok := a.GetProvider("password").(*password.Provider)
+	if !ok {
+		return false
+	}
+
+	var info auth_identity.Basic
+	dbErr := a.DB.Model(&HotfixedAuthIdentity{}).
+		Where("provider = ? AND uid = ?", provider.GetName(), uid).Scan(&info)
+	if dbErr.Error != nil {
+		return false
+	}
+
+	return provider.Encryptor.Compare(info.EncryptedPassword, strings.TrimSpace(pass)) == nil
+}
+
+// StratumPasswordRequired returns true if the user only allows miners that
+// provide their password
+func (a Authenticator) StratumPasswordRequired(uid string) bool {
+	var u User
+	dbErr := a.DB.Where("uid = ?", uid).First(&u)
+	if dbErr.Error != nil {
+		return false
+	}
+	return u.StratumPasswordRequired
+}
+
 func (a Authenticator) GetSessionManager(mux *http.ServeMux) http.Handler {
 	return manager.SessionManager.Middleware(mux)
 }
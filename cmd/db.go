@@ -1,19 +1,26 @@
 package cmd
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
 
 	"github.com/FactomWyomingEntity/prosper-pool/web"
 
 	"github.com/FactomWyomingEntity/prosper-pool/accounting"
 
 	"github.com/Factom-Asset-Tokens/base58"
+	"github.com/Factom-Asset-Tokens/factom"
 	"github.com/FactomWyomingEntity/prosper-pool/authentication"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
 	"github.com/FactomWyomingEntity/prosper-pool/database"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
+	"github.com/FactomWyomingEntity/prosper-pool/payout"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -23,6 +30,12 @@ func init() {
 	db.AddCommand(makeCode)
 	db.AddCommand(makePayments)
 	db.AddCommand(recordPayments)
+	db.AddCommand(userMinPayout)
+	db.AddCommand(confirmPayments)
+	db.AddCommand(userStratumPassword)
+
+	recordPayments.Flags().Bool("pending", false, "Record payments that cannot be confirmed as pending, instead of refusing the receipt")
+	confirmPayments.Flags().String("failed", "", "Mark the pending payments of an entry that never made it on chain as failed, so they are paid again")
 	rootCmd.AddCommand(db)
 }
 
@@ -73,16 +86,135 @@ var recordPayments = &cobra.Command{
 			return err
 		}
 
+		// Every entry in the receipt must be on chain, pay what the
+		// receipt says, and be applied by pegnetd
+		failed, err := checkReceipt(payments)
+		if err != nil {
+			return err
+		}
+		var unconfirmed int
+		for hash, err := range failed {
+			if err == payout.ErrBatchRejected {
+				fmt.Printf("Entry %s was rejected, its payments are recorded as failed\n", hash)
+				continue
+			}
+			fmt.Printf("Entry %s is not confirmed: %s\n", hash, err.Error())
+			unconfirmed++
+		}
+
+		pending, _ := cmd.Flags().GetBool("pending")
+		if unconfirmed > 0 && !pending {
+			return fmt.Errorf("%d entries could not be confirmed, nothing was recorded. "+
+				"Use --pending to record them as pending", unconfirmed)
+		}
+
+		var pendingCount int
+		for i := range payments {
+			payments[i].Status = accounting.PaidConfirmed
+			if err, ok := failed[payments[i].EntryHash]; ok {
+				payments[i].Status = accounting.PaidPending
+				if err == payout.ErrBatchRejected {
+					payments[i].Status = accounting.PaidFailed
+					continue
+				}
+				pendingCount++
+			}
+		}
+
 		err = a.WritePayments(payments)
 		if err != nil {
 			return err
 		}
 
 		fmt.Println("Payment data recorded")
+		if pendingCount > 0 {
+			fmt.Printf("%d payments are pending. Run 'db confirm' once they are on chain\n", pendingCount)
+		}
 		return nil
 	},
 }
 
+var confirmPayments = &cobra.Command{
+	Use:     "confirm",
+	Short:   "Confirm any pending payments that are now on chain",
+	Example: "prosper db confirm",
+	Args:    cobra.NoArgs,
+	PreRun:  SoftReadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := database.New(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		a, err := accounting.NewAccountant(viper.GetViper(), db.DB)
+		if err != nil {
+			return err
+		}
+
+		if hash, _ := cmd.Flags().GetString("failed"); hash != "" {
+			dbErr := db.DB.Model(&accounting.Paid{}).Where("entry_hash = ? AND status = ?", hash, accounting.PaidPending).
+				Update("status", accounting.PaidFailed)
+			if dbErr.Error != nil {
+				return dbErr.Error
+			}
+			fmt.Printf("%d payments marked as failed\n", dbErr.RowsAffected)
+			return nil
+		}
+
+		pending, err := a.PendingPayments()
+		if err != nil {
+			return err
+		}
+
+		if len(pending) == 0 {
+			fmt.Println("No pending payments")
+			return nil
+		}
+
+		failed, err := checkReceipt(pending)
+		if err != nil {
+			return err
+		}
+
+		hashes := make(map[string]struct{})
+		for _, pay := range pending {
+			hashes[pay.EntryHash] = struct{}{}
+		}
+
+		for hash := range hashes {
+			if err, ok := failed[hash]; ok {
+				if err != payout.ErrBatchRejected {
+					fmt.Printf("Entry %s is still pending: %s\n", hash, err.Error())
+					continue
+				}
+				if err := a.SetPaymentStatus(hash, accounting.PaidFailed); err != nil {
+					return err
+				}
+				fmt.Printf("Entry %s was rejected, its payments will be made again\n", hash)
+				continue
+			}
+			if err := a.SetPaymentStatus(hash, accounting.PaidConfirmed); err != nil {
+				return err
+			}
+			fmt.Printf("Entry %s confirmed\n", hash)
+		}
+		return nil
+	},
+}
+
+// checkReceipt checks the receipt against factomd and pegnetd. The payments
+// must be from the payout address.
+func checkReceipt(payments []accounting.Paid) (map[string]error, error) {
+	source, err := factom.NewFAAddress(viper.GetString(config.ConfigPayoutFAAddress))
+	if err != nil {
+		return nil, fmt.Errorf("payout fa address: %s", err.Error())
+	}
+
+	cl := factomclient.FactomClientFromConfig(viper.GetViper())
+	pegnetd := factomclient.PegnetdClientFromConfig(viper.GetViper())
+	return payout.CheckReceipt(context.Background(), cl, pegnetd, source, payments), nil
+}
+
 var makePayments = &cobra.Command{
 	Use:     "payout <pay.json>",
 	Short:   "Will construct a payout tx for the pool",
@@ -106,7 +238,7 @@ var makePayments = &cobra.Command{
 			return err
 		}
 
-		payments, err := a.CalculatePayments()
+		payments, withheld, err := a.CalculatePaymentsWithheld()
 		if err != nil {
 			return err
 		}
@@ -116,6 +248,11 @@ var makePayments = &cobra.Command{
 			totalPay += pay.PaymentAmount
 		}
 
+		var totalWithheld int64
+		for _, pay := range withheld {
+			totalWithheld += pay.PaymentAmount
+		}
+
 		data, err := json.Marshal(payments)
 		if err != nil {
 			return err
@@ -134,6 +271,69 @@ var makePayments = &cobra.Command{
 
 		fmt.Println("Payment data written to file")
 		fmt.Printf("%s PEG needed for the TX\n", web.FactoshiToFactoid(uint64(totalPay)))
+		fmt.Printf("%d users below their minimum payout, %s PEG withheld until the next payout\n",
+			len(withheld), web.FactoshiToFactoid(uint64(totalWithheld)))
+		return nil
+	},
+}
+
+var userMinPayout = &cobra.Command{
+	Use:     "minpayout <uid> <amount>",
+	Short:   "Sets the minimum payout for a user in PEG",
+	Long:    "Balances below the user's minimum are carried forward. An amount of 0 uses the pool minimum.",
+	Example: "prosper db minpayout user@gmail.com 25.5",
+	PreRun:  SoftReadConfig,
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		min, err := decimal.NewFromString(args[1])
+		if err != nil {
+			return err
+		}
+		if min.IsNegative() {
+			return fmt.Errorf("minimum payout cannot be negative")
+		}
+
+		db, err := database.New(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		dbErr := db.DB.Model(&authentication.User{}).Where("uid = ?", args[0]).
+			Update("minimum_payout", min.Shift(accounting.AccountingPrecision).IntPart())
+		if dbErr.Error != nil {
+			return dbErr.Error
+		}
+
+		fmt.Printf("%d rows affected\n", dbErr.RowsAffected)
+		return nil
+	},
+}
+
+var userStratumPassword = &cobra.Command{
+	Use:       "stratumpassword <uid> <true|false>",
+	Short:     "Sets if a user's miners must authorize with their password",
+	Example:   "prosper db stratumpassword user@gmail.com true",
+	PreRun:    SoftReadConfig,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"true", "false"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		required, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+
+		db, err := database.New(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		dbErr := db.DB.Model(&authentication.User{}).Where("uid = ?", args[0]).
+			Update("stratum_password_required", required)
+		if dbErr.Error != nil {
+			return dbErr.Error
+		}
+
+		fmt.Printf("%d rows affected\n", dbErr.RowsAffected)
 		return nil
 	},
 }
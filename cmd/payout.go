@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/FactomWyomingEntity/prosper-pool/database"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
+	"github.com/FactomWyomingEntity/prosper-pool/payout"
+	"github.com/FactomWyomingEntity/prosper-pool/web"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	payoutNow.Flags().Bool("dry-run", false, "Calculate the payout without submitting it")
+	payoutStandIn.Flags().Int("port", 8088, "Port to serve the stand-in factomd on")
+	payoutStandIn.Flags().Int("confirm", 3, "Number of acks before an entry is reported as confirmed")
+
+	payoutCmd.AddCommand(payoutNow)
+	payoutCmd.AddCommand(payoutStandIn)
+	rootCmd.AddCommand(payoutCmd)
+}
+
+var payoutCmd = &cobra.Command{
+	Use:   "payout",
+	Short: "Automatic payout commands",
+	Long: "The pool can pay users automatically if the payout section of the config " +
+		"is set. These commands allow testing the payout outside the pool.",
+}
+
+var payoutNow = &cobra.Command{
+	Use:     "run",
+	Short:   "Run a single payout using the payout config",
+	Example: "prosper-pool payout run --dry-run",
+	PreRunE: HardReadConfig,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
+			viper.Set(config.ConfigPayoutDryRun, true)
+		}
+
+		db, err := database.New(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		a, err := accounting.NewAccountant(viper.GetViper(), db.DB)
+		if err != nil {
+			return err
+		}
+
+		s, err := payout.NewScheduler(viper.GetViper(), a, factomclient.FactomClientFromConfig(viper.GetViper()))
+		if err != nil {
+			return err
+		}
+
+		batches, err := s.PayOnce(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if len(batches) == 0 {
+			fmt.Println("Nothing to pay")
+			return nil
+		}
+
+		var total int64
+		for _, batch := range batches {
+			total += batch.Total()
+		}
+
+		payments := payout.Receipt(batches)
+		if s.DryRun {
+			fmt.Printf("Dry run: %d payments in %d batches for %s PEG\n", len(payments), len(batches), web.FactoshiToFactoid(uint64(total)))
+			return nil
+		}
+		fmt.Printf("Paid %d users %s PEG\n", len(payments), web.FactoshiToFactoid(uint64(total)))
+		for _, batch := range batches {
+			fmt.Printf("EntryHash: %s\n", batch.Entry.Hash.String())
+		}
+		return nil
+	},
+}
+
+var payoutStandIn = &cobra.Command{
+	Use:   "standin",
+	Short: "Launch a local stand-in factomd for testing payouts",
+	Long: "The stand-in accepts entries and reports them as confirmed after a few acks. " +
+		"It also answers as pegnetd, and reports confirmed entries as applied. " +
+		"Nothing is sent to the Factom network. Point the pool's factomd and pegnetd " +
+		"locations at it to test payouts end to end.",
+	Example: "prosper-pool payout standin --port 8188",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		port, _ := cmd.Flags().GetInt("port")
+		confirm, _ := cmd.Flags().GetInt("confirm")
+
+		log.Infof("stand-in factomd listening on http://localhost:%d/v2, and pegnetd on /v1", port)
+		standIn := payout.NewStandInFactomd(confirm)
+		mux := http.NewServeMux()
+		mux.Handle("/v2", standIn)
+		mux.Handle("/v1", standIn)
+		return http.ListenAndServe(fmt.Sprintf("localhost:%d", port), mux)
+	},
+}
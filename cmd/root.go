@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/FactomWyomingEntity/prosper-pool/accounting"
@@ -19,6 +20,7 @@ import (
 	"github.com/FactomWyomingEntity/prosper-pool/database"
 	"github.com/FactomWyomingEntity/prosper-pool/engine"
 	"github.com/FactomWyomingEntity/prosper-pool/exit"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
 	"github.com/FactomWyomingEntity/prosper-pool/loghelp"
 	"github.com/FactomWyomingEntity/prosper-pool/pegnet"
 	"github.com/FactomWyomingEntity/prosper-pool/polling"
@@ -136,6 +138,31 @@ var testStratum = &cobra.Command{
 						if len(words) > 4 {
 							_ = s.ReconnectClient(words[1], words[2], words[3], words[4])
 						}
+					case "bans":
+						for _, ban := range s.Bans.Bans(time.Now()) {
+							fmt.Printf("%s until %s, strikes %d, manual %t: %s\n", ban.Subject, ban.Until.Format(time.RFC3339), ban.Strikes, ban.Manual, ban.Reason)
+						}
+					case "ban":
+						// ban <ip:address|user:username> <duration> [reason]
+						if len(words) > 2 {
+							duration, err := time.ParseDuration(words[2])
+							if err != nil {
+								fmt.Println(err)
+								break
+							}
+							ban, err := s.Bans.Ban(words[1], duration, strings.Join(words[3:], " "), time.Now())
+							if err != nil {
+								fmt.Println(err)
+								break
+							}
+							fmt.Printf("banned %s until %s, disconnected %d\n", ban.Subject, ban.Until.Format(time.RFC3339), s.DisconnectSubject(ban.Subject))
+						}
+					case "unban":
+						if len(words) > 1 {
+							if err := s.Bans.Unban(words[1]); err != nil {
+								fmt.Println(err)
+							}
+						}
 					default:
 						fmt.Println("Server command not supported: ", words[0])
 					}
@@ -149,16 +176,17 @@ var testStratum = &cobra.Command{
 
 // rootPreRunSetup is run before the root command
 func rootPreRunSetup(cmd *cobra.Command, args []string) {
-	// Catch ctl+c
+	// Catch ctl+c, and the SIGTERM from docker or systemd
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signalChan
 		log.Info("Gracefully closing")
 
-		// We will give it 3 seconds to close gracefully.
-		// If anything is hanging beyond that, just kill it.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+		// The drain steps have their own timeouts. After them, we will
+		// give it 3 seconds to close gracefully. If anything is hanging
+		// beyond that, just kill it.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3+exit.GlobalExitHandler.DrainTimeout())
 		defer cancel()
 		err := exit.GlobalExitHandler.CloseWithTimeout(ctx)
 		if err != nil {
@@ -263,7 +291,9 @@ var testSync = &cobra.Command{
 			return db.Close()
 		})
 
-		p, err := pegnet.NewPegnetNode(conf, db)
+		factomd := factomclient.NewPool(conf)
+		go factomd.Run(ctx)
+		p, err := pegnet.NewPegnetNode(conf, db, factomd)
 		if err != nil {
 			panic(err)
 		}
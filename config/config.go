@@ -10,7 +10,23 @@ import (
 const (
 	LoggingLevel = "app.loglevel"
 
-	ConfigPoolCut = "pool.PoolFeeRate"
+	ConfigPoolCut           = "pool.PoolFeeRate"
+	ConfigPoolPayoutScheme  = "Pool.PayoutScheme"
+	ConfigPoolPPLNSWindow   = "Pool.PPLNSWindow"
+	ConfigPoolMinimumPayout = "Pool.MinimumPayout"
+
+	ConfigAccountingCheckpointInterval = "Accounting.CheckpointInterval"
+
+	ConfigPayoutEnabled          = "Payout.Enabled"
+	ConfigPayoutInterval         = "Payout.Interval"
+	ConfigPayoutDryRun           = "Payout.DryRun"
+	ConfigPayoutKeySource        = "Payout.KeySource"
+	ConfigPayoutFAAddress        = "Payout.FAAddress"
+	ConfigPayoutFsAddress        = "Payout.FsAddress"
+	ConfigPayoutECAddress        = "Payout.ECAddress"
+	ConfigPayoutESAddress        = "Payout.ESAddress"
+	ConfigPayoutConfirmTimeout   = "Payout.ConfirmTimeout"
+	ConfigPayoutReceiptDirectory = "Payout.ReceiptDirectory"
 
 	ConfigSQLHost     = "Database.host"
 	ConfigSQLPort     = "Database.port"
@@ -19,9 +35,15 @@ const (
 	ConfigSQLPassword = "Database.password"
 
 	ConfigFactomdLocation = "Factom.FactomdLocation"
+	ConfigWalletdLocation = "Factom.WalletdLocation"
+
+	ConfigFactomdLocations           = "Factom.FactomdLocations"
+	ConfigFactomdHealthCheckInterval = "Factom.HealthCheckInterval"
+	ConfigFactomdRequestTimeout      = "Factom.RequestTimeout"
 
 	ConfigPegnetPollingPeriod = "Pegnet.PollingPeriod"
 	ConfigPegnetRetryPeriod   = "Pegnet.RetryPeriod"
+	ConfigPegnetdLocation     = "Pegnet.PegnetdLocation"
 
 	Config1ForgeKey            = "Oracle.1ForgeKey"
 	ConfigApiLayerKey          = "Oracle.ApiLayerKey"
@@ -45,16 +67,63 @@ const (
 	ConfigPoolCoinbase  = "Pool.OPRCoinbase"
 	ConfigPoolESAddress = "Pool.ESAddress"
 
+	ConfigPoolJobRefreshInterval  = "Pool.JobRefreshInterval"
+	ConfigPoolJobRefreshThreshold = "Pool.JobRefreshThreshold"
+	ConfigPoolShutdownStepTimeout = "Pool.ShutdownStepTimeout"
+
 	ConfigSubmitterCutoff  = "Submit.SubmissionCutoff"
 	ConfigSubmitterEMAN    = "Submit.EMA-N"
 	ConfigSubmitterSoftMax = "Submit.SoftMax"
 
 	ConfigWebPort = "Web.Port"
 
-	ConfigStratumRequireAuth    = "Stratum.RequireAuth"
-	ConfigStratumPort           = "Stratum.StratumPort"
-	ConfigStratumWelcomeMessage = "Stratum.WelcomeMessage"
-	ConfigStratumCheckAllWork   = "Stratum.ValidateAllShares"
+	ConfigStratumRequireAuth       = "Stratum.RequireAuth"
+	ConfigStratumRequirePassword   = "Stratum.RequirePassword"
+	ConfigStratumAuthMaxFailures   = "Stratum.AuthMaxFailures"
+	ConfigStratumAuthMaxIPFailures = "Stratum.AuthMaxIPFailures"
+	ConfigStratumAuthLockout       = "Stratum.AuthLockoutDuration"
+	ConfigStratumPort              = "Stratum.StratumPort"
+	ConfigStratumWelcomeMessage    = "Stratum.WelcomeMessage"
+	ConfigStratumCheckAllWork      = "Stratum.ValidateAllShares"
+	ConfigStratumJobHistory        = "Stratum.JobHistory"
+
+	ConfigStratumPreviousJobGrace = "Stratum.PreviousJobGrace"
+	ConfigStratumSessionTTL       = "Stratum.SessionTTL"
+
+	ConfigStratumWriteTimeout      = "Stratum.WriteTimeout"
+	ConfigStratumNotifyMaxFailures = "Stratum.NotifyMaxFailures"
+	ConfigStratumRequestTimeout    = "Stratum.RequestTimeout"
+
+	ConfigStratumShutdownRedirectHost = "Stratum.ShutdownRedirectHost"
+	ConfigStratumShutdownRedirectPort = "Stratum.ShutdownRedirectPort"
+	ConfigStratumShutdownRedirectWait = "Stratum.ShutdownRedirectWait"
+
+	ConfigStratumMaxConnsPerIP   = "Stratum.MaxConnsPerIP"
+	ConfigStratumMaxMsgPerSecond = "Stratum.MaxMessagesPerSecond"
+	ConfigStratumBanThreshold    = "Stratum.BanThreshold"
+	ConfigStratumBanScoreWindow  = "Stratum.BanScoreWindow"
+	ConfigStratumBanDuration     = "Stratum.BanDuration"
+	ConfigStratumBanMaxDuration  = "Stratum.BanMaxDuration"
+
+	ConfigStratumShareSampleRate = "Stratum.ShareSampleRate"
+
+	ConfigStratumMinimumMinerVersion  = "Stratum.MinimumMinerVersion"
+	ConfigStratumRefuseOutdatedMiners = "Stratum.RefuseOutdatedMiners"
+	ConfigStratumMinVersionDeadline   = "Stratum.MinVersionDeadline"
+	ConfigStratumUpgradeMessage       = "Stratum.UpgradeMessage"
+
+	ConfigStratumTLSPort     = "Stratum.TLSPort"
+	ConfigStratumTLSCertFile = "Stratum.TLSCertFile"
+	ConfigStratumTLSKeyFile  = "Stratum.TLSKeyFile"
+	ConfigStratumTLSOnly     = "Stratum.TLSOnly"
+
+	ConfigStratumVarDiff                = "Stratum.VarDiff"
+	ConfigStratumVarDiffSharesPerMinute = "Stratum.VarDiffSharesPerMinute"
+	ConfigStratumVarDiffRetarget        = "Stratum.VarDiffRetargetTime"
+	ConfigStratumVarDiffVariance        = "Stratum.VarDiffVariance"
+	ConfigStratumInitialTarget          = "Stratum.InitialTarget"
+	ConfigStratumMinimumTarget          = "Stratum.MinimumTarget"
+	ConfigStratumMaximumTarget          = "Stratum.MaximumTarget"
 )
 
 func SetDefaults(conf *viper.Viper) {
@@ -66,9 +135,14 @@ func SetDefaults(conf *viper.Viper) {
 	conf.SetDefault(ConfigSQLPassword, "password")
 
 	conf.SetDefault(ConfigFactomdLocation, "http://localhost:8088/v2")
+	conf.SetDefault(ConfigWalletdLocation, "http://localhost:8089/v2")
+	conf.SetDefault(ConfigFactomdLocations, []string{})
+	conf.SetDefault(ConfigFactomdHealthCheckInterval, time.Second*5)
+	conf.SetDefault(ConfigFactomdRequestTimeout, time.Second*30)
 
 	conf.SetDefault(ConfigPegnetPollingPeriod, time.Second*2)
 	conf.SetDefault(ConfigPegnetRetryPeriod, time.Second*5)
+	conf.SetDefault(ConfigPegnetdLocation, "http://localhost:8070/v1")
 
 	conf.SetDefault(Config1ForgeKey, "CHANGEME")
 	conf.SetDefault(ConfigApiLayerKey, "CHANGEME")
@@ -89,10 +163,29 @@ func SetDefaults(conf *viper.Viper) {
 	conf.SetDefault(ConfigAlternativeMePriority, -1)
 
 	conf.SetDefault(ConfigPoolCut, "0.05")
+	conf.SetDefault(ConfigPoolPayoutScheme, "proportional")
+	conf.SetDefault(ConfigPoolPPLNSWindow, 2)
+	conf.SetDefault(ConfigPoolMinimumPayout, "0")
+
+	conf.SetDefault(ConfigAccountingCheckpointInterval, time.Second*5)
+
+	conf.SetDefault(ConfigPayoutEnabled, false)
+	conf.SetDefault(ConfigPayoutInterval, time.Hour*24)
+	conf.SetDefault(ConfigPayoutDryRun, false)
+	conf.SetDefault(ConfigPayoutKeySource, "walletd")
+	conf.SetDefault(ConfigPayoutFAAddress, "")
+	conf.SetDefault(ConfigPayoutFsAddress, "")
+	conf.SetDefault(ConfigPayoutECAddress, "")
+	conf.SetDefault(ConfigPayoutESAddress, "")
+	conf.SetDefault(ConfigPayoutConfirmTimeout, time.Minute*30)
+	conf.SetDefault(ConfigPayoutReceiptDirectory, "$HOME/.prosper/receipts")
 
 	conf.SetDefault(ConfigPoolIdentity, "Prosper")
 	conf.SetDefault(ConfigPoolCoinbase, "FA2jK2HcLnRdS94dEcU27rF3meoJfpUcZPSinpb7AwQvPRY6RL1Q")
 	conf.SetDefault(ConfigPoolESAddress, "Es2XT3jSxi1xqrDvS5JERM3W3jh1awRHuyoahn3hbQLyfEi1jvbq")
+	conf.SetDefault(ConfigPoolJobRefreshInterval, time.Duration(0))
+	conf.SetDefault(ConfigPoolJobRefreshThreshold, 0.005)
+	conf.SetDefault(ConfigPoolShutdownStepTimeout, time.Second*10)
 
 	conf.SetDefault(ConfigSubmitterCutoff, 200)
 	// 6hrs
@@ -103,6 +196,43 @@ func SetDefaults(conf *viper.Viper) {
 
 	conf.SetDefault(ConfigStratumCheckAllWork, true)
 	conf.SetDefault(ConfigStratumRequireAuth, true)
+	conf.SetDefault(ConfigStratumRequirePassword, false)
+	conf.SetDefault(ConfigStratumAuthMaxFailures, 5)
+	conf.SetDefault(ConfigStratumAuthMaxIPFailures, 20)
+	conf.SetDefault(ConfigStratumAuthLockout, time.Minute*15)
 	conf.SetDefault(ConfigStratumPort, 1234)
 	conf.SetDefault(ConfigStratumWelcomeMessage, "Welcome to Prosper pool! Please visit http://my.pool.url:port for more information.")
+
+	conf.SetDefault(ConfigStratumJobHistory, 10)
+	conf.SetDefault(ConfigStratumPreviousJobGrace, time.Second*5)
+	conf.SetDefault(ConfigStratumSessionTTL, time.Minute*5)
+	conf.SetDefault(ConfigStratumWriteTimeout, time.Second*10)
+	conf.SetDefault(ConfigStratumNotifyMaxFailures, 3)
+	conf.SetDefault(ConfigStratumRequestTimeout, time.Second*30)
+	conf.SetDefault(ConfigStratumShutdownRedirectHost, "")
+	conf.SetDefault(ConfigStratumShutdownRedirectPort, 0)
+	conf.SetDefault(ConfigStratumShutdownRedirectWait, time.Second*30)
+	conf.SetDefault(ConfigStratumMaxConnsPerIP, 100)
+	conf.SetDefault(ConfigStratumMaxMsgPerSecond, 50)
+	conf.SetDefault(ConfigStratumBanThreshold, 100)
+	conf.SetDefault(ConfigStratumBanScoreWindow, time.Minute*10)
+	conf.SetDefault(ConfigStratumBanDuration, time.Minute*10)
+	conf.SetDefault(ConfigStratumBanMaxDuration, time.Hour*24)
+	conf.SetDefault(ConfigStratumShareSampleRate, 0.0)
+	conf.SetDefault(ConfigStratumMinimumMinerVersion, "")
+	conf.SetDefault(ConfigStratumRefuseOutdatedMiners, false)
+	conf.SetDefault(ConfigStratumMinVersionDeadline, "")
+	conf.SetDefault(ConfigStratumUpgradeMessage, "Please upgrade prosper-miner.")
+	conf.SetDefault(ConfigStratumTLSPort, 0)
+	conf.SetDefault(ConfigStratumTLSCertFile, "")
+	conf.SetDefault(ConfigStratumTLSKeyFile, "")
+	conf.SetDefault(ConfigStratumTLSOnly, false)
+
+	conf.SetDefault(ConfigStratumVarDiff, true)
+	conf.SetDefault(ConfigStratumVarDiffSharesPerMinute, 6)
+	conf.SetDefault(ConfigStratumVarDiffRetarget, time.Second*90)
+	conf.SetDefault(ConfigStratumVarDiffVariance, 0.3)
+	conf.SetDefault(ConfigStratumInitialTarget, "ffff000000000000")
+	conf.SetDefault(ConfigStratumMinimumTarget, "ffff000000000000")
+	conf.SetDefault(ConfigStratumMaximumTarget, "ffffffff00000000")
 }
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"time"
 
 	"github.com/pegnet/pegnet/modules/grader"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/FactomWyomingEntity/prosper-pool/exit"
 	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
 	"github.com/FactomWyomingEntity/prosper-pool/minutekeeper"
+	"github.com/FactomWyomingEntity/prosper-pool/payout"
 	"github.com/FactomWyomingEntity/prosper-pool/pegnet"
 	"github.com/FactomWyomingEntity/prosper-pool/polling"
 	"github.com/FactomWyomingEntity/prosper-pool/sharesubmit"
@@ -46,9 +48,20 @@ type PoolEngine struct {
 	Authenticator *authentication.Authenticator
 	Web           *web.HttpServices
 	MinuteKeeper  *minutekeeper.MinuteKeeper
+	// Factomd is the pool of factomd nodes used by sync, the minute keeper
+	// and the submitter
+	Factomd *factomclient.Pool
+	// Payouts is nil if automatic payouts are not enabled
+	Payouts *payout.Scheduler
 
 	Identity IdentityInformation
 
+	// currentJob is the latest job sent to the miners. It is refreshed
+	// mid-block if prices move.
+	currentJob      *stratum.Job
+	refreshInterval time.Duration
+	refreshThresh   float64
+
 	// Engine hooks
 	// nodeHook listens for new pegnet blocks
 	nodeHook <-chan pegnet.PegnetdHook
@@ -68,6 +81,8 @@ type IdentityInformation struct {
 func Setup(conf *viper.Viper) (*PoolEngine, error) {
 	e := new(PoolEngine)
 	e.conf = conf
+	e.refreshInterval = conf.GetDuration(config.ConfigPoolJobRefreshInterval)
+	e.refreshThresh = conf.GetFloat64(config.ConfigPoolJobRefreshThreshold)
 
 	// Init modules
 	err := e.init()
@@ -100,7 +115,17 @@ func (e *PoolEngine) init() error {
 		return err
 	}
 
-	p, err := pegnet.NewPegnetNode(e.conf, db)
+	// Bans are kept in the database across restarts
+	bans, err := stratum.NewBanManager(e.conf, db.DB)
+	if err != nil {
+		return err
+	}
+	stratumServer.SetBanManager(bans)
+
+	// They all follow the same factomd, so the minute keeper and the
+	// submitter are on the node the jobs were synced from
+	factomd := factomclient.NewPool(e.conf)
+	p, err := pegnet.NewPegnetNode(e.conf, db, factomd)
 	if err != nil {
 		return err
 	}
@@ -114,7 +139,7 @@ func (e *PoolEngine) init() error {
 		return err
 	}
 
-	sub, err := sharesubmit.NewSubmitter(e.conf, db.DB)
+	sub, err := sharesubmit.NewSubmitter(e.conf, db.DB, factomd)
 	if err != nil {
 		return err
 	}
@@ -126,7 +151,15 @@ func (e *PoolEngine) init() error {
 
 	srv := web.NewHttpServices(e.conf, db.DB)
 
-	mk := minutekeeper.NewMinuteKeeper(factomclient.FactomClientFromConfig(e.conf))
+	mk := minutekeeper.NewMinuteKeeper(factomd)
+
+	var payouts *payout.Scheduler
+	if e.conf.GetBool(config.ConfigPayoutEnabled) {
+		payouts, err = payout.NewScheduler(e.conf, acc, factomclient.FactomClientFromConfig(e.conf))
+		if err != nil {
+			return fmt.Errorf("payout scheduler: %s", err.Error())
+		}
+	}
 
 	// Load our identity info for oprs
 	if id := e.conf.GetString(config.ConfigPoolIdentity); id == "" {
@@ -165,13 +198,59 @@ func (e *PoolEngine) init() error {
 	e.Authenticator = auth
 	e.Web = srv
 	e.MinuteKeeper = mk
+	e.Factomd = factomd
+	e.Payouts = payouts
+
+	// Add all closes. The drain runs first, while everything is up.
+	e.addDrains()
+	exit.GlobalExitHandler.AddExit(e.closeDatabase)
 
-	// Add all closes
-	exit.GlobalExitHandler.AddExit(e.Database.Close)
+	// Metrics are served with the profiler
+	factomclient.RegisterPrometheus()
+	pegnet.RegisterPrometheus()
+	sharesubmit.RegisterPrometheus()
+	stratum.RegisterPrometheus()
 
 	return nil
 }
 
+// addDrains adds the graceful shutdown. Stratum stops taking shares, the
+// accepted work is flushed to the accountant, and the miners are sent to the
+// backup pool before the listeners are closed.
+func (e *PoolEngine) addDrains() {
+	timeout := e.conf.GetDuration(config.ConfigPoolShutdownStepTimeout)
+	host := e.conf.GetString(config.ConfigStratumShutdownRedirectHost)
+	port := e.conf.GetInt(config.ConfigStratumShutdownRedirectPort)
+	wait := e.conf.GetDuration(config.ConfigStratumShutdownRedirectWait)
+
+	exit.GlobalExitHandler.AddDrain("stop shares", timeout, func(ctx context.Context) error {
+		e.StratumServer.StopShares()
+		return nil
+	})
+	exit.GlobalExitHandler.AddDrain("flush accounting", timeout, e.Accountant.Flush)
+	exit.GlobalExitHandler.AddDrain("redirect miners", timeout, func(ctx context.Context) error {
+		count := e.StratumServer.RedirectMiners(host, port, wait)
+		log.WithFields(log.Fields{"miners": count, "host": host, "wait": wait}).Info("redirected miners")
+		return nil
+	})
+	exit.GlobalExitHandler.AddDrain("close stratum", timeout, func(ctx context.Context) error {
+		return e.StratumServer.Close()
+	})
+	exit.GlobalExitHandler.AddDrain("close web", timeout, e.Web.Shutdown)
+}
+
+// closeDatabase closes the database once the accountant has written its last
+// checkpoint. The accountant stops when the pool's context is cancelled,
+// which is the closing function before this one.
+func (e *PoolEngine) closeDatabase() error {
+	select {
+	case <-e.Accountant.Done():
+	case <-time.After(e.conf.GetDuration(config.ConfigPoolShutdownStepTimeout)):
+		log.Warn("accountant did not stop, closing the database anyway")
+	}
+	return e.Database.Close()
+}
+
 func (e *PoolEngine) link() error {
 	// NodeHook hooks all pegnet blocks
 	e.nodeHook = e.PegnetNode.GetHook()
@@ -190,11 +269,15 @@ func (e *PoolEngine) link() error {
 
 	e.StratumServer.SetAuthenticator(e.Authenticator)
 	e.StratumServer.SetShareCheck(e.MinuteKeeper)
+	e.StratumServer.SetSubmitTarget(e.Submitter)
 
 	return nil
 }
 
 func (e *PoolEngine) Run(ctx context.Context) {
+	// Health check the factomd nodes, to pick the one furthest along
+	go e.Factomd.Run(ctx)
+
 	// MinuteKeeper watches for the min 0 to 1 problem
 	//	- Used by the submitter and stratum server to reject shares
 	go e.MinuteKeeper.Run(ctx)
@@ -214,13 +297,49 @@ func (e *PoolEngine) Run(ctx context.Context) {
 	// Start api/web
 	go e.Web.Listen()
 
+	// Pay users on a schedule
+	if e.Payouts != nil {
+		go e.Payouts.Run(ctx)
+	}
+
 	// Listen for new jobs for forwarding
 	e.listenBlocks(ctx)
 }
 
 func (e *PoolEngine) listenBlocks(ctx context.Context) {
+	// A nil channel never fires, so refreshing is off without an interval
+	var refresh <-chan time.Time
+	if e.refreshInterval > 0 {
+		ticker := time.NewTicker(e.refreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
 	for {
 		select {
+		case <-refresh:
+			if e.currentJob == nil {
+				continue
+			}
+			job := e.refreshJob(e.currentJob)
+			if job == nil {
+				continue
+			}
+
+			// The submitter gets the sub-job first, without blocking the
+			// new blocks. If it is behind, the refresh is skipped, so
+			// miners never mine an opr it cannot submit.
+			select {
+			case e.Submitter.GetJobsChannel() <- job:
+			default:
+				engLog.WithField("job", job.JobIDString()).Warn("share submitter is behind, skipping the job refresh")
+				continue
+			}
+
+			e.currentJob = job
+			// Sub-jobs keep the job id, so the accountant does not need
+			// to know about them.
+			e.StratumServer.UpdateCurrentJob(job)
 		case hook := <-e.nodeHook:
 			job := e.createJob(hook)
 			if job == nil {
@@ -233,6 +352,7 @@ func (e *PoolEngine) listenBlocks(ctx context.Context) {
 			// or we are just syncing
 			if hook.Top {
 				// Update current job and notify the Miners
+				e.currentJob = job
 				e.StratumServer.UpdateCurrentJob(job)
 				// Notify Accounting
 				//	Notify of the new job
@@ -290,15 +410,7 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 		}
 	}
 
-	assetList := opr.V2Assets
-	version := uint8(2)
-	if uint32(hook.Height+1) >= config.FreeFloatingPEGPriceActivation {
-		version = 3
-	}
-	if uint32(hook.Height+1) >= config.V4OPRActivation {
-		version = 4
-		assetList = opr.V4Assets
-	}
+	version, assetList := oprVersion(hook.Height + 1)
 
 	// New block, let's construct the job
 	assets, err := e.Poller.PullAllPEGAssets(version)
@@ -307,7 +419,6 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 		return nil
 	}
 
-	var _ = assets
 	// Construct the OPR
 	// TODO: Modules should have a constructor for us
 	record := opr.V2Content{}
@@ -324,7 +435,58 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 			record.Winners = append(record.Winners, data)
 		}
 	}
+	setAssets(&record, version, assetList, assets)
 
+	// The job is for the height + 1. The synced block is wrapping up the last
+	// job
+	return e.jobFromRecord(hLog.WithField("top", hook.Top), record, version)
+}
+
+// refreshJob polls the prices again mid-block. If any asset moved past the
+// refresh threshold, a new sub-job of the current job is returned. Nil is
+// returned if the prices have not moved.
+func (e *PoolEngine) refreshJob(current *stratum.Job) *stratum.Job {
+	hLog := engLog.WithFields(log.Fields{"height": current.JobID, "seq": current.Seq + 1})
+	version, assetList := oprVersion(current.JobID)
+	assets, err := e.Poller.PullAllPEGAssets(version)
+	if err != nil {
+		hLog.WithError(err).Errorf("failed to poll asset pricing")
+		return nil
+	}
+
+	// Everything but the prices stays the same
+	record := current.OPR
+	setAssets(&record, version, assetList, assets)
+	if !PricesMoved(current.OPR.Assets, record.Assets, e.refreshThresh) {
+		hLog.Debug("prices have not moved, no sub-job")
+		return nil
+	}
+
+	job := e.jobFromRecord(hLog, record, version)
+	if job == nil {
+		return nil
+	}
+	job.Seq = current.Seq + 1
+	hLog.WithField("oprhash", job.OPRHash).Infof("prices moved, new sub-job")
+	return job
+}
+
+// oprVersion returns the opr version and assets for a height
+func oprVersion(height int32) (uint8, []string) {
+	assetList := opr.V2Assets
+	version := uint8(2)
+	if uint32(height) >= config.FreeFloatingPEGPriceActivation {
+		version = 3
+	}
+	if uint32(height) >= config.V4OPRActivation {
+		version = 4
+		assetList = opr.V4Assets
+	}
+	return version, assetList
+}
+
+// setAssets sets the record's prices from the polled assets
+func setAssets(record *opr.V2Content, version uint8, assetList []string, assets polling.PegAssets) {
 	// Assets need to be set in a specific order
 	record.Assets = make([]uint64, len(assetList))
 	for i, name := range assetList {
@@ -335,7 +497,31 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 		asset := assets[name]
 		record.Assets[i] = uint64(math.Round(asset.Value * 1e8))
 	}
+}
+
+// PricesMoved returns true if any price changed by more than the threshold,
+// relative to the old price.
+func PricesMoved(old, new []uint64, threshold float64) bool {
+	if len(old) != len(new) {
+		return true
+	}
+	for i := range old {
+		if old[i] == new[i] {
+			continue
+		}
+		if old[i] == 0 {
+			return true
+		}
+		change := math.Abs(float64(new[i])-float64(old[i])) / float64(old[i])
+		if change > threshold {
+			return true
+		}
+	}
+	return false
+}
 
+// jobFromRecord hashes the record into a job
+func (e *PoolEngine) jobFromRecord(hLog *log.Entry, record opr.V2Content, version uint8) *stratum.Job {
 	// Get OPRHash
 	data, err := record.Marshal()
 	if version == 4 {
@@ -350,7 +536,7 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 	}
 	oprHash := sha256.Sum256(data)
 	oprHashHex := fmt.Sprintf("%x", oprHash[:])
-	hLog.WithFields(log.Fields{"oprhash": oprHashHex, "top": hook.Top}).Debugf("new job")
+	hLog.WithFields(log.Fields{"oprhash": oprHashHex}).Debugf("new job")
 
 	switch version {
 	case 2:
@@ -365,10 +551,8 @@ func (e *PoolEngine) createJob(hook pegnet.PegnetdHook) *stratum.Job {
 		hLog.Errorf("Please check your config is correct. Like the correct data sources")
 	}
 
-	// The job is for the height + 1. The synced block is wrapping up the last
-	// job
 	return &stratum.Job{
-		JobID:   stratum.JobIDFromHeight(hook.Height + 1),
+		JobID:   stratum.JobIDFromHeight(record.Height),
 		OPRHash: oprHashHex,
 		OPR:     record,
 		OPRv4:   opr.V4Content{record},
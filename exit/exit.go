@@ -2,6 +2,8 @@ package exit
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -9,7 +11,19 @@ import (
 var GlobalExitHandler = NewExitHandler()
 
 type ExitHandler struct {
+	// DrainSteps run in order before the closing functions
+	DrainSteps       []DrainStep
 	ClosingFunctions []func() error
+
+	drain sync.Once
+}
+
+// DrainStep is a step of a graceful shutdown. Each step is given its own
+// timeout, so one stuck step cannot hold up the rest.
+type DrainStep struct {
+	Name    string
+	Timeout time.Duration
+	Drain   func(ctx context.Context) error
 }
 
 func NewExitHandler() *ExitHandler {
@@ -29,7 +43,49 @@ func (e *ExitHandler) AddCancel(cancel context.CancelFunc) {
 	})
 }
 
+// AddDrain adds a step to the graceful shutdown. Drain steps run before any
+// of the closing functions, so they can still use the database and the
+// connections.
+func (e *ExitHandler) AddDrain(name string, timeout time.Duration, f func(ctx context.Context) error) {
+	e.DrainSteps = append(e.DrainSteps, DrainStep{Name: name, Timeout: timeout, Drain: f})
+}
+
+// DrainTimeout is the longest the drain steps can take together
+func (e *ExitHandler) DrainTimeout() time.Duration {
+	var total time.Duration
+	for _, step := range e.DrainSteps {
+		total += step.Timeout
+	}
+	return total
+}
+
+// Drain runs the drain steps in order, once. A step that does not finish
+// within its timeout is abandoned, and the next step is run.
+func (e *ExitHandler) Drain() {
+	e.drain.Do(func() {
+		for _, step := range e.DrainSteps {
+			sLog := log.WithField("step", step.Name)
+			sLog.Info("draining")
+			ctx, cancel := context.WithTimeout(context.Background(), step.Timeout)
+			done := make(chan error, 1)
+			go func(step DrainStep) {
+				done <- step.Drain(ctx)
+			}(step)
+			select {
+			case err := <-done:
+				if err != nil {
+					sLog.WithError(err).Error("drain step failed")
+				}
+			case <-ctx.Done():
+				sLog.Warn("drain step timed out")
+			}
+			cancel()
+		}
+	})
+}
+
 func (e *ExitHandler) Close() {
+	e.Drain()
 	for _, f := range e.ClosingFunctions {
 		err := f()
 		if err != nil {
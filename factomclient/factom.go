@@ -10,8 +10,16 @@ import (
 func FactomClientFromConfig(conf *viper.Viper) *factom.Client {
 	cl := factom.NewClient()
 	cl.FactomdServer = conf.GetString(config.ConfigFactomdLocation)
-	// We don't use walletd
-	cl.WalletdServer = conf.GetString("http://localhost:8089")
+	// Walletd is only used if the payout keys are held in walletd
+	cl.WalletdServer = conf.GetString(config.ConfigWalletdLocation)
 
 	return cl
 }
+
+// PegnetdClientFromConfig is a client for pegnetd. Pegnetd answers json-rpc
+// the same way factomd does, so its requests are made as factomd requests.
+func PegnetdClientFromConfig(conf *viper.Viper) *factom.Client {
+	cl := factom.NewClient()
+	cl.FactomdServer = conf.GetString(config.ConfigPegnetdLocation)
+	return cl
+}
@@ -0,0 +1,46 @@
+package factomclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	nodeLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pool_factomd_request_seconds",
+		Help:    "Time taken by requests and health checks to each factomd",
+		Buckets: []float64{.005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"node"})
+	nodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_factomd_errors",
+		Help: "Requests and health checks that could not reach each factomd",
+	}, []string{"node"})
+	nodeHeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pool_factomd_dblock_height",
+		Help: "Directory block height each factomd reported on its last health check",
+	}, []string{"node"})
+	nodeSelected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pool_factomd_selected",
+		Help: "1 for the factomd requests are sent to, 0 for the rest",
+	}, []string{"node"})
+)
+
+var prom sync.Once
+
+func RegisterPrometheus() {
+	prom.Do(func() {
+		prometheus.MustRegister(nodeLatency)
+		prometheus.MustRegister(nodeErrors)
+		prometheus.MustRegister(nodeHeight)
+		prometheus.MustRegister(nodeSelected)
+	})
+}
+
+func observe(n *Node, latency time.Duration, failed bool) {
+	nodeLatency.WithLabelValues(n.Client.FactomdServer).Observe(latency.Seconds())
+	if failed {
+		nodeErrors.WithLabelValues(n.Client.FactomdServer).Inc()
+	}
+}
@@ -0,0 +1,316 @@
+package factomclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	fLog = log.WithField("mod", "factomd")
+)
+
+// DefaultHealthCheckInterval is used by pools not built from a config
+const DefaultHealthCheckInterval = time.Second * 5
+
+// Pool is a set of factomd nodes. Every node is health checked on an
+// interval, and requests go to the healthy node furthest along, by directory
+// block and then minute. If a node cannot be reached, the request fails over
+// to the next best node.
+type Pool struct {
+	nodes    []*Node
+	interval time.Duration
+
+	// Guards the selected node, and the health of every node
+	sync.RWMutex
+	selected *Node
+}
+
+// Node is a factomd in the pool, with its health as of the last check or
+// request
+type Node struct {
+	Client *factom.Client
+
+	checked bool
+	healthy bool
+	height  int32
+	minute  int32
+	latency time.Duration
+	err     error
+}
+
+// NodeStatus is the health of a node
+type NodeStatus struct {
+	Server   string        `json:"server"`
+	Selected bool          `json:"selected"`
+	Checked  bool          `json:"checked"`
+	Healthy  bool          `json:"healthy"`
+	Height   int32         `json:"dblockheight"`
+	Minute   int32         `json:"minute"`
+	Latency  time.Duration `json:"latency"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// currentMinute is the part of the factomd current-minute api the pool
+// needs
+type currentMinute struct {
+	Directoryblockheight int32 `json:"directoryblockheight"`
+	Minute               int32 `json:"minute"`
+}
+
+// NewPool builds a pool of the factomd location, followed by any extra
+// factomd locations.
+func NewPool(conf *viper.Viper) *Pool {
+	locations := append([]string{conf.GetString(config.ConfigFactomdLocation)},
+		conf.GetStringSlice(config.ConfigFactomdLocations)...)
+
+	seen := make(map[string]bool)
+	var clients []*factom.Client
+	for _, location := range locations {
+		location = strings.TrimSpace(location)
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		cl := FactomClientFromConfig(conf)
+		cl.FactomdServer = location
+		// A node that hangs should fail over like a node that is down
+		cl.Factomd.Timeout = conf.GetDuration(config.ConfigFactomdRequestTimeout)
+		clients = append(clients, cl)
+	}
+	if len(clients) == 0 {
+		clients = append(clients, FactomClientFromConfig(conf))
+	}
+
+	p := NewPoolFromClients(clients...)
+	if interval := conf.GetDuration(config.ConfigFactomdHealthCheckInterval); interval > 0 {
+		p.interval = interval
+	}
+	return p
+}
+
+// NewPoolFromClients builds a pool of the clients. The first client is
+// selected until the nodes are checked.
+func NewPoolFromClients(clients ...*factom.Client) *Pool {
+	p := new(Pool)
+	p.interval = DefaultHealthCheckInterval
+	for _, cl := range clients {
+		p.nodes = append(p.nodes, &Node{Client: cl})
+	}
+	p.selected = p.nodes[0]
+	return p
+}
+
+// Run checks the health of every node on the interval, until the context is
+// cancelled.
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check asks every node for its current minute, and selects the node
+// furthest along.
+func (p *Pool) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			p.check(ctx, n)
+		}(n)
+	}
+	wg.Wait()
+	p.choose()
+}
+
+func (p *Pool) check(ctx context.Context, n *Node) {
+	// A check should never run into the next one
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	var cm currentMinute
+	start := time.Now()
+	err := n.Client.FactomdRequest(ctx, "current-minute", nil, &cm)
+	latency := time.Since(start)
+	observe(n, latency, err != nil)
+
+	p.Lock()
+	defer p.Unlock()
+	n.checked = true
+	n.latency = latency
+	n.err = err
+	n.healthy = err == nil
+	if err == nil {
+		n.height, n.minute = cm.Directoryblockheight, cm.Minute
+		nodeHeight.WithLabelValues(n.Client.FactomdServer).Set(float64(n.height))
+	}
+}
+
+// choose selects the best node. The selected node is kept on a tie, so the
+// pool does not bounce between nodes at the same height.
+func (p *Pool) choose() {
+	p.Lock()
+	defer p.Unlock()
+	best := p.selected
+	for _, n := range p.nodes {
+		if ahead(n, best) {
+			best = n
+		}
+	}
+
+	if best != p.selected {
+		fLog.WithFields(log.Fields{
+			"from":   p.selected.Client.FactomdServer,
+			"to":     best.Client.FactomdServer,
+			"height": best.height,
+			"minute": best.minute,
+		}).Warn("switching factomd")
+		p.selected = best
+	}
+	for _, n := range p.nodes {
+		var selected float64
+		if n == p.selected {
+			selected = 1
+		}
+		nodeSelected.WithLabelValues(n.Client.FactomdServer).Set(selected)
+	}
+}
+
+// ahead returns if node a is better than node b. Healthy nodes are better
+// than unhealthy ones, then the highest directory block and minute wins.
+func ahead(a, b *Node) bool {
+	if a.healthy != b.healthy {
+		return a.healthy
+	}
+	if a.height != b.height {
+		return a.height > b.height
+	}
+	return a.minute > b.minute
+}
+
+// Client is the client of the selected node. Requests made with it directly
+// do not fail over, use Do for that.
+func (p *Pool) Client() *factom.Client {
+	p.RLock()
+	defer p.RUnlock()
+	return p.selected.Client
+}
+
+// Do calls f with the client of the selected node. If the node cannot be
+// reached, it is marked unhealthy until its next check, and f is retried with
+// the next best node. Errors factomd answers with, like a missing entry, are
+// returned without failing over, as every node would give the same answer.
+//
+// A request that fails can still have reached the node, so requests that
+// must not be made twice should use Send.
+func (p *Pool) Do(f func(cl *factom.Client) error) error {
+	var err error
+	for _, n := range p.order() {
+		if err = p.call(n, f); !NodeFailure(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Send calls f once with the client of the selected node, and never retries
+// on another node. Entry commits spend entry credits, and a commit that timed
+// out may still have been accepted, so they are sent this way.
+func (p *Pool) Send(f func(cl *factom.Client) error) error {
+	return p.call(p.order()[0], f)
+}
+
+// call calls f with the node's client. If the node cannot be reached, it is
+// marked unhealthy until its next check, and the best node is chosen again.
+func (p *Pool) call(n *Node, f func(cl *factom.Client) error) error {
+	start := time.Now()
+	err := f(n.Client)
+	failed := NodeFailure(err)
+	observe(n, time.Since(start), failed)
+	if !failed {
+		return err
+	}
+
+	fLog.WithError(err).WithField("fhost", n.Client.FactomdServer).Warn("factomd request failed")
+	p.Lock()
+	n.healthy = false
+	n.err = err
+	p.Unlock()
+	p.choose()
+	return err
+}
+
+// order is every node, best first
+func (p *Pool) order() []*Node {
+	p.RLock()
+	defer p.RUnlock()
+	nodes := []*Node{p.selected}
+	for _, n := range p.nodes {
+		if n != p.selected {
+			nodes = append(nodes, n)
+		}
+	}
+	rest := nodes[1:]
+	sort.SliceStable(rest, func(i, j int) bool { return ahead(rest[i], rest[j]) })
+	return nodes
+}
+
+// Status is the health of every node, in the configured order
+func (p *Pool) Status() []NodeStatus {
+	p.RLock()
+	defer p.RUnlock()
+	status := make([]NodeStatus, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		s := NodeStatus{
+			Server:   n.Client.FactomdServer,
+			Selected: n == p.selected,
+			Checked:  n.checked,
+			Healthy:  n.healthy,
+			Height:   n.height,
+			Minute:   n.minute,
+			Latency:  n.latency,
+		}
+		if n.err != nil {
+			s.Error = n.err.Error()
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// NodeFailure returns if the error is from not reaching a node, or the node
+// not answering properly. Errors factomd answered with are not failures.
+func NodeFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var urlErr *url.Error
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &urlErr), errors.As(err, &syntaxErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	// An http status other than 200 or 400
+	return strings.Contains(err.Error(), "http: ")
+}
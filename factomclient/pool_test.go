@@ -0,0 +1,200 @@
+package factomclient_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/factomclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// factomd is a stand in factomd, that answers current-minute and heights
+type factomd struct {
+	*httptest.Server
+
+	sync.Mutex
+	height, minute int32
+	requests       int
+}
+
+func newFactomd(height, minute int32) *factomd {
+	f := &factomd{height: height, minute: minute}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *factomd) URL() string {
+	return f.Server.URL + "/v2"
+}
+
+func (f *factomd) set(height, minute int32) {
+	f.Lock()
+	defer f.Unlock()
+	f.height, f.minute = height, minute
+}
+
+func (f *factomd) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     int    `json:"id"`
+		Method string `json:"method"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	switch req.Method {
+	case "current-minute":
+		resp["result"] = map[string]int32{"directoryblockheight": f.height, "minute": f.minute}
+	case "heights":
+		resp["result"] = map[string]int32{"directoryblockheight": f.height}
+	default:
+		resp["error"] = map[string]interface{}{"code": -32601, "message": "Method not found"}
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func poolOf(nodes ...*factomd) *Pool {
+	conf := viper.New()
+	config.SetDefaults(conf)
+	var locations []string
+	for _, n := range nodes {
+		locations = append(locations, n.URL())
+	}
+	conf.Set(config.ConfigFactomdLocation, locations[0])
+	conf.Set(config.ConfigFactomdLocations, locations[1:])
+	return NewPool(conf)
+}
+
+func selected(p *Pool) string {
+	for _, s := range p.Status() {
+		if s.Selected {
+			return s.Server
+		}
+	}
+	return ""
+}
+
+func TestPool_Check(t *testing.T) {
+	require := require.New(t)
+	a, b, c := newFactomd(10, 3), newFactomd(10, 5), newFactomd(11, 0)
+	defer a.Close()
+	defer b.Close()
+	c.Close() // Down
+
+	p := poolOf(a, b, c)
+	require.Len(p.Status(), 3)
+	require.Equal(a.URL(), p.Client().FactomdServer, "first node until checked")
+
+	// The furthest along by height, then minute
+	p.Check(context.Background())
+	require.Equal(b.URL(), p.Client().FactomdServer)
+	status := p.Status()
+	require.Equal(int32(10), status[1].Height)
+	require.Equal(int32(5), status[1].Minute)
+	require.True(status[1].Healthy)
+	require.True(status[2].Checked)
+	require.False(status[2].Healthy, "the height of a node that is down does not count")
+	require.NotEmpty(status[2].Error)
+
+	// Ties keep the selected node
+	a.set(10, 5)
+	p.Check(context.Background())
+	require.Equal(b.URL(), selected(p))
+
+	a.set(11, 1)
+	p.Check(context.Background())
+	require.Equal(a.URL(), selected(p))
+}
+
+func TestPool_Do(t *testing.T) {
+	require := require.New(t)
+	RegisterPrometheus()
+	a, b := newFactomd(10, 3), newFactomd(10, 5)
+	defer a.Close()
+	p := poolOf(a, b)
+	p.Check(context.Background())
+	require.Equal(b.URL(), selected(p))
+
+	// The selected node goes down, and the request fails over
+	b.Close()
+	heights := new(factom.Heights)
+	err := p.Do(func(cl *factom.Client) error {
+		return heights.Get(nil, cl)
+	})
+	require.NoError(err)
+	require.Equal(uint32(10), heights.DirectoryBlock)
+	require.Equal(a.URL(), selected(p))
+	require.False(p.Status()[1].Healthy)
+	require.Equal(float64(1), errorCount(t, b.URL()))
+
+	// Errors factomd answers with do not fail over
+	a.Lock()
+	before := a.requests
+	a.Unlock()
+	var tries int
+	err = p.Do(func(cl *factom.Client) error {
+		tries++
+		return cl.FactomdRequest(nil, "unknown-method", nil, nil)
+	})
+	require.Error(err)
+	require.False(NodeFailure(err))
+	require.Equal(1, tries)
+	require.Equal(a.URL(), selected(p))
+	a.Lock()
+	require.Equal(before+1, a.requests)
+	a.Unlock()
+
+	// Sends are never retried on another node
+	c := newFactomd(10, 1)
+	defer c.Close()
+	p = poolOf(a, c)
+	p.Check(context.Background())
+	a.Close()
+	tries = 0
+	err = p.Send(func(cl *factom.Client) error {
+		tries++
+		return heights.Get(nil, cl)
+	})
+	require.True(NodeFailure(err))
+	require.Equal(1, tries)
+	require.Equal(c.URL(), selected(p), "the next request goes to a healthy node")
+	require.NoError(p.Send(func(cl *factom.Client) error {
+		return heights.Get(nil, cl)
+	}))
+
+	// With every node down, the last failure is returned
+	c.Close()
+	err = p.Do(func(cl *factom.Client) error {
+		return heights.Get(nil, cl)
+	})
+	require.True(NodeFailure(err))
+}
+
+// errorCount is the pool_factomd_errors of the node
+func errorCount(t *testing.T, node string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "pool_factomd_errors" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "node" && l.GetValue() == node {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -48,6 +48,7 @@ const (
 	SubmitStats
 	PauseMining
 	ResumeMining
+	NewNonceExtension
 )
 
 type MinerCommand struct {
@@ -66,6 +67,8 @@ type PegnetMiner struct {
 	// ID is the miner number, starting with "1".
 	ID         uint32 // The process id to the pool
 	PersonalID uint32 // The miner thread id
+	// Extension follows the ID in the nonce, if the pool assigned one
+	Extension []byte
 
 	// Miner commands
 	commands chan *MinerCommand
@@ -107,11 +110,14 @@ type NonceIncrementer struct {
 	lastPrefixByte int
 }
 
-func NewNonceIncrementer(id uint32, personalid uint32) *NonceIncrementer {
+// NewNonceIncrementer starts the nonces at the id, followed by any extension
+// the pool assigned, and the personalid.
+func NewNonceIncrementer(id uint32, personalid uint32, extension ...byte) *NonceIncrementer {
 	n := new(NonceIncrementer)
 
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, id)
+	buf = append(buf, extension...)
 	buf = append(buf, byte(personalid))
 
 	n.lastPrefixByte = len(buf) - 1
@@ -145,7 +151,7 @@ func (i *NonceIncrementer) NextNonce() {
 }
 
 func (p *PegnetMiner) ResetNonce() {
-	p.MiningState.NonceIncrementer = NewNonceIncrementer(p.ID, p.PersonalID)
+	p.MiningState.NonceIncrementer = NewNonceIncrementer(p.ID, p.PersonalID, p.Extension...)
 	p.MiningState.start = 0
 	p.resetStatic()
 }
@@ -159,7 +165,7 @@ func NewPegnetMiner(id uint32, commands chan *MinerCommand, successes chan *Winn
 	p.successes = successes
 
 	// Some inits
-	p.MiningState.NonceIncrementer = NewNonceIncrementer(p.ID, p.PersonalID)
+	p.MiningState.NonceIncrementer = NewNonceIncrementer(p.ID, p.PersonalID, p.Extension...)
 	p.ResetNonce()
 	p.MiningState.stats = NewSingleMinerStats(p.PersonalID)
 
@@ -339,6 +345,9 @@ func (p *PegnetMiner) HandleCommand(c *MinerCommand) {
 	case NewNoncePrefix:
 		p.ID = c.Data.(uint32)
 		p.ResetNonce()
+	case NewNonceExtension:
+		p.Extension = c.Data.([]byte)
+		p.ResetNonce()
 	case NewOPRHash:
 		p.MiningState.oprhash = c.Data.([]byte)
 		p.resetStatic()
@@ -406,6 +415,13 @@ func (b *CommandBuilder) NewNoncePrefix(prefix uint32) *CommandBuilder {
 	return b
 }
 
+// NewNonceExtension follows the nonce prefix with more bytes, so a proxy can
+// split its nonce space between its rigs. A nil extension clears it.
+func (b *CommandBuilder) NewNonceExtension(extension []byte) *CommandBuilder {
+	b.commands = append(b.commands, &MinerCommand{Command: NewNonceExtension, Data: extension})
+	return b
+}
+
 func (b *CommandBuilder) ResetRecords() *CommandBuilder {
 	b.commands = append(b.commands, &MinerCommand{Command: ResetRecords, Data: nil})
 	return b
@@ -84,3 +84,10 @@ func TestNonceIncrementer_Prefix(t *testing.T) {
 //	h := LX.Hash(append(o, n...))
 //	fmt.Printf(hex.EncodeToString(h))
 //}
+
+func TestNonceIncrementer_Extension(t *testing.T) {
+	n := NewNonceIncrementer(100, 10, 0xab, 0xcd)
+	if !bytes.HasPrefix(n.Nonce, []byte{0, 0, 0, 100, 0xab, 0xcd, 10}) {
+		t.Errorf("extension not after the id, found %x", n.Nonce)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"go.uber.org/atomic"
 
 	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,7 +19,7 @@ const (
 // a good time to submit or not. If we are between minute 0 and minute 1, we
 // should not submit.
 type MinuteKeeper struct {
-	FactomClient *factom.Client
+	Factomd *factomclient.Pool
 
 	submit       atomic.Bool
 	submitHeight atomic.Int32
@@ -38,9 +39,9 @@ type MinuteKeeperStatus struct {
 	LastNoneZeroHeight int32 `json:"lastnonzero"`
 }
 
-func NewMinuteKeeper(cl *factom.Client) *MinuteKeeper {
+func NewMinuteKeeper(factomd *factomclient.Pool) *MinuteKeeper {
 	k := new(MinuteKeeper)
-	k.FactomClient = cl
+	k.Factomd = factomd
 	k.setSubmit(true)
 	k.Logger = log.New()
 	k.Logger.SetLevel(log.FatalLevel)
@@ -71,7 +72,9 @@ func (k *MinuteKeeper) Run(ctx context.Context) {
 			return // Cancelled
 		}
 		var cr CurrentMinute
-		err := k.FactomClient.FactomdRequest(nil, "current-minute", nil, &cr)
+		err := k.Factomd.Do(func(cl *factom.Client) error {
+			return cl.FactomdRequest(nil, "current-minute", nil, &cr)
+		})
 		if err != nil {
 			// Any error? We use rolling submits, and just eat the 1min problem
 			k.setSubmit(true)
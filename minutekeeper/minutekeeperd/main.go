@@ -6,13 +6,14 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
 	"github.com/FactomWyomingEntity/prosper-pool/minutekeeper"
 )
 
 func main() {
 
 	cl := factom.NewClient()
-	mn := minutekeeper.NewMinuteKeeper(cl)
+	mn := minutekeeper.NewMinuteKeeper(factomclient.NewPoolFromClients(cl))
 	mn.Logger.SetLevel(logrus.TraceLevel)
 
 	mn.Run(context.Background())
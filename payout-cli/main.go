@@ -1,17 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 
-	"github.com/FactomWyomingEntity/prosper-pool/config"
-
 	"github.com/Factom-Asset-Tokens/factom"
 
 	"github.com/FactomWyomingEntity/prosper-pool/accounting"
-	"github.com/pegnet/pegnetd/fat/fat2"
+	"github.com/FactomWyomingEntity/prosper-pool/payout"
 
 	"github.com/spf13/cobra"
 )
@@ -86,77 +85,63 @@ var pay = &cobra.Command{
 			return fmt.Errorf("bad FA address: %s", err.Error())
 		}
 
-		// Construct the transaction
-		var batch fat2.TransactionBatch
-		batch.Version = 1
-		batch.ChainID = factom.NewBytes32(config.TransactionChain[:])
-		for _, pay := range payments {
-			var tx fat2.Transaction
-			if pay.PaymentAmount < 0 {
-				return fmt.Errorf("%s is below 0 in paymen", pay.PayoutAddress)
-			}
-			tx.Input.Amount = uint64(pay.PaymentAmount)
-			tx.Input.Address = poolAddr
-			tx.Input.Type = fat2.PTickerPEG
-			tx.Transfers = make([]fat2.AddressAmountTuple, 1)
-			tx.Transfers[0].Amount = uint64(pay.PaymentAmount)
-			tx.Transfers[0].Address, err = factom.NewFAAddress(pay.PayoutAddress)
-			if err != nil {
-				return fmt.Errorf("%s is not a valid payout adress: %s", pay.PayoutAddress, err.Error())
-			}
-
-			batch.Transactions = append(batch.Transactions, tx)
-		}
-
-		err = batch.MarshalEntry()
+		payment, err := factom.NewECAddress(payer)
 		if err != nil {
-			return fmt.Errorf("failed to marshal tx: %s", err.Error())
-		}
-
-		if _, err := batch.Entry.Cost(); err != nil {
-			fmt.Println("If your entry is over 10KB, you can split the pay.json into parts manually.")
-			return fmt.Errorf("error with entry: %s", err.Error())
+			return fmt.Errorf("bad EC address: %s", err.Error())
 		}
 
-		priv, err := poolAddr.GetFsAddress(cl)
+		// Construct the transactions, split to fit in entries
+		batches, err := payout.SplitBatches(poolAddr, payments)
 		if err != nil {
-			return fmt.Errorf("unable to get private key: %s\n", err.Error())
+			return fmt.Errorf("failed to make tx: %s", err.Error())
 		}
 
-		batch.Sign(priv)
-
-		payment, err := factom.NewECAddress(payer)
+		keys := &payout.WalletdKeys{Client: cl, EC: payment}
+		priv, err := keys.FsAddress(context.Background(), poolAddr)
 		if err != nil {
 			return fmt.Errorf("unable to get private key: %s\n", err.Error())
 		}
 
-		es, err := payment.GetEsAddress(cl)
+		es, err := keys.EsAddress(context.Background())
 		if err != nil {
 			return fmt.Errorf("unable to get private key: %s", err.Error())
 		}
 
-		txid, err := batch.ComposeCreate(cl, es)
-		if err != nil {
-			return fmt.Errorf("unable to submit entry: %s", err.Error())
-		}
-
-		for i := range payments {
-			payments[i].EntryHash = batch.Entry.Hash.String()
+		for _, batch := range batches {
+			if err := batch.Sign(priv); err != nil {
+				return fmt.Errorf("error with entry: %s", err.Error())
+			}
 		}
 
-		data, err = json.Marshal(payments)
-		if err != nil {
-			fmt.Printf("failed to make reciept: %s\n", err.Error())
-		} else {
+		// The receipt must cover every batch that was submitted, even if a
+		// later one fails.
+		var submitted []*payout.Batch
+		defer func() {
+			if len(submitted) == 0 {
+				return
+			}
+			data, err := json.Marshal(payout.Receipt(submitted))
+			if err != nil {
+				fmt.Printf("failed to make reciept: %s\n", err.Error())
+				return
+			}
 			_, err = recFile.Write(data)
 			if err != nil {
 				fmt.Printf("failed to make reciept: %s\n", err.Error())
 			}
-		}
+		}()
+
+		for i, batch := range batches {
+			txid, err := batch.Submit(context.Background(), cl, es)
+			if err != nil {
+				return fmt.Errorf("unable to submit entry %d of %d: %s", i+1, len(batches), err.Error())
+			}
+			submitted = append(submitted, batch)
 
-		fmt.Println("Payment submitted to the network")
-		fmt.Printf("EntryHash: %s\n", batch.Entry.Hash.String())
-		fmt.Printf("   Commit: %s\n", txid.String())
+			fmt.Printf("Payment %d of %d submitted to the network\n", i+1, len(batches))
+			fmt.Printf("EntryHash: %s\n", batch.Entry.Hash.String())
+			fmt.Printf("   Commit: %s\n", txid.String())
+		}
 
 		return nil
 	},
@@ -0,0 +1,184 @@
+package payout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/Factom-Asset-Tokens/factom/fat103"
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+)
+
+// The batch types mirror the pegnetd fat2 transaction batch json. The fat2
+// package pins a fatd that does not build against our factom library, so
+// the pool constructs the entry itself.
+
+const (
+	BatchVersion = 1
+	TickerPEG    = "PEG"
+
+	// SignatureLen is the size the fat103 signature adds to the entry for a
+	// single signer: the timestamp salt, the RCD, and the signature ExtIDs.
+	SignatureLen = (2 + 10) + (2 + 33) + (2 + 64)
+)
+
+type AddressAmount struct {
+	Address factom.FAAddress `json:"address"`
+	Amount  uint64           `json:"amount"`
+}
+
+type TypedAddressAmount struct {
+	Address factom.FAAddress `json:"address"`
+	Amount  uint64           `json:"amount"`
+	Type    string           `json:"type"`
+}
+
+type Transaction struct {
+	Input     TypedAddressAmount `json:"input"`
+	Transfers []AddressAmount    `json:"transfers"`
+}
+
+// Batch is a PEG transaction batch paying out a set of payments from a
+// single input address.
+type Batch struct {
+	Version      uint          `json:"version"`
+	Transactions []Transaction `json:"transactions"`
+
+	Payments []accounting.Paid `json:"-"`
+	Entry    factom.Entry      `json:"-"`
+}
+
+// NewBatch constructs a batch paying all the payments from the source. The
+// entry content is set, but the batch still needs to be signed.
+func NewBatch(source factom.FAAddress, payments []accounting.Paid) (*Batch, error) {
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("no payments in batch")
+	}
+
+	b := new(Batch)
+	b.Version = BatchVersion
+	b.Payments = payments
+	for _, pay := range payments {
+		if pay.PaymentAmount <= 0 {
+			return nil, fmt.Errorf("%s has a payment of %d, payments must be above 0", pay.UserID, pay.PaymentAmount)
+		}
+
+		dest, err := factom.NewFAAddress(pay.PayoutAddress)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid payout address: %s", pay.PayoutAddress, err.Error())
+		}
+
+		b.Transactions = append(b.Transactions, Transaction{
+			Input: TypedAddressAmount{
+				Address: source,
+				Amount:  uint64(pay.PaymentAmount),
+				Type:    TickerPEG,
+			},
+			Transfers: []AddressAmount{{Address: dest, Amount: uint64(pay.PaymentAmount)}},
+		})
+	}
+
+	content, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := factom.Bytes32(config.TransactionChain)
+	b.Entry.ChainID = &chain
+	b.Entry.Content = content
+	return b, nil
+}
+
+// SplitBatches splits the payments into as many batches as needed for each
+// signed batch to fit in a single entry. Every batch has its own copy of its
+// payments.
+func SplitBatches(source factom.FAAddress, payments []accounting.Paid) ([]*Batch, error) {
+	var batches []*Batch
+	for start := 0; start < len(payments); {
+		end := start + 1
+		b, err := NewBatch(source, payments[start:end])
+		if err != nil {
+			return nil, err
+		}
+		if !b.Fits() {
+			return nil, fmt.Errorf("the payment to %s does not fit in an entry", payments[start].PayoutAddress)
+		}
+
+		// Grow the batch until the next payment no longer fits
+		for ; end < len(payments); end++ {
+			next, err := NewBatch(source, payments[start:end+1])
+			if err != nil {
+				return nil, err
+			}
+			if !next.Fits() {
+				break
+			}
+			b = next
+		}
+
+		b.Payments = append([]accounting.Paid(nil), payments[start:end]...)
+		batches = append(batches, b)
+		start = end
+	}
+	return batches, nil
+}
+
+// Fits returns true if the batch will fit in an entry once signed
+func (b *Batch) Fits() bool {
+	return len(b.Entry.Content)+SignatureLen <= factom.EntryMaxDataLen
+}
+
+// Total is the sum of all the payments in the batch
+func (b *Batch) Total() int64 {
+	var total int64
+	for _, pay := range b.Payments {
+		total += pay.PaymentAmount
+	}
+	return total
+}
+
+// Sign signs the batch entry with the input address's private key. The entry
+// hash is known once signed, so the payments will have their entryhash set.
+func (b *Batch) Sign(fs factom.FsAddress) error {
+	for _, tx := range b.Transactions {
+		if tx.Input.Address != fs.FAAddress() {
+			return fmt.Errorf("signing key is for %s, but the input is %s", fs.FAAddress(), tx.Input.Address)
+		}
+	}
+
+	b.Entry = fat103.Sign(b.Entry, fs)
+	if _, err := b.Entry.Cost(); err != nil {
+		return fmt.Errorf("batch entry is invalid: %s", err.Error())
+	}
+
+	data, err := b.Entry.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("batch entry is invalid: %s", err.Error())
+	}
+	hash := factom.ComputeEntryHash(data)
+	b.Entry.Hash = &hash
+	for i := range b.Payments {
+		b.Payments[i].EntryHash = hash.String()
+	}
+	return nil
+}
+
+// Submit commits and reveals the signed batch. The payments will have their
+// entryhash set.
+func (b *Batch) Submit(ctx context.Context, cl *factom.Client, es factom.EsAddress) (factom.Bytes32, error) {
+	if len(b.Entry.ExtIDs) == 0 {
+		return factom.Bytes32{}, fmt.Errorf("batch is not signed")
+	}
+
+	txid, err := b.Entry.ComposeCreate(ctx, cl, es)
+	if err != nil {
+		return txid, err
+	}
+
+	for i := range b.Payments {
+		b.Payments[i].EntryHash = b.Entry.Hash.String()
+	}
+	return txid, nil
+}
@@ -0,0 +1,135 @@
+package payout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// Factomd ack statuses
+const (
+	StatusUnknown         = "Unknown"
+	StatusNotConfirmed    = "NotConfirmed"
+	StatusTransactionACK  = "TransactionACK"
+	StatusDBlockConfirmed = "DBlockConfirmed"
+)
+
+type ackParams struct {
+	Hash    string `json:"hash"`
+	ChainID string `json:"chainid"`
+}
+
+type AckResult struct {
+	CommitTxID string `json:"committxid"`
+	EntryHash  string `json:"entryhash"`
+	CommitData struct {
+		Status string `json:"status"`
+	} `json:"commitdata"`
+	EntryData struct {
+		Status string `json:"status"`
+	} `json:"entrydata"`
+}
+
+// EntryStatus asks factomd for the status of an entry
+func EntryStatus(ctx context.Context, cl *factom.Client, entryHash, chainID string) (string, error) {
+	var res AckResult
+	err := cl.FactomdRequest(ctx, "ack", ackParams{Hash: entryHash, ChainID: chainID}, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.EntryData.Status, nil
+}
+
+// WaitForConfirmation polls factomd until the entry is in a directory block.
+// An error is returned if it is not confirmed within the timeout.
+func WaitForConfirmation(ctx context.Context, cl *factom.Client, entryHash, chainID string, poll, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		status, err := EntryStatus(ctx, cl, entryHash, chainID)
+		if err == nil {
+			last = status
+			if status == StatusDBlockConfirmed {
+				return nil
+			}
+		} else {
+			payLog.WithError(err).WithField("entryhash", entryHash).Warn("failed to get entry status")
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("entry %s not confirmed after %s, last status '%s'", entryHash, timeout, last)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pegnetd transaction statuses. A batch that was applied has the height it
+// was executed at.
+const (
+	TxPending  = 0
+	TxRejected = -1
+)
+
+// ErrBatchRejected means pegnetd rejected the batch, so none of its payments
+// were made
+var ErrBatchRejected = errors.New("the transaction batch was rejected by pegnetd")
+
+type txStatusParams struct {
+	EntryHash string `json:"entryhash"`
+}
+
+type TxStatus struct {
+	Height   uint32 `json:"height"`
+	Executed int32  `json:"executed"`
+}
+
+// TransactionStatus asks pegnetd for the status of a transaction batch
+func TransactionStatus(ctx context.Context, pegnetd *factom.Client, entryHash string) (*TxStatus, error) {
+	var res TxStatus
+	err := pegnetd.FactomdRequest(ctx, "get-transaction-status", txStatusParams{EntryHash: entryHash}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// WaitForApplied polls pegnetd until the batch is applied. Pegnetd only
+// applies a batch once it is in a directory block, and ErrBatchRejected is
+// returned if it is rejected. An error is returned if pegnetd has not
+// decided within the timeout.
+func WaitForApplied(ctx context.Context, pegnetd *factom.Client, entryHash string, poll, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		status, err := TransactionStatus(ctx, pegnetd, entryHash)
+		if err == nil {
+			switch {
+			case status.Executed == TxRejected:
+				return ErrBatchRejected
+			case status.Executed != TxPending:
+				return nil
+			}
+		} else {
+			payLog.WithError(err).WithField("entryhash", entryHash).Warn("failed to get transaction status")
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("batch %s not applied by pegnetd after %s", entryHash, timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package payout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/spf13/viper"
+)
+
+const (
+	KeySourceWalletd = "walletd"
+	KeySourceConfig  = "config"
+)
+
+// KeySource provides the private keys needed to sign and pay for a payout.
+type KeySource interface {
+	// FsAddress returns the private key for the PEG source
+	FsAddress(ctx context.Context, fa factom.FAAddress) (factom.FsAddress, error)
+	// EsAddress returns the private key that pays for the entry
+	EsAddress(ctx context.Context) (factom.EsAddress, error)
+}
+
+func NewKeySource(conf *viper.Viper, cl *factom.Client) (KeySource, error) {
+	switch strings.ToLower(conf.GetString(config.ConfigPayoutKeySource)) {
+	case KeySourceWalletd:
+		ec, err := factom.NewECAddress(conf.GetString(config.ConfigPayoutECAddress))
+		if err != nil {
+			return nil, fmt.Errorf("payout ec address: %s", err.Error())
+		}
+		return &WalletdKeys{Client: cl, EC: ec}, nil
+	case KeySourceConfig:
+		fs, err := factom.NewFsAddress(conf.GetString(config.ConfigPayoutFsAddress))
+		if err != nil {
+			return nil, fmt.Errorf("payout fs address: %s", err.Error())
+		}
+		es, err := factom.NewEsAddress(conf.GetString(config.ConfigPayoutESAddress))
+		if err != nil {
+			return nil, fmt.Errorf("payout es address: %s", err.Error())
+		}
+		return &StaticKeys{Fs: fs, Es: es}, nil
+	default:
+		return nil, fmt.Errorf("unknown payout key source '%s'", conf.GetString(config.ConfigPayoutKeySource))
+	}
+}
+
+// WalletdKeys fetches the keys from factom-walletd when they are needed, so
+// they never have to be stored with the pool config.
+type WalletdKeys struct {
+	Client *factom.Client
+	EC     factom.ECAddress
+}
+
+func (w *WalletdKeys) FsAddress(ctx context.Context, fa factom.FAAddress) (factom.FsAddress, error) {
+	return fa.GetFsAddress(ctx, w.Client)
+}
+
+func (w *WalletdKeys) EsAddress(ctx context.Context) (factom.EsAddress, error) {
+	return w.EC.GetEsAddress(ctx, w.Client)
+}
+
+// StaticKeys are keys provided directly, such as from the config
+type StaticKeys struct {
+	Fs factom.FsAddress
+	Es factom.EsAddress
+}
+
+func (s *StaticKeys) FsAddress(ctx context.Context, fa factom.FAAddress) (factom.FsAddress, error) {
+	if s.Fs.FAAddress() != fa {
+		return factom.FsAddress{}, fmt.Errorf("no private key for %s", fa)
+	}
+	return s.Fs, nil
+}
+
+func (s *StaticKeys) EsAddress(ctx context.Context) (factom.EsAddress, error) {
+	return s.Es, nil
+}
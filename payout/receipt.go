@@ -0,0 +1,106 @@
+package payout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+)
+
+// CheckReceipt looks up every entry in the receipt on chain. Each entry hash
+// maps to an error if the entry is not in a directory block, does not pay
+// what the receipt says it does, or was not applied by pegnetd. Entries
+// that pass are not in the map.
+func CheckReceipt(ctx context.Context, cl, pegnetd *factom.Client, source factom.FAAddress, payments []accounting.Paid) map[string]error {
+	byHash := make(map[string][]accounting.Paid)
+	for _, pay := range payments {
+		byHash[pay.EntryHash] = append(byHash[pay.EntryHash], pay)
+	}
+
+	failed := make(map[string]error)
+	for hash, pays := range byHash {
+		if err := CheckEntry(ctx, cl, pegnetd, source, hash, pays); err != nil {
+			failed[hash] = err
+		}
+	}
+	return failed
+}
+
+// CheckEntry ensures the entry is confirmed, that it is a batch paying
+// exactly the payments given from the source address, and that pegnetd
+// applied it. ErrBatchRejected is returned if pegnetd rejected the batch.
+func CheckEntry(ctx context.Context, cl, pegnetd *factom.Client, source factom.FAAddress, entryHash string, payments []accounting.Paid) error {
+	chain := factom.Bytes32(config.TransactionChain)
+	status, err := EntryStatus(ctx, cl, entryHash, chain.String())
+	if err != nil {
+		return fmt.Errorf("unable to get entry status: %s", err.Error())
+	}
+	if status != StatusDBlockConfirmed {
+		return fmt.Errorf("entry is not in a directory block, status '%s'", status)
+	}
+
+	var hash factom.Bytes32
+	if err := hash.Set(entryHash); err != nil {
+		return fmt.Errorf("invalid entryhash: %s", err.Error())
+	}
+
+	e := factom.Entry{Hash: &hash}
+	if err := e.Get(ctx, cl); err != nil {
+		return fmt.Errorf("unable to get entry: %s", err.Error())
+	}
+	if *e.ChainID != chain {
+		return fmt.Errorf("entry is not in the transaction chain")
+	}
+
+	var batch Batch
+	if err := json.Unmarshal(e.Content, &batch); err != nil {
+		return fmt.Errorf("entry is not a transaction batch: %s", err.Error())
+	}
+
+	// Every transfer must be in the receipt, and every payment on chain
+	type transfer struct {
+		Address string
+		Amount  uint64
+	}
+	onChain := make(map[transfer]int)
+	for _, tx := range batch.Transactions {
+		if tx.Input.Address != source {
+			return fmt.Errorf("batch pays from %s, not the payout address %s", tx.Input.Address, source)
+		}
+		for _, t := range tx.Transfers {
+			onChain[transfer{Address: t.Address.String(), Amount: t.Amount}]++
+		}
+	}
+
+	for _, pay := range payments {
+		t := transfer{Address: pay.PayoutAddress, Amount: uint64(pay.PaymentAmount)}
+		if onChain[t] == 0 {
+			return fmt.Errorf("payment of %d to %s is not in the entry", pay.PaymentAmount, pay.PayoutAddress)
+		}
+		onChain[t]--
+	}
+
+	for t, left := range onChain {
+		if left > 0 {
+			return fmt.Errorf("entry pays %d to %s, which is not in the receipt", t.Amount, t.Address)
+		}
+	}
+
+	// A batch on chain can still be rejected, like when the source does
+	// not have the balance to cover it
+	txStatus, err := TransactionStatus(ctx, pegnetd, entryHash)
+	if err != nil {
+		return fmt.Errorf("unable to get transaction status: %s", err.Error())
+	}
+	switch txStatus.Executed {
+	case TxRejected:
+		return ErrBatchRejected
+	case TxPending:
+		return fmt.Errorf("batch is not yet applied by pegnetd")
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package payout_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	. "github.com/FactomWyomingEntity/prosper-pool/payout"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckReceipt(t *testing.T) {
+	require := require.New(t)
+	factomd := NewStandInFactomd(2)
+	srv := httptest.NewServer(factomd)
+	defer srv.Close()
+	cl := factom.NewClient()
+	cl.FactomdServer = srv.URL
+
+	source, err := factom.GenerateFsAddress()
+	require.NoError(err)
+	es, err := factom.GenerateEsAddress()
+	require.NoError(err)
+
+	var payments []accounting.Paid
+	for i := 0; i < 3; i++ {
+		adr, err := factom.GenerateFsAddress()
+		require.NoError(err)
+		payments = append(payments, accounting.Paid{UserID: "u", PayoutAddress: adr.FAAddress().String(), PaymentAmount: 1e8})
+	}
+
+	batches, err := SplitBatches(source.FAAddress(), payments)
+	require.NoError(err)
+	require.Len(batches, 1)
+	require.NoError(batches[0].Sign(source))
+	_, err = batches[0].Submit(context.Background(), cl, es)
+	require.NoError(err)
+	receipt := Receipt(batches)
+	hash := receipt[0].EntryHash
+
+	// Not yet in a directory block
+	failed := CheckReceipt(context.Background(), cl, cl, source.FAAddress(), receipt)
+	require.Contains(failed, hash)
+
+	failed = CheckReceipt(context.Background(), cl, cl, source.FAAddress(), receipt)
+	require.Empty(failed)
+
+	t.Run("wrong amount", func(t *testing.T) {
+		bad := append([]accounting.Paid(nil), receipt...)
+		bad[1].PaymentAmount++
+		require.Contains(CheckReceipt(context.Background(), cl, cl, source.FAAddress(), bad), hash)
+	})
+
+	t.Run("missing payment", func(t *testing.T) {
+		require.Contains(CheckReceipt(context.Background(), cl, cl, source.FAAddress(), receipt[1:]), hash)
+	})
+
+	t.Run("wrong input", func(t *testing.T) {
+		other, err := factom.GenerateFsAddress()
+		require.NoError(err)
+		failed := CheckReceipt(context.Background(), cl, cl, other.FAAddress(), receipt)
+		require.Contains(failed, hash)
+	})
+
+	t.Run("unknown entry", func(t *testing.T) {
+		bad := append([]accounting.Paid(nil), receipt...)
+		bad[0].EntryHash = factom.Bytes32{}.String()
+		failed := CheckReceipt(context.Background(), cl, cl, source.FAAddress(), bad)
+		require.Len(failed, 2)
+	})
+}
+
+func TestCheckReceipt_Rejected(t *testing.T) {
+	require := require.New(t)
+	factomd := NewStandInFactomd(1)
+	factomd.RejectBatches = true
+	srv := httptest.NewServer(factomd)
+	defer srv.Close()
+	cl := factom.NewClient()
+	cl.FactomdServer = srv.URL
+
+	source, err := factom.GenerateFsAddress()
+	require.NoError(err)
+	es, err := factom.GenerateEsAddress()
+	require.NoError(err)
+	payments := []accounting.Paid{{UserID: "u", PayoutAddress: source.FAAddress().String(), PaymentAmount: 1e8}}
+
+	batches, err := SplitBatches(source.FAAddress(), payments)
+	require.NoError(err)
+	require.NoError(batches[0].Sign(source))
+	_, err = batches[0].Submit(context.Background(), cl, es)
+	require.NoError(err)
+
+	// On chain, but never applied
+	receipt := Receipt(batches)
+	failed := CheckReceipt(context.Background(), cl, cl, source.FAAddress(), receipt)
+	require.Equal(ErrBatchRejected, failed[receipt[0].EntryHash])
+}
@@ -0,0 +1,263 @@
+package payout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	payLog = log.WithField("mod", "payout")
+)
+
+// Scheduler pays out all the owed user balances on an interval. Payments
+// are recorded as pending before the batches are submitted, and confirmed
+// once pegnetd has applied them. While any payment is pending the scheduler
+// halts, as paying again could pay users twice. This holds across restarts,
+// until an admin resolves the pending payments with `db confirm`.
+type Scheduler struct {
+	Accountant *accounting.Accountant
+	Client     *factom.Client
+	Pegnetd    *factom.Client
+	Keys       KeySource
+
+	// Source is the address paying the users
+	Source           factom.FAAddress
+	Interval         time.Duration
+	DryRun           bool
+	ConfirmTimeout   time.Duration
+	PollInterval     time.Duration
+	ReceiptDirectory string
+}
+
+func NewScheduler(conf *viper.Viper, acc *accounting.Accountant, cl *factom.Client) (*Scheduler, error) {
+	s := new(Scheduler)
+	s.Accountant = acc
+	s.Client = cl
+	s.Pegnetd = factomclient.PegnetdClientFromConfig(conf)
+	s.Interval = conf.GetDuration(config.ConfigPayoutInterval)
+	s.DryRun = conf.GetBool(config.ConfigPayoutDryRun)
+	s.ConfirmTimeout = conf.GetDuration(config.ConfigPayoutConfirmTimeout)
+	s.PollInterval = time.Second * 10
+	s.ReceiptDirectory = os.ExpandEnv(conf.GetString(config.ConfigPayoutReceiptDirectory))
+
+	if s.Interval <= 0 {
+		return nil, fmt.Errorf("payout interval must be greater than 0")
+	}
+
+	var err error
+	s.Source, err = factom.NewFAAddress(conf.GetString(config.ConfigPayoutFAAddress))
+	if err != nil {
+		return nil, fmt.Errorf("payout fa address: %s", err.Error())
+	}
+
+	// A dry run never signs anything
+	if !s.DryRun {
+		s.Keys, err = NewKeySource(conf, cl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Halted returns the reason the scheduler will not pay, if it will not.
+// Payouts halt while any payments are pending.
+func (s *Scheduler) Halted() error {
+	pending, err := s.Accountant.PendingPayments()
+	if err != nil {
+		return fmt.Errorf("unable to check for pending payments: %s", err.Error())
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d payments are pending", len(pending))
+	}
+	return nil
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	payLog.WithFields(log.Fields{"interval": s.Interval, "dryrun": s.DryRun}).Info("payout scheduler started")
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Halted(); err != nil {
+				payLog.WithError(err).Error("payouts are halted, resolve the pending payments with `db confirm`")
+				continue
+			}
+			if _, err := s.PayOnce(ctx); err != nil {
+				payLog.WithError(err).Error("scheduled payout failed")
+			}
+		}
+	}
+}
+
+// PayOnce calculates, submits, and records a single payout. The payout is
+// split into as many batches as needed. The payments of every batch are
+// recorded as pending before any is submitted, and each batch is confirmed
+// or failed once pegnetd decides on it. The batches are returned, and will
+// be empty if there was nothing to pay.
+func (s *Scheduler) PayOnce(ctx context.Context) ([]*Batch, error) {
+	if err := s.Halted(); err != nil {
+		return nil, fmt.Errorf("payouts are halted: %s", err.Error())
+	}
+
+	payments, err := s.Accountant.CalculatePayments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payments) == 0 {
+		payLog.Info("no payments above the minimum, nothing to pay")
+		return nil, nil
+	}
+
+	batches, err := SplitBatches(s.Source, payments)
+	if err != nil {
+		return nil, err
+	}
+
+	pLog := payLog.WithFields(log.Fields{"payments": len(payments), "batches": len(batches), "source": s.Source})
+	if s.DryRun {
+		for _, pay := range payments {
+			pLog.WithFields(log.Fields{"user": pay.UserID, "address": pay.PayoutAddress, "amount": pay.PaymentAmount}).Info("dry run payment")
+		}
+		pLog.Info("dry run, payout not submitted")
+		return batches, nil
+	}
+
+	fs, err := s.Keys.FsAddress(ctx, s.Source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get private key: %s", err.Error())
+	}
+
+	es, err := s.Keys.EsAddress(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get private key: %s", err.Error())
+	}
+
+	for _, batch := range batches {
+		if err := batch.Sign(fs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Recorded before anything is sent, so a restart can never pay
+	// these balances again
+	payments = Receipt(batches)
+	for i := range payments {
+		payments[i].Status = accounting.PaidPending
+	}
+	if err := s.Accountant.WritePayments(payments); err != nil {
+		return nil, fmt.Errorf("unable to record pending payments: %s", err.Error())
+	}
+
+	receipt, err := s.writeReceipt(batches)
+	if err != nil {
+		pLog.WithError(err).Error("failed to write receipt")
+	}
+	pLog = pLog.WithField("receipt", receipt)
+
+	var submitted []*Batch
+	for i, batch := range batches {
+		txid, err := batch.Submit(ctx, s.Client, es)
+		if err != nil {
+			// We cannot be sure the failed batch was not paid, so it
+			// stays pending. The batches after it were never sent.
+			for _, unsent := range batches[i+1:] {
+				if rErr := s.Accountant.RemovePayments(unsent.Entry.Hash.String()); rErr != nil {
+					pLog.WithError(rErr).WithField("entryhash", unsent.Entry.Hash.String()).Error("failed to remove unsent payments")
+				}
+			}
+			pLog.Errorf("payout stopped after %d of %d batches", len(submitted), len(batches))
+			return submitted, fmt.Errorf("unable to submit entry: %s", err.Error())
+		}
+		submitted = append(submitted, batch)
+		pLog.WithFields(log.Fields{"entryhash": batch.Entry.Hash.String(), "commit": txid.String(), "total": batch.Total()}).Info("payout batch submitted")
+	}
+
+	var failed error
+	for _, batch := range batches {
+		hash := batch.Entry.Hash.String()
+		bLog := pLog.WithField("entryhash", hash)
+
+		status := accounting.PaidConfirmed
+		if err := s.confirm(ctx, batch); err == ErrBatchRejected {
+			status = accounting.PaidFailed
+			failed = err
+			bLog.Error("payout batch rejected, the payments will be made again")
+		} else if err != nil {
+			failed = err
+			bLog.WithError(err).Error("payout batch was not applied, the payments are left pending")
+			continue
+		}
+
+		if err := s.Accountant.SetPaymentStatus(hash, status); err != nil {
+			bLog.WithError(err).Errorf("failed to record the payments as %s", status)
+			failed = err
+		}
+	}
+	if failed != nil {
+		return batches, failed
+	}
+
+	pLog.Info("payout confirmed and recorded")
+	return batches, nil
+}
+
+// confirm waits for the batch to be in a directory block and applied by
+// pegnetd, then checks the batch on chain is the one submitted
+func (s *Scheduler) confirm(ctx context.Context, batch *Batch) error {
+	hash := batch.Entry.Hash.String()
+	err := WaitForConfirmation(ctx, s.Client, hash, batch.Entry.ChainID.String(), s.PollInterval, s.ConfirmTimeout)
+	if err != nil {
+		return err
+	}
+	if err := WaitForApplied(ctx, s.Pegnetd, hash, s.PollInterval, s.ConfirmTimeout); err != nil {
+		return err
+	}
+	return CheckEntry(ctx, s.Client, s.Pegnetd, s.Source, hash, batch.Payments)
+}
+
+// Receipt combines the payments of all the batches. Each payment has the
+// entryhash of its own batch.
+func Receipt(batches []*Batch) []accounting.Paid {
+	var payments []accounting.Paid
+	for _, b := range batches {
+		payments = append(payments, b.Payments...)
+	}
+	return payments
+}
+
+// writeReceipt writes the receipt in the format `db record` reads
+func (s *Scheduler) writeReceipt(batches []*Batch) (string, error) {
+	if s.ReceiptDirectory == "" || len(batches) == 0 {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(s.ReceiptDirectory, 0700); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(Receipt(batches))
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(s.ReceiptDirectory, fmt.Sprintf("receipt-%s.json", batches[0].Entry.Hash.String()))
+	return path, ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,233 @@
+package payout_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/Factom-Asset-Tokens/factom/fat103"
+	"github.com/FactomWyomingEntity/prosper-pool/accounting"
+	"github.com/FactomWyomingEntity/prosper-pool/authentication"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/payout"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func testScheduler(t *testing.T, factomd string) (*Scheduler, *gorm.DB) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	db.AutoMigrate(&authentication.User{})
+
+	fs, err := factom.GenerateFsAddress()
+	require.NoError(err)
+	es, err := factom.GenerateEsAddress()
+	require.NoError(err)
+
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigFactomdLocation, factomd)
+	conf.Set(config.ConfigPegnetdLocation, factomd)
+	conf.Set(config.ConfigPayoutKeySource, KeySourceConfig)
+	conf.Set(config.ConfigPayoutFAAddress, fs.FAAddress().String())
+	conf.Set(config.ConfigPayoutFsAddress, fs.String())
+	conf.Set(config.ConfigPayoutESAddress, es.String())
+	conf.Set(config.ConfigPayoutReceiptDirectory, t.TempDir())
+	conf.Set(config.ConfigPoolMinimumPayout, "1")
+
+	acc, err := accounting.NewAccountant(conf, db)
+	require.NoError(err)
+
+	cl := factom.NewClient()
+	cl.FactomdServer = factomd
+	s, err := NewScheduler(conf, acc, cl)
+	require.NoError(err)
+	s.PollInterval = time.Millisecond * 10
+	s.ConfirmTimeout = time.Second
+
+	// Three users with different balances
+	owed := map[string]int64{"big": 10e8, "small": 5e7, "none": 0}
+	var job int32
+	for user, amt := range owed {
+		job++
+		adr, err := factom.GenerateFsAddress()
+		require.NoError(err)
+		require.NoError(db.Create(&authentication.User{UID: user, PayoutAddress: adr.FAAddress().String()}).Error)
+		require.NoError(db.Create(&accounting.UserOwedPayouts{JobID: job, UserID: user, Payout: amt}).Error)
+	}
+	return s, db
+}
+
+func paidCount(t *testing.T, db *gorm.DB) int {
+	var count int
+	require.NoError(t, db.Model(&accounting.Paid{}).Count(&count).Error)
+	return count
+}
+
+func TestScheduler_PayOnce(t *testing.T) {
+	t.Run("dry run", func(t *testing.T) {
+		require := require.New(t)
+		factomd := NewStandInFactomd(1)
+		srv := httptest.NewServer(factomd)
+		defer srv.Close()
+
+		s, db := testScheduler(t, srv.URL)
+		s.DryRun = true
+		batches, err := s.PayOnce(context.Background())
+		require.NoError(err)
+		require.Len(batches, 1)
+		require.Len(batches[0].Payments, 1)
+		require.Equal(int64(10e8), batches[0].Total())
+
+		require.Empty(factomd.Entries())
+		require.Equal(0, paidCount(t, db))
+	})
+
+	t.Run("confirmed", func(t *testing.T) {
+		require := require.New(t)
+		factomd := NewStandInFactomd(3)
+		srv := httptest.NewServer(factomd)
+		defer srv.Close()
+
+		s, db := testScheduler(t, srv.URL)
+		batches, err := s.PayOnce(context.Background())
+		require.NoError(err)
+		require.Len(batches, 1)
+
+		// The entry is signed by the source address
+		entries := factomd.Entries()
+		require.Len(entries, 1)
+		require.Equal(config.TransactionChain[:], entries[0].ChainID[:])
+		// The timestamp salt is checked against the entry's block time
+		entries[0].Timestamp = time.Now()
+		require.NoError(fat103.Validate(entries[0], map[factom.Bytes32]struct{}{factom.Bytes32(s.Source): {}}))
+
+		var content Batch
+		require.NoError(json.Unmarshal(entries[0].Content, &content))
+		require.Len(content.Transactions, 1)
+		require.Equal(uint64(10e8), content.Transactions[0].Input.Amount)
+
+		// Payments are recorded and the receipt is written
+		var paid []accounting.Paid
+		require.NoError(db.Find(&paid).Error)
+		require.Len(paid, 1)
+		require.Equal("big", paid[0].UserID)
+		require.Equal(entries[0].Hash.String(), paid[0].EntryHash)
+		require.Equal(accounting.PaidConfirmed, paid[0].Status)
+
+		data, err := ioutil.ReadFile(filepath.Join(s.ReceiptDirectory, "receipt-"+paid[0].EntryHash+".json"))
+		require.NoError(err)
+		var receipt []accounting.Paid
+		require.NoError(json.Unmarshal(data, &receipt))
+		require.Len(receipt, 1)
+
+		// Nothing is left to pay above the minimum
+		batches, err = s.PayOnce(context.Background())
+		require.NoError(err)
+		require.Empty(batches)
+	})
+
+	t.Run("not confirmed", func(t *testing.T) {
+		require := require.New(t)
+		factomd := NewStandInFactomd(1000)
+		srv := httptest.NewServer(factomd)
+		defer srv.Close()
+
+		s, db := testScheduler(t, srv.URL)
+		s.ConfirmTimeout = time.Millisecond * 100
+		_, err := s.PayOnce(context.Background())
+		require.Error(err)
+
+		// The payment was recorded before it was sent
+		var paid []accounting.Paid
+		require.NoError(db.Find(&paid).Error)
+		require.Len(paid, 1)
+		require.Equal(accounting.PaidPending, paid[0].Status)
+
+		// The scheduler will not pay again until an admin steps in, even
+		// after a restart
+		require.Error(s.Halted())
+		_, err = s.PayOnce(context.Background())
+		require.Error(err)
+		restarted := &Scheduler{Accountant: s.Accountant}
+		require.Error(restarted.Halted())
+		require.Len(factomd.Entries(), 1)
+
+		// Once resolved, payouts resume
+		require.NoError(s.Accountant.SetPaymentStatus(paid[0].EntryHash, accounting.PaidConfirmed))
+		require.NoError(s.Halted())
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		require := require.New(t)
+		factomd := NewStandInFactomd(1)
+		factomd.RejectBatches = true
+		srv := httptest.NewServer(factomd)
+		defer srv.Close()
+
+		s, db := testScheduler(t, srv.URL)
+		_, err := s.PayOnce(context.Background())
+		require.Equal(ErrBatchRejected, err)
+
+		var paid []accounting.Paid
+		require.NoError(db.Find(&paid).Error)
+		require.Len(paid, 1)
+		require.Equal(accounting.PaidFailed, paid[0].Status)
+
+		// Nothing was paid, so the balance is paid again
+		require.NoError(s.Halted())
+		payments, err := s.Accountant.CalculatePayments()
+		require.NoError(err)
+		require.Len(payments, 1)
+		require.Equal(int64(10e8), payments[0].PaymentAmount)
+	})
+}
+
+func TestSplitBatches(t *testing.T) {
+	require := require.New(t)
+	source, err := factom.GenerateFsAddress()
+	require.NoError(err)
+
+	var payments []accounting.Paid
+	for i := 0; i < 200; i++ {
+		adr, err := factom.GenerateFsAddress()
+		require.NoError(err)
+		payments = append(payments, accounting.Paid{
+			UserID:        fmt.Sprintf("user-%d", i),
+			PayoutAddress: adr.FAAddress().String(),
+			PaymentAmount: int64(i+1) * 1e8,
+		})
+	}
+
+	// All 200 will not fit in a single entry
+	single, err := NewBatch(source.FAAddress(), payments)
+	require.NoError(err)
+	require.False(single.Fits())
+
+	batches, err := SplitBatches(source.FAAddress(), payments)
+	require.NoError(err)
+	require.True(len(batches) > 1)
+
+	var total int64
+	for _, b := range batches {
+		require.NoError(b.Sign(source))
+		total += b.Total()
+	}
+	require.Equal(single.Total(), total)
+
+	// The receipt has every payment, in order
+	receipt := Receipt(batches)
+	require.Len(receipt, len(payments))
+	for i := range receipt {
+		require.Equal(payments[i].UserID, receipt[i].UserID)
+	}
+}
@@ -0,0 +1,188 @@
+package payout
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// StandInFactomd is a minimal factomd for testing payouts locally. It
+// accepts entry commits and reveals, and reports revealed entries as
+// confirmed after they have been polled a few times. It also stands in for
+// pegnetd, and reports confirmed entries as applied. Nothing is validated
+// beyond the entry format, and nothing is sent to a network.
+type StandInFactomd struct {
+	// ConfirmAfter is the number of acks before an entry is reported as
+	// in a directory block
+	ConfirmAfter int
+	// RejectBatches has pegnetd report every confirmed entry as rejected
+	RejectBatches bool
+
+	sync.Mutex
+	commits map[factom.Bytes32]bool
+	entries map[factom.Bytes32][]byte
+	acks    map[factom.Bytes32]int
+}
+
+func NewStandInFactomd(confirmAfter int) *StandInFactomd {
+	s := new(StandInFactomd)
+	s.ConfirmAfter = confirmAfter
+	s.commits = make(map[factom.Bytes32]bool)
+	s.entries = make(map[factom.Bytes32][]byte)
+	s.acks = make(map[factom.Bytes32]int)
+	return s
+}
+
+type standInRequest struct {
+	ID     interface{}     `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type standInError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type standInResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      interface{}   `json:"id"`
+	Result  interface{}   `json:"result,omitempty"`
+	Error   *standInError `json:"error,omitempty"`
+}
+
+// Entries returns all the revealed entries
+func (s *StandInFactomd) Entries() []factom.Entry {
+	s.Lock()
+	defer s.Unlock()
+	var entries []factom.Entry
+	for _, data := range s.entries {
+		var e factom.Entry
+		if err := e.UnmarshalBinary(data); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (s *StandInFactomd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req standInRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(standInResponse{JSONRPC: "2.0", Error: &standInError{Code: -32700, Message: "Parse error"}})
+		return
+	}
+
+	res := standInResponse{JSONRPC: "2.0", ID: req.ID}
+	result, err := s.handle(req.Method, req.Params)
+	if err != nil {
+		res.Error = err
+	} else {
+		res.Result = result
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *StandInFactomd) handle(method string, params json.RawMessage) (interface{}, *standInError) {
+	s.Lock()
+	defer s.Unlock()
+
+	invalid := &standInError{Code: -32602, Message: "Invalid params"}
+	switch method {
+	case "commit-entry":
+		var p struct {
+			Message string `json:"message"`
+		}
+		data, err := s.hexParam(params, &p, &p.Message)
+		// Version + timestamp + entryhash + ...
+		if err != nil || len(data) < 39 {
+			return nil, invalid
+		}
+		var hash factom.Bytes32
+		copy(hash[:], data[7:39])
+		s.commits[hash] = true
+		return map[string]string{"message": "Entry Commit Success", "entryhash": hash.String()}, nil
+	case "reveal-entry":
+		var p struct {
+			Entry string `json:"entry"`
+		}
+		data, err := s.hexParam(params, &p, &p.Entry)
+		if err != nil {
+			return nil, invalid
+		}
+		var e factom.Entry
+		if err := e.UnmarshalBinary(data); err != nil {
+			return nil, invalid
+		}
+		if !s.commits[*e.Hash] {
+			return nil, &standInError{Code: -32011, Message: "Repeated Commit"}
+		}
+		s.entries[*e.Hash] = data
+		return map[string]string{"message": "Entry Reveal Success", "entryhash": e.Hash.String(), "chainid": e.ChainID.String()}, nil
+	case "ack":
+		var p ackParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalid
+		}
+		var hash factom.Bytes32
+		if err := hash.Set(p.Hash); err != nil {
+			return nil, invalid
+		}
+
+		var res AckResult
+		res.EntryHash = p.Hash
+		res.EntryData.Status = StatusUnknown
+		if _, ok := s.entries[hash]; ok {
+			s.acks[hash]++
+			res.EntryData.Status = StatusTransactionACK
+			if s.acks[hash] >= s.ConfirmAfter {
+				res.EntryData.Status = StatusDBlockConfirmed
+			}
+		}
+		res.CommitData.Status = res.EntryData.Status
+		return res, nil
+	case "get-transaction-status":
+		var p txStatusParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalid
+		}
+		var hash factom.Bytes32
+		if err := hash.Set(p.EntryHash); err != nil {
+			return nil, invalid
+		}
+
+		// Pegnetd only knows of entries in a directory block
+		if _, ok := s.entries[hash]; !ok || s.acks[hash] < s.ConfirmAfter {
+			return nil, &standInError{Code: -32803, Message: "Transaction Not Found"}
+		}
+		status := TxStatus{Height: 1, Executed: 1}
+		if s.RejectBatches {
+			status.Executed = TxRejected
+		}
+		return status, nil
+	case "raw-data":
+		var p struct {
+			Hash factom.Bytes32 `json:"hash"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalid
+		}
+		data, ok := s.entries[p.Hash]
+		if !ok {
+			return nil, &standInError{Code: -32009, Message: "Missing Chain Head"}
+		}
+		return map[string]string{"data": hex.EncodeToString(data)}, nil
+	default:
+		return nil, &standInError{Code: -32601, Message: "Method not found"}
+	}
+}
+
+func (s *StandInFactomd) hexParam(params json.RawMessage, p interface{}, field *string) ([]byte, error) {
+	if err := json.Unmarshal(params, p); err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(*field)
+}
@@ -3,7 +3,6 @@ package pegnet
 import (
 	"github.com/jinzhu/gorm"
 
-	"github.com/Factom-Asset-Tokens/factom"
 	"github.com/FactomWyomingEntity/prosper-pool/config"
 	"github.com/FactomWyomingEntity/prosper-pool/database"
 	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
@@ -17,8 +16,10 @@ var (
 )
 
 type Node struct {
-	FactomClient *factom.Client
-	config       *viper.Viper
+	// Factomd is shared with the rest of the pool, so they follow the same
+	// node
+	Factomd *factomclient.Pool
+	config  *viper.Viper
 
 	db   *database.SqlDatabase
 	Sync *database.BlockSync
@@ -29,9 +30,9 @@ type Node struct {
 	justBooted bool
 }
 
-func NewPegnetNode(conf *viper.Viper, db *database.SqlDatabase) (*Node, error) {
+func NewPegnetNode(conf *viper.Viper, db *database.SqlDatabase, factomd *factomclient.Pool) (*Node, error) {
 	n := new(Node)
-	n.FactomClient = factomclient.FactomClientFromConfig(conf)
+	n.Factomd = factomd
 	n.config = conf
 	n.db = db
 
@@ -34,12 +34,13 @@ OuterSyncLoop:
 		// Fetch the current highest height
 		heights := new(factom.Heights)
 
-		// TODO: we might want to query against more than 1 factomd. If 1 node
-		// 	is synced higher than the other (such as following minutes better)
-		//	we will want to switch the client.
-		err := heights.Get(nil, n.FactomClient)
+		// The pool follows the factomd that is synced the highest, and
+		// fails over if it goes down.
+		err := n.Factomd.Do(func(cl *factom.Client) error {
+			return heights.Get(nil, cl)
+		})
 		if err != nil {
-			pegdLog.WithError(err).WithFields(log.Fields{"fhost": n.FactomClient.FactomdServer}).Errorf("failed to fetch heights")
+			pegdLog.WithError(err).WithFields(log.Fields{"fhost": n.Factomd.Client().FactomdServer}).Errorf("failed to fetch heights")
 			time.Sleep(retryPeriod)
 			continue // Loop will just keep retrying until factomd is reached
 		}
@@ -179,14 +180,20 @@ func (n *Node) SyncBlock(ctx context.Context, tx *gorm.DB, height uint32) (grade
 
 	dblock := new(factom.DBlock)
 	dblock.Height = height
-	if err := dblock.Get(nil, n.FactomClient); err != nil {
+	err := n.Factomd.Do(func(cl *factom.Client) error {
+		return dblock.Get(nil, cl)
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	// First, gather all entries we need from factomd
 	oprEBlock := dblock.EBlock(factom.Bytes32(config.OPRChain))
 	if oprEBlock != nil {
-		if err := multiFetch(oprEBlock, n.FactomClient); err != nil {
+		err := n.Factomd.Do(func(cl *factom.Client) error {
+			return multiFetch(oprEBlock, cl)
+		})
+		if err != nil {
 			return nil, err
 		}
 	}
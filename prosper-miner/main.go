@@ -32,6 +32,9 @@ const (
 	ConfigNumGoRountines = "miner.threads"
 	ConfigUserName       = "miner.username"
 	ConfigMinerName      = "miner.minerid"
+	ConfigTLS            = "pool.tls"
+	ConfigTLSCA          = "pool.tlsca"
+	ConfigTLSPin         = "pool.tlspin"
 )
 
 var rxEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
@@ -59,6 +62,13 @@ func init() {
 	rootCmd.Flags().StringP("poolhost", "s", "localhost:1234", "URL to connect to the pool")
 	rootCmd.Flags().IntP("miners", "t", runtime.NumCPU(), "Number of mining threads")
 
+	rootCmd.Flags().Bool("tls", false, "Connect to the pool's tls stratum port")
+	rootCmd.Flags().String("tlsca", "", "Verify the pool certificate against the CA certificates in this PEM file instead of the system CAs (implies --tls)")
+	rootCmd.Flags().String("tlspin", "", "Only accept a pool certificate with this sha256 fingerprint, self signed certificates are allowed (implies --tls)")
+
+	rootCmd.Flags().String("verifyopr", "off", "Verify the opr content of each job against the oprhash (off, warn, or refuse)")
+	rootCmd.Flags().String("poolcoinbase", "", "If set, the opr being mined must pay to this address")
+
 	rootCmd.AddCommand(properties)
 }
 
@@ -130,6 +140,31 @@ var rootCmd = &cobra.Command{
 			panic(err)
 		}
 
+		verifyMode, _ := cmd.Flags().GetString("verifyopr")
+		verification, err := stratum.ParseOPRVerification(verifyMode)
+		if err != nil {
+			log.WithError(err).Error("invalid --verifyopr")
+			return
+		}
+		poolCoinbase, _ := cmd.Flags().GetString("poolcoinbase")
+		if poolCoinbase != "" {
+			if err := factoidaddress.Valid(poolCoinbase); err != nil {
+				log.WithError(err).Errorf("%s is not a valid FA address", poolCoinbase)
+				return
+			}
+		}
+		client.SetOPRVerification(verification, poolCoinbase)
+
+		tlsCA, tlsPin := viper.GetString(ConfigTLSCA), viper.GetString(ConfigTLSPin)
+		if viper.GetBool(ConfigTLS) || tlsCA != "" || tlsPin != "" {
+			tlsConfig, err := stratum.NewClientTLSConfig(tlsCA, tlsPin)
+			if err != nil {
+				log.WithError(err).Error("invalid tls settings")
+				return
+			}
+			client.SetTLS(tlsConfig)
+		}
+
 		miners := viper.GetInt(ConfigNumGoRountines)
 		client.InitMiners(miners)
 		fake, _ := cmd.Flags().GetInt("fake")
@@ -265,6 +300,9 @@ func SetDefaults(cmd *cobra.Command) {
 	_ = viper.BindPFlag(ConfigNumGoRountines, cmd.Flags().Lookup("miners"))
 	_ = viper.BindPFlag(ConfigUserName, cmd.Flags().Lookup("user"))
 	_ = viper.BindPFlag(ConfigMinerName, cmd.Flags().Lookup("minerid"))
+	_ = viper.BindPFlag(ConfigTLS, cmd.Flags().Lookup("tls"))
+	_ = viper.BindPFlag(ConfigTLSCA, cmd.Flags().Lookup("tlsca"))
+	_ = viper.BindPFlag(ConfigTLSPin, cmd.Flags().Lookup("tlspin"))
 }
 
 // GenerateMinerID has to be random
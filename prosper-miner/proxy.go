@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/FactomWyomingEntity/prosper-pool/exit"
+	"github.com/FactomWyomingEntity/prosper-pool/stratum"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	proxy.Flags().StringP("user", "u", "", "Username to log into the mining pool")
+	proxy.Flags().StringP("minerid", "m", GenerateMinerID(), "Minerid of the proxy, the pool sees the whole farm as this one miner")
+	proxy.Flags().StringP("poolhost", "s", "localhost:1234", "URL to connect to the pool")
+	proxy.Flags().Int("listen", 1234, "Port the rigs connect to")
+
+	proxy.Flags().Bool("tls", false, "Connect to the pool's tls stratum port")
+	proxy.Flags().String("tlsca", "", "Verify the pool certificate against the CA certificates in this PEM file instead of the system CAs (implies --tls)")
+	proxy.Flags().String("tlspin", "", "Only accept a pool certificate with this sha256 fingerprint, self signed certificates are allowed (implies --tls)")
+
+	rootCmd.AddCommand(proxy)
+}
+
+var proxy = &cobra.Command{
+	Use:     "proxy",
+	Short:   "Relay the rigs of a farm to the pool over a single connection",
+	PreRunE: OpenConfig,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		exit.GlobalExitHandler.AddCancel(cancel)
+
+		username, minerid := viper.GetString(ConfigUserName), viper.GetString(ConfigMinerName)
+		if len(username) > 254 || !rxEmail.MatchString(username) {
+			log.Error("Username must be a valid email address")
+			return
+		}
+
+		client, err := stratum.NewClient(username, minerid, "", "", "", config.CompiledInVersion)
+		if err != nil {
+			panic(err)
+		}
+
+		tlsCA, tlsPin := viper.GetString(ConfigTLSCA), viper.GetString(ConfigTLSPin)
+		if viper.GetBool(ConfigTLS) || tlsCA != "" || tlsPin != "" {
+			tlsConfig, err := stratum.NewClientTLSConfig(tlsCA, tlsPin)
+			if err != nil {
+				log.WithError(err).Error("invalid tls settings")
+				return
+			}
+			client.SetTLS(tlsConfig)
+		}
+
+		// The rigs are trusted, the pool checks the work it is sent
+		listen, _ := cmd.Flags().GetInt("listen")
+		conf := viper.New()
+		config.SetDefaults(conf)
+		conf.Set(config.ConfigStratumPort, listen)
+		conf.Set(config.ConfigStratumCheckAllWork, false)
+		conf.Set(config.ConfigStratumRequireAuth, false)
+		conf.Set(config.ConfigStratumMaxConnsPerIP, 0)
+		conf.Set(config.ConfigStratumBanThreshold, 0)
+		conf.Set(config.ConfigStratumWelcomeMessage, fmt.Sprintf("Connected to the prosper-miner proxy for %s", username))
+
+		p, err := stratum.NewProxy(conf, client)
+		if err != nil {
+			log.WithError(err).Error("failed to create the proxy")
+			return
+		}
+
+		exit.GlobalExitHandler.AddExit(func() error {
+			return client.Close()
+		})
+
+		if err := client.Connect(viper.GetString(ConfigHost)); err != nil {
+			panic(err)
+		}
+		_ = client.Handshake()
+
+		log.Infof("Initiated Prosper Proxy")
+		log.Infof("Username: %s, MinerID: %s, rigs connect on port %d", username, minerid, listen)
+
+		go p.Server.Listen(ctx)
+		go p.Run(ctx)
+
+		go func() {
+			keyboardReader := bufio.NewReader(os.Stdin)
+			for {
+				userCommand, _ := keyboardReader.ReadString('\n')
+				words := strings.Fields(userCommand)
+				if len(words) > 0 {
+					switch words[0] {
+					case "rigs":
+						for _, miner := range p.Server.MinersSnapShot() {
+							fmt.Printf("%s,%s %s accepted %d, rejected %v\n", miner.Username, miner.Minerid, miner.IP, miner.Accepted, miner.Rejections)
+						}
+					case "relayed":
+						for _, rig := range p.Rigs() {
+							fmt.Printf("%s relayed %d, pool accepted %d, rejected %v, last share %s\n", rig.Rig, rig.Relayed, rig.Accepted, rig.Rejected, rig.LastShare.Format("15:04:05"))
+						}
+					default:
+						fmt.Println("Proxy command not supported: ", words[0])
+					}
+				}
+			}
+		}()
+
+		client.Listen(ctx)
+	},
+}
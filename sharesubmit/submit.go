@@ -3,15 +3,15 @@ package sharesubmit
 import (
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math/big"
+	"sync/atomic"
 
 	"github.com/FactomWyomingEntity/prosper-pool/database"
 
 	"github.com/FactomWyomingEntity/prosper-pool/factomclient"
 
-	"github.com/pegnet/pegnet/modules/opr"
-
 	"github.com/Factom-Asset-Tokens/factom"
 
 	"github.com/FactomWyomingEntity/prosper-pool/config"
@@ -36,22 +36,27 @@ const (
 // or too low, it will not submit. If we are submitting too many, then it
 // will switch from rolling submissions to minute 9 submissions
 type Submitter struct {
+	// emaTarget is the current ema, for stratum to read. It is first so it
+	// is aligned for atomic access.
+	emaTarget uint64
+
 	db *gorm.DB
 
 	// shares channel is made elsewhere
 	shares <-chan *stratum.ShareSubmission
 	blocks chan SubmissionJob
 
-	FactomClient *factom.Client
+	Factomd *factomclient.Pool
 
-	currentJob *stratum.Job
+	// jobs are mid-block sub-jobs of the current height
+	jobs chan *stratum.Job
 
-	// V3s should be deprecated once v4 is live
-	oprCopyData []byte
-	oprCopy     opr.V2Content // Our safe copy
+	currentJob *stratum.Job
 
-	oprCopyDataV4 []byte
-	oprCopyV4     opr.V4Content // Our safe copy
+	// oprCopies are our safe copies of every sub-job of the current job,
+	// by oprhash. Sub-jobs can arrive before their block, so copies of
+	// newer jobs are kept too.
+	oprCopies map[string]oprCopy
 
 	// jobState is state a job can use in it's decision process
 	jobState struct {
@@ -69,6 +74,14 @@ type Submitter struct {
 	}
 }
 
+// oprCopy is the marshalled content of a job's opr
+type oprCopy struct {
+	jobID int32
+	// V3s should be deprecated once v4 is live
+	data   []byte
+	dataV4 []byte
+}
+
 // SubmissionJob contains all the info a submitter will need.
 // It needs the details for the last block submitted to maintain a
 // min target. It needs the job information to submit the incoming shares
@@ -77,9 +90,11 @@ type SubmissionJob struct {
 	Job   *stratum.Job
 }
 
-func NewSubmitter(conf *viper.Viper, db *gorm.DB) (*Submitter, error) {
+func NewSubmitter(conf *viper.Viper, db *gorm.DB, factomd *factomclient.Pool) (*Submitter, error) {
 	s := new(Submitter)
 	s.blocks = make(chan SubmissionJob, 10)
+	s.jobs = make(chan *stratum.Job, 10)
+	s.oprCopies = make(map[string]oprCopy)
 	s.db = db
 	s.db.AutoMigrate(&EMA{})
 	s.db.AutoMigrate(&EntrySubmission{})
@@ -89,8 +104,9 @@ func NewSubmitter(conf *viper.Viper, db *gorm.DB) (*Submitter, error) {
 	if dbErr.Error != nil && dbErr.Error != gorm.ErrRecordNotFound {
 		return nil, dbErr.Error
 	}
+	atomic.StoreUint64(&s.emaTarget, s.currentEMA.EMAValue)
 
-	s.FactomClient = factomclient.FactomClientFromConfig(conf)
+	s.Factomd = factomd
 
 	s.configuration.Cutoff = conf.GetInt(config.ConfigSubmitterCutoff)
 	s.configuration.EMANumPoints = conf.GetInt(config.ConfigSubmitterEMAN)
@@ -122,6 +138,33 @@ func (s Submitter) GetBlocksChannel() chan<- SubmissionJob {
 	return s.blocks
 }
 
+// GetJobsChannel takes mid-block sub-jobs. Shares for a sub-job are
+// submitted with the sub-job's opr.
+func (s Submitter) GetJobsChannel() chan<- *stratum.Job {
+	return s.jobs
+}
+
+// SubmitTarget is the ema target. Shares above it are submitted to factomd.
+func (s *Submitter) SubmitTarget() uint64 {
+	return atomic.LoadUint64(&s.emaTarget)
+}
+
+// addJobCopy keeps a copy of the job's opr to submit its shares with
+func (s *Submitter) addJobCopy(job *stratum.Job) {
+	c := oprCopy{jobID: job.JobID}
+	var err error
+	c.data, err = job.OPR.Marshal()
+	if err != nil {
+		sLog.WithError(err).WithField("job", job.JobIDString()).Errorf("failed to marshal opr")
+	}
+
+	c.dataV4, err = job.OPRv4.Marshal()
+	if err != nil {
+		sLog.WithError(err).WithField("job", job.JobIDString()).Errorf("failed to marshal oprv4")
+	}
+	s.oprCopies[job.OPRHash] = c
+}
+
 // softMax enforces the softmax limit on shares. If the softMax() returns true
 // the share is accepted. If it returns false, the share is rejected.
 // If the limit is set to <= 0, the softMax limit is not applied.
@@ -174,17 +217,12 @@ func (s *Submitter) Run(ctx context.Context) {
 				cutoffMinimumIndex.Set(200)
 				emaDifficulty.Set(float64(ema.EMAValue))
 				s.currentJob = block.Job
-				s.oprCopy = block.Job.OPR
-				s.oprCopyData, err = s.oprCopy.Marshal()
-				if err != nil {
-					sLog.WithError(err).WithField("height", block.Block.Height).Errorf("failed to marshal opr")
-				}
-
-				s.oprCopyV4 = block.Job.OPRv4
-				s.oprCopyDataV4, err = s.oprCopyV4.Marshal()
-				if err != nil {
-					sLog.WithError(err).WithField("height", block.Block.Height).Errorf("failed to marshal oprv4")
+				for hash, c := range s.oprCopies {
+					if c.jobID < block.Job.JobID {
+						delete(s.oprCopies, hash)
+					}
 				}
+				s.addJobCopy(block.Job)
 
 				sLog.WithFields(log.Fields{
 					"job": block.Job.JobID,
@@ -192,10 +230,28 @@ func (s *Submitter) Run(ctx context.Context) {
 				}).Infof("ema share submit set")
 			}
 			s.currentEMA = ema
+			atomic.StoreUint64(&s.emaTarget, ema.EMAValue)
+		case job := <-s.jobs:
+			if s.currentJob != nil && job.JobID < s.currentJob.JobID {
+				continue // Sub-job of an old height
+			}
+			s.addJobCopy(job)
 		case share := <-s.shares:
-			if share.JobID != s.currentJob.JobID {
+			if share.Forfeit != nil {
+				continue // Takes back credit, there is no share
+			}
+			if share.Stale {
+				// Credited in the grace window, but the block it was for
+				// is already done. It would only waste entry credits.
+				continue
+			}
+			if s.currentJob == nil || share.JobID != s.currentJob.JobID {
 				continue // Invalid share
 			}
+			jobCopy, ok := s.oprCopies[hex.EncodeToString(share.OPRHash)]
+			if !ok || jobCopy.jobID != share.JobID {
+				continue // Not a sub-job of the current job
+			}
 
 			// If the target is above the ema target
 			if share.Target > s.currentEMA.EMAValue {
@@ -219,9 +275,9 @@ func (s *Submitter) Run(ctx context.Context) {
 				binary.BigEndian.PutUint64(buf, share.Target)
 				oChain := factom.Bytes32(config.OPRChain)
 				v := config.OPRVersion(uint32(share.JobID))
-				content := s.oprCopyData
+				content := jobCopy.data
 				if v == 4 {
-					content = s.oprCopyDataV4
+					content = jobCopy.dataV4
 				}
 				entry := factom.Entry{
 					ChainID: &oChain,
@@ -236,7 +292,13 @@ func (s *Submitter) Run(ctx context.Context) {
 					Content: content,
 				}
 
-				txid, err := entry.ComposeCreate(nil, s.FactomClient, s.configuration.ESAddress)
+				// A commit that failed may still have been accepted, so
+				// it is never resent to another node
+				var txid factom.Bytes32
+				err := s.Factomd.Send(func(cl *factom.Client) (err error) {
+					txid, err = entry.ComposeCreate(nil, cl, s.configuration.ESAddress)
+					return err
+				})
 				if err != nil {
 					sLog.WithError(err).WithField("job", share.JobID).Errorf("failed to submit opr")
 				} else {
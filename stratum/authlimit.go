@@ -0,0 +1,121 @@
+package stratum
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthLimiter locks out repeated failed authorizations, so passwords and
+// invite codes cannot be guessed over stratum. Failures are tracked for the
+// ip and username, so one ip cannot lock a user out for everyone, and for the
+// ip alone, so an ip cannot spray usernames or invite codes.
+type AuthLimiter struct {
+	// MaxFailures is the number of failures for a user from an ip before a
+	// lockout
+	MaxFailures int
+	// MaxIPFailures is the number of failures from an ip, for any user,
+	// before the ip is locked out
+	MaxIPFailures int
+	// Lockout is how long a lockout lasts. Failures older than this are
+	// forgotten.
+	Lockout time.Duration
+
+	sync.Mutex
+	failures map[string]*authFailures
+}
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func NewAuthLimiter(maxFailures, maxIPFailures int, lockout time.Duration) *AuthLimiter {
+	l := new(AuthLimiter)
+	l.MaxFailures = maxFailures
+	l.MaxIPFailures = maxIPFailures
+	l.Lockout = lockout
+	l.failures = make(map[string]*authFailures)
+	return l
+}
+
+// authLimitKeys are the keys failures are tracked by, the remote ip and the
+// username, and the remote ip alone
+func authLimitKeys(addr net.Addr, username string) (user string, ip string) {
+	ip = remoteHost(addr)
+	return ip + "/" + username, ip
+}
+
+// Locked returns true if the user is currently locked out from the address,
+// or the address is locked out
+func (l *AuthLimiter) Locked(addr net.Addr, username string, now time.Time) bool {
+	user, ip := authLimitKeys(addr, username)
+
+	l.Lock()
+	defer l.Unlock()
+	return (l.MaxFailures > 0 && l.locked(user, now)) || (l.MaxIPFailures > 0 && l.locked(ip, now))
+}
+
+// Fail records a failure for the user from the address, and returns true if
+// either is now locked out. Registration failures have no user to count
+// against, so they are only counted against the address.
+func (l *AuthLimiter) Fail(addr net.Addr, username string, register bool, now time.Time) bool {
+	user, ip := authLimitKeys(addr, username)
+
+	l.Lock()
+	defer l.Unlock()
+	l.prune(now)
+
+	var locked bool
+	if l.MaxFailures > 0 && !register {
+		locked = l.fail(user, l.MaxFailures, now)
+	}
+	if l.MaxIPFailures > 0 && l.fail(ip, l.MaxIPFailures, now) {
+		locked = true
+	}
+	return locked
+}
+
+// Success clears any failures for the user from the address. The failures
+// of the address are kept, so a good login cannot reset a spray.
+func (l *AuthLimiter) Success(addr net.Addr, username string) {
+	user, _ := authLimitKeys(addr, username)
+
+	l.Lock()
+	defer l.Unlock()
+	delete(l.failures, user)
+}
+
+// locked returns if the key is locked out. Must hold the lock.
+func (l *AuthLimiter) locked(key string, now time.Time) bool {
+	f, ok := l.failures[key]
+	return ok && now.Before(f.lockedUntil)
+}
+
+// fail counts a failure for the key, and returns true if it is now locked
+// out. Must hold the lock.
+func (l *AuthLimiter) fail(key string, max int, now time.Time) bool {
+	f, ok := l.failures[key]
+	if !ok {
+		f = new(authFailures)
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= max {
+		f.lockedUntil = now.Add(l.Lockout)
+		f.count = 0
+		return true
+	}
+	return false
+}
+
+// prune drops any failures that are no longer relevant. Must hold the lock.
+func (l *AuthLimiter) prune(now time.Time) {
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.Lockout && now.After(f.lockedUntil) {
+			delete(l.failures, key)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package stratum
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Offense is misbehaviour by a miner. Every offense adds its score to the
+// miner's ip and username, and once a score passes the threshold, that ip or
+// username is banned.
+type Offense int
+
+const (
+	// OffenseMalformed is a message or share that could not be parsed
+	OffenseMalformed Offense = iota
+	// OffenseInvalidWork is a share that does not hash to its target
+	OffenseInvalidWork
+	// OffenseFlood is a message over the per connection rate limit
+	OffenseFlood
+)
+
+// Score is how much the offense counts towards a ban
+func (o Offense) Score() int {
+	switch o {
+	case OffenseMalformed:
+		return 10
+	case OffenseInvalidWork:
+		return 25
+	case OffenseFlood:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (o Offense) String() string {
+	switch o {
+	case OffenseMalformed:
+		return "malformed"
+	case OffenseInvalidWork:
+		return "invalid work"
+	case OffenseFlood:
+		return "flooding"
+	default:
+		return "unknown"
+	}
+}
+
+// Ban subjects are an ip or a username, with a prefix so they cannot collide
+const (
+	banIPPrefix   = "ip:"
+	banUserPrefix = "user:"
+)
+
+// IPSubject is the ban subject of an ip
+func IPSubject(host string) string { return banIPPrefix + host }
+
+// UserSubject is the ban subject of a username
+func UserSubject(username string) string { return banUserPrefix + username }
+
+// ParseBanSubject accepts a subject with its 'ip:' or 'user:' prefix
+func ParseBanSubject(subject string) (string, error) {
+	if (strings.HasPrefix(subject, banIPPrefix) && len(subject) > len(banIPPrefix)) ||
+		(strings.HasPrefix(subject, banUserPrefix) && len(subject) > len(banUserPrefix)) {
+		return subject, nil
+	}
+	return "", fmt.Errorf("ban subject must be 'ip:<address>' or 'user:<username>'")
+}
+
+// Ban is a banned ip or username. Expired bans are kept, so repeat offenders
+// are banned for longer.
+type Ban struct {
+	Subject string    `gorm:"primary_key"`
+	Until   time.Time `gorm:"column:banned_until;index"`
+	Reason  string
+	// Strikes is the number of times the subject was banned by the pool.
+	// Every strike doubles the ban duration.
+	Strikes int
+	// Manual bans were set by an admin
+	Manual    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (Ban) TableName() string { return "stratum_bans" }
+
+// Active returns if the ban is still in effect
+func (b Ban) Active(now time.Time) bool {
+	return now.Before(b.Until)
+}
+
+// BanManager scores misbehaviour per ip and per username, caps the
+// concurrent connections per ip, and bans offenders. Every ban for a repeat
+// offender lasts twice as long, up to the max duration. If a database is
+// set, bans are persisted across restarts.
+type BanManager struct {
+	// MaxConnsPerIP is the number of concurrent connections an ip can have.
+	// 0 is unlimited.
+	MaxConnsPerIP int
+	// MaxMessagesPerSecond is the number of messages a connection can send
+	// each second before every message is an offense. 0 is unlimited.
+	MaxMessagesPerSecond int
+	// Threshold is the score that bans. 0 disables automatic bans.
+	Threshold int
+	// ScoreWindow is how long a score is kept after the last offense
+	ScoreWindow time.Duration
+	// Duration is the first ban duration, and MaxDuration the longest
+	Duration    time.Duration
+	MaxDuration time.Duration
+
+	db *gorm.DB
+
+	sync.Mutex
+	scores map[string]*banScore
+	bans   map[string]*Ban
+	conns  map[string]int
+}
+
+type banScore struct {
+	score int
+	last  time.Time
+}
+
+// NewBanManager loads the bans from the db. The db can be nil, in which case
+// bans only last until a restart.
+func NewBanManager(conf *viper.Viper, db *gorm.DB) (*BanManager, error) {
+	b := new(BanManager)
+	b.MaxConnsPerIP = conf.GetInt(config.ConfigStratumMaxConnsPerIP)
+	b.MaxMessagesPerSecond = conf.GetInt(config.ConfigStratumMaxMsgPerSecond)
+	b.Threshold = conf.GetInt(config.ConfigStratumBanThreshold)
+	b.ScoreWindow = conf.GetDuration(config.ConfigStratumBanScoreWindow)
+	b.Duration = conf.GetDuration(config.ConfigStratumBanDuration)
+	b.MaxDuration = conf.GetDuration(config.ConfigStratumBanMaxDuration)
+	if b.MaxDuration < b.Duration {
+		b.MaxDuration = b.Duration
+	}
+
+	b.scores = make(map[string]*banScore)
+	b.bans = make(map[string]*Ban)
+	b.conns = make(map[string]int)
+
+	if db != nil {
+		b.db = db
+		if err := db.AutoMigrate(&Ban{}).Error; err != nil {
+			return nil, err
+		}
+
+		var bans []Ban
+		if err := db.Find(&bans).Error; err != nil {
+			return nil, fmt.Errorf("failed to load bans: %s", err.Error())
+		}
+		for i := range bans {
+			b.bans[bans[i].Subject] = &bans[i]
+		}
+	}
+	return b, nil
+}
+
+// Admit counts a new connection from the host, and returns an error if the
+// host is banned or has too many connections. Every admitted connection must
+// be released.
+func (b *BanManager) Admit(host string, now time.Time) error {
+	b.Lock()
+	defer b.Unlock()
+	if ban := b.active(IPSubject(host), now); ban != nil {
+		connectionsRefused.WithLabelValues("banned").Inc()
+		return fmt.Errorf("banned until %s", ban.Until.Format(time.RFC3339))
+	}
+	if b.MaxConnsPerIP > 0 && b.conns[host] >= b.MaxConnsPerIP {
+		connectionsRefused.WithLabelValues("limit").Inc()
+		return fmt.Errorf("too many connections from %s", host)
+	}
+	b.conns[host]++
+	return nil
+}
+
+// Release frees an admitted connection
+func (b *BanManager) Release(host string) {
+	b.Lock()
+	defer b.Unlock()
+	b.conns[host]--
+	if b.conns[host] <= 0 {
+		delete(b.conns, host)
+	}
+}
+
+// Banned returns the active ban on the host or username, if there is one. An
+// empty username only checks the host.
+func (b *BanManager) Banned(host, username string, now time.Time) *Ban {
+	b.Lock()
+	defer b.Unlock()
+	ban := b.active(IPSubject(host), now)
+	if ban == nil && username != "" {
+		ban = b.active(UserSubject(username), now)
+	}
+	if ban == nil {
+		return nil
+	}
+	banned := *ban
+	return &banned
+}
+
+// Punish scores the offense against the host and username, and returns the
+// ban if either is now banned.
+func (b *BanManager) Punish(host, username string, o Offense, now time.Time) *Ban {
+	if b.Threshold <= 0 {
+		return nil
+	}
+
+	subjects := []string{IPSubject(host)}
+	if username != "" {
+		subjects = append(subjects, UserSubject(username))
+	}
+
+	var banned []Ban
+	b.Lock()
+	for _, subject := range subjects {
+		score, ok := b.scores[subject]
+		if !ok || now.Sub(score.last) > b.ScoreWindow {
+			score = new(banScore)
+			b.scores[subject] = score
+		}
+		score.score += o.Score()
+		score.last = now
+		if score.score >= b.Threshold {
+			delete(b.scores, subject)
+			banned = append(banned, *b.escalate(subject, o, now))
+		}
+	}
+	b.prune(now)
+	b.Unlock()
+
+	for _, ban := range banned {
+		bansIssued.Inc()
+		log.WithFields(log.Fields{"subject": ban.Subject, "until": ban.Until, "strikes": ban.Strikes}).Warnf("banned for %s", o)
+		_ = b.save(ban)
+	}
+	if len(banned) == 0 {
+		return nil
+	}
+	return &banned[0]
+}
+
+// escalate bans the subject for twice as long as its last ban. Strikes are
+// forgiven once the last ban is older than the max duration. Must hold the
+// lock.
+func (b *BanManager) escalate(subject string, o Offense, now time.Time) *Ban {
+	ban, ok := b.bans[subject]
+	if !ok {
+		ban = &Ban{Subject: subject}
+		b.bans[subject] = ban
+	}
+	if now.Sub(ban.Until) > b.MaxDuration {
+		ban.Strikes = 0
+	}
+	ban.Strikes++
+
+	duration := b.Duration
+	for i := 1; i < ban.Strikes && duration < b.MaxDuration; i++ {
+		duration *= 2
+	}
+	if duration > b.MaxDuration {
+		duration = b.MaxDuration
+	}
+	ban.Until = now.Add(duration)
+	ban.Reason = o.String()
+	ban.Manual = false
+	return ban
+}
+
+// Ban bans the subject for the duration, set by an admin
+func (b *BanManager) Ban(subject string, duration time.Duration, reason string, now time.Time) (*Ban, error) {
+	subject, err := ParseBanSubject(subject)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("ban duration must be positive")
+	}
+
+	b.Lock()
+	ban, ok := b.bans[subject]
+	if !ok {
+		ban = &Ban{Subject: subject}
+		b.bans[subject] = ban
+	}
+	ban.Until = now.Add(duration)
+	ban.Reason = reason
+	ban.Manual = true
+	saved := *ban
+	b.Unlock()
+
+	bansIssued.Inc()
+	return &saved, b.save(saved)
+}
+
+// Unban lifts the ban on the subject, and forgets its strikes
+func (b *BanManager) Unban(subject string) error {
+	subject, err := ParseBanSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	_, ok := b.bans[subject]
+	delete(b.bans, subject)
+	delete(b.scores, subject)
+	b.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not banned", subject)
+	}
+
+	if b.db != nil {
+		return b.db.Delete(&Ban{Subject: subject}).Error
+	}
+	return nil
+}
+
+// Bans returns the active bans
+func (b *BanManager) Bans(now time.Time) []Ban {
+	b.Lock()
+	defer b.Unlock()
+	var bans []Ban
+	for _, ban := range b.bans {
+		if ban.Active(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	return bans
+}
+
+// Connections is the number of admitted connections from the host
+func (b *BanManager) Connections(host string) int {
+	b.Lock()
+	defer b.Unlock()
+	return b.conns[host]
+}
+
+// active returns the subject's ban if it is in effect. Must hold the lock.
+func (b *BanManager) active(subject string, now time.Time) *Ban {
+	if ban, ok := b.bans[subject]; ok && ban.Active(now) {
+		return ban
+	}
+	return nil
+}
+
+// prune drops scores that are no longer relevant. Must hold the lock.
+func (b *BanManager) prune(now time.Time) {
+	for subject, score := range b.scores {
+		if now.Sub(score.last) > b.ScoreWindow {
+			delete(b.scores, subject)
+		}
+	}
+}
+
+func (b *BanManager) save(ban Ban) error {
+	if b.db == nil {
+		return nil
+	}
+	err := b.db.Save(&ban).Error
+	if err != nil {
+		log.WithError(err).WithField("subject", ban.Subject).Error("failed to save ban")
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package stratum_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func banConfig() *viper.Viper {
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumMaxConnsPerIP, 2)
+	conf.Set(config.ConfigStratumBanThreshold, 50)
+	conf.Set(config.ConfigStratumBanDuration, time.Minute)
+	conf.Set(config.ConfigStratumBanMaxDuration, time.Minute*3)
+	return conf
+}
+
+func TestBanManager_Escalate(t *testing.T) {
+	require := require.New(t)
+	b, err := NewBanManager(banConfig(), nil)
+	require.NoError(err)
+
+	now := time.Now()
+	require.Nil(b.Punish("1.2.3.4", "", OffenseInvalidWork, now))
+	ban := b.Punish("1.2.3.4", "", OffenseInvalidWork, now)
+	require.NotNil(ban)
+	require.Equal(IPSubject("1.2.3.4"), ban.Subject)
+	require.Equal(now.Add(time.Minute), ban.Until)
+	require.NotNil(b.Banned("1.2.3.4", "", now))
+	require.Error(b.Admit("1.2.3.4", now))
+	require.Nil(b.Banned("1.2.3.4", "", ban.Until))
+
+	// Repeat offenses double the ban, up to the max
+	for _, expected := range []time.Duration{time.Minute * 2, time.Minute * 3, time.Minute * 3} {
+		now = ban.Until
+		b.Punish("1.2.3.4", "", OffenseInvalidWork, now)
+		ban = b.Punish("1.2.3.4", "", OffenseInvalidWork, now)
+		require.NotNil(ban)
+		require.Equal(now.Add(expected), ban.Until)
+	}
+
+	// Strikes are forgiven after a while
+	now = ban.Until.Add(time.Hour)
+	b.Punish("1.2.3.4", "", OffenseInvalidWork, now)
+	ban = b.Punish("1.2.3.4", "", OffenseInvalidWork, now)
+	require.Equal(1, ban.Strikes)
+	require.Equal(now.Add(time.Minute), ban.Until)
+}
+
+func TestBanManager_Username(t *testing.T) {
+	require := require.New(t)
+	b, err := NewBanManager(banConfig(), nil)
+	require.NoError(err)
+
+	now := time.Now()
+	// Scores expire after the window
+	for i := 0; i < 4; i++ {
+		require.Nil(b.Punish("1.1.1.1", "user", OffenseMalformed, now))
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		require.Nil(b.Punish("2.2.2.2", "user", OffenseMalformed, now))
+	}
+	require.NotNil(b.Punish("3.3.3.3", "user", OffenseMalformed, now))
+
+	// The user is banned from any ip, but the ip is not
+	require.NotNil(b.Banned("4.4.4.4", "user", now))
+	require.Nil(b.Banned("3.3.3.3", "", now))
+	require.NoError(b.Admit("3.3.3.3", now))
+
+	require.NoError(b.Unban(UserSubject("user")))
+	require.Nil(b.Banned("4.4.4.4", "user", now))
+	require.Error(b.Unban(UserSubject("user")))
+	require.Error(b.Unban("user"))
+}
+
+func TestBanManager_ConnLimit(t *testing.T) {
+	require := require.New(t)
+	b, err := NewBanManager(banConfig(), nil)
+	require.NoError(err)
+
+	now := time.Now()
+	require.NoError(b.Admit("1.2.3.4", now))
+	require.NoError(b.Admit("1.2.3.4", now))
+	require.Error(b.Admit("1.2.3.4", now))
+	require.NoError(b.Admit("5.6.7.8", now))
+	require.Equal(2, b.Connections("1.2.3.4"))
+
+	b.Release("1.2.3.4")
+	require.NoError(b.Admit("1.2.3.4", now))
+}
+
+func TestBanManager_Persist(t *testing.T) {
+	require := require.New(t)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+
+	b, err := NewBanManager(banConfig(), db)
+	require.NoError(err)
+
+	now := time.Now()
+	_, err = b.Ban("ip:1.2.3.4", time.Hour, "manual", now)
+	require.NoError(err)
+	_, err = b.Ban("user:someone", time.Hour, "manual", now)
+	require.NoError(err)
+	_, err = b.Ban("someone", time.Hour, "manual", now)
+	require.Error(err)
+	require.NoError(b.Unban("user:someone"))
+
+	reloaded, err := NewBanManager(banConfig(), db)
+	require.NoError(err)
+	bans := reloaded.Bans(now)
+	require.Len(bans, 1)
+	require.Equal("ip:1.2.3.4", bans[0].Subject)
+	require.Equal("manual", bans[0].Reason)
+	require.True(bans[0].Manual)
+	require.NotNil(reloaded.Banned("1.2.3.4", "", now))
+	require.Nil(reloaded.Banned("1.1.1.1", "someone", now))
+}
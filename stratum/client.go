@@ -3,6 +3,8 @@ package stratum
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -14,7 +16,9 @@ import (
 	"time"
 
 	"github.com/FactomWyomingEntity/prosper-pool/mining"
+	"github.com/pegnet/pegnet/modules/opr"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 var _ = log.Println
@@ -39,11 +43,35 @@ type Client struct {
 
 	miners         []*ControlledMiner
 	successes      chan *mining.Winner
-	totalSuccesses uint64 // Total submitted shares
+	totalSuccesses uint64            // Total submitted shares
+	rejections     map[string]uint64 // Rejected shares by reason
+
+	// OPR verification checks the pool is mining the record it claims
+	oprVerification OPRVerification
+	poolCoinbase    string
+
+	// tlsConfig is set if the pool connection is over tls
+	tlsConfig *tls.Config
+
+	// relay passes the pool's jobs, targets and nonces on, if the client
+	// is the upstream of a proxy
+	relay Relay
 
 	subscriptions []Subscription
+	// sessionID is sent on reconnect to resume the session
+	sessionID     string
 	requestsMade  map[int32]func(Response)
-	autoreconnect bool
+	autoreconnect atomic.Bool
+	// connLock guards swapping the conn on reconnect against a Close from
+	// another goroutine. Close can be called with the client locked.
+	connLock sync.Mutex
+
+	// address is the server the client last connected to. A pool that
+	// sends client.reconnect sets the redirect, which the client connects
+	// to after redirectWait seconds instead of reconnecting to the address.
+	address      string
+	redirect     string
+	redirectWait string
 	sync.RWMutex
 }
 
@@ -61,9 +89,34 @@ func (c *ControlledMiner) SendCommand(command *mining.MinerCommand) bool {
 	}
 }
 
+// OPRVerification is how the client treats the oprs the pool sends to mine
+type OPRVerification int
+
+const (
+	// VerifyOff trusts the pool's oprhash
+	VerifyOff OPRVerification = iota
+	// VerifyWarn will fetch the opr for each job, and log if it is wrong
+	VerifyWarn
+	// VerifyRefuse will not mine a job until the opr is verified
+	VerifyRefuse
+)
+
+// ParseOPRVerification parses the 'off', 'warn', or 'refuse' modes
+func ParseOPRVerification(mode string) (OPRVerification, error) {
+	switch strings.ToLower(mode) {
+	case "", "off":
+		return VerifyOff, nil
+	case "warn":
+		return VerifyWarn, nil
+	case "refuse":
+		return VerifyRefuse, nil
+	}
+	return VerifyOff, fmt.Errorf("unknown opr verification mode '%s'", mode)
+}
+
 func NewClient(username, minername, password, invitecode, payoutaddress, version string) (*Client, error) {
 	c := new(Client)
-	c.autoreconnect = true
+	c.autoreconnect.Store(true)
 	c.version = version
 	c.username = username
 	c.minername = minername
@@ -74,6 +127,7 @@ func NewClient(username, minername, password, invitecode, payoutaddress, version
 	c.currentOPRHash = "00037f39cf870a1f49129f9c82d935665d352ffd25ea3296208f6f7b16fd654f"
 	c.currentTarget = 0xfffe000000000000
 	c.requestsMade = make(map[int32]func(Response))
+	c.rejections = make(map[string]uint64)
 
 	successChannel := make(chan *mining.Winner, 100)
 	c.successes = successChannel
@@ -85,6 +139,31 @@ func NewClient(username, minername, password, invitecode, payoutaddress, version
 	return c, nil
 }
 
+// SetOPRVerification will check every job's opr content against the oprhash.
+// If the coinbase is not empty, the opr must also pay to that address.
+func (c *Client) SetOPRVerification(mode OPRVerification, coinbase string) {
+	c.Lock()
+	defer c.Unlock()
+	c.oprVerification = mode
+	c.poolCoinbase = coinbase
+}
+
+// SetTLS will connect to the pool over tls with the given config. Reconnects
+// also use tls. A nil config connects without tls.
+func (c *Client) SetTLS(cfg *tls.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.tlsConfig = cfg
+}
+
+// SetRelay passes the pool's jobs, targets and nonces to the relay. It must
+// be set before connecting.
+func (c *Client) SetRelay(r Relay) {
+	c.Lock()
+	defer c.Unlock()
+	c.relay = r
+}
+
 func (c *Client) InitMiners(num int) {
 	c.miners = make([]*ControlledMiner, num)
 	for i := range c.miners {
@@ -134,6 +213,20 @@ func (c *Client) Encode(x interface{}) (err error) {
 }
 
 func (c *Client) Connect(address string) error {
+	c.Lock()
+	tlsConfig := c.tlsConfig
+	c.address = address
+	c.Unlock()
+	if tlsConfig != nil {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 3 * time.Minute}
+		conn, err := tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+		if err != nil {
+			return err
+		}
+		c.InitConn(conn)
+		return nil
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return err
@@ -157,13 +250,15 @@ func (c *Client) Handshake() error {
 func (c *Client) InitConn(conn net.Conn) {
 	c.Lock()
 	defer c.Unlock()
+	c.connLock.Lock()
 	c.conn = conn
+	c.connLock.Unlock()
 	c.enc = json.NewEncoder(conn)
 	c.dec = bufio.NewReader(conn)
 }
 
 func (c *Client) BlockTillConnected(address, waittime string) error {
-	for c.autoreconnect {
+	for c.autoreconnect.Load() {
 		if err := c.WaitThenConnect(address, waittime); err == nil {
 			return nil
 		} else {
@@ -196,13 +291,16 @@ func (c *Client) Authorize(username, password, invitecode, payoutaddress string)
 	c.Lock()
 	c.requestsMade[req.ID] = func(resp Response) {
 		var result bool
-		if err := resp.FitResult(&result); err == nil {
-			if result == false {
-				log.Errorf("AuthorizeResponse is false. Rather than contributing uncredited mining, shutting down client.")
-				c.Close()
-			} else {
-				log.Infof("AuthorizeResponse result: %t\n", result)
-			}
+		if resp.Error != nil {
+			log.Errorf("Authorize rejected: %v", resp.Error.Data)
+		} else if err := resp.FitResult(&result); err != nil {
+			return
+		}
+		if result == false {
+			log.Errorf("AuthorizeResponse is false. Rather than contributing uncredited mining, shutting down client.")
+			c.Close()
+		} else {
+			log.Infof("AuthorizeResponse result: %t\n", result)
 		}
 	}
 	c.Unlock()
@@ -219,6 +317,10 @@ func (c *Client) GetOPRHash(jobID string) error {
 	req := GetOPRHashRequest(jobID)
 	c.Lock()
 	c.requestsMade[req.ID] = func(resp Response) {
+		if resp.Error != nil {
+			log.WithField("job", jobID).Errorf("OPRHash request failed: %s", resp.Error.Message)
+			return
+		}
 		var result string
 		if err := resp.FitResult(&result); err == nil {
 			log.Infof("OPRHash result: %s\n", result)
@@ -246,8 +348,85 @@ func (c *Client) GetOPRHash(jobID string) error {
 	return nil
 }
 
+// GetOPR requests the full opr content for a job, and verifies it against
+// the oprhash we were given for the job.
+func (c *Client) GetOPR(jobID, oprHash string) error {
+	req := GetOPRRequest(jobID)
+	c.Lock()
+	c.requestsMade[req.ID] = func(resp Response) {
+		jLog := log.WithFields(log.Fields{"job": jobID, "oprhash": oprHash})
+		if resp.Error != nil {
+			jLog.Errorf("OPR request failed: %s", resp.Error.Message)
+			c.rejectJob(jobID)
+			return
+		}
+
+		var result string
+		if err := resp.FitResult(&result); err != nil {
+			jLog.WithError(err).Errorf("OPR response is invalid")
+			c.rejectJob(jobID)
+			return
+		}
+
+		content, err := hex.DecodeString(result)
+		if err != nil {
+			jLog.WithError(err).Errorf("OPR response is invalid")
+			c.rejectJob(jobID)
+			return
+		}
+
+		if err := VerifyOPR(oprHash, content, c.poolCoinbase); err != nil {
+			jLog.WithError(err).Errorf("OPR verification failed! The pool is not mining what it claims")
+			c.rejectJob(jobID)
+			return
+		}
+
+		jLog.Infof("OPR verified")
+		if c.oprVerification == VerifyRefuse && jobID == c.currentJobID {
+			c.SendCommand(mining.BuildCommand().ResumeMining().Build())
+		}
+	}
+	c.Unlock()
+	return c.Encode(req)
+}
+
+// rejectJob stops mining a job that failed verification. The caller must
+// hold the client lock.
+func (c *Client) rejectJob(jobID string) {
+	if c.oprVerification == VerifyRefuse && jobID == c.currentJobID {
+		log.WithField("job", jobID).Warnf("refusing to mine the job")
+		c.SendCommand(mining.BuildCommand().PauseMining().Build())
+	}
+}
+
+// VerifyOPR checks the opr content hashes to the oprhash, and if a coinbase
+// is provided, that the opr pays to the coinbase.
+func VerifyOPR(oprHash string, content []byte, coinbase string) error {
+	hash := sha256.Sum256(content)
+	if fmt.Sprintf("%x", hash[:]) != oprHash {
+		return fmt.Errorf("opr content hashes to %x, not %s", hash[:], oprHash)
+	}
+
+	var record opr.V4Content
+	if err := record.Unmarshal(content); err != nil {
+		return fmt.Errorf("opr content is invalid: %s", err.Error())
+	}
+
+	if coinbase != "" && record.Address != coinbase {
+		return fmt.Errorf("opr coinbase is %s, not the pool's %s", record.Address, coinbase)
+	}
+	return nil
+}
+
 // Submit completed work to server
 func (c *Client) Submit(username, jobID, nonce, oprHash, target string) error {
+	return c.SubmitWithResult(username, jobID, nonce, oprHash, target, nil)
+}
+
+// SubmitWithResult submits completed work, and calls done with the pool's
+// answer. The reason is empty if the share was accepted. done is called
+// with the client lock held.
+func (c *Client) SubmitWithResult(username, jobID, nonce, oprHash, target string, done func(accepted bool, reason string)) error {
 	req := SubmitRequest(username, jobID, nonce, oprHash, target)
 	c.Lock()
 	c.requestsMade[req.ID] = func(resp Response) {
@@ -259,6 +438,13 @@ func (c *Client) Submit(username, jobID, nonce, oprHash, target string) error {
 				"target":  target,
 			}).Tracef("Submission result: %t\n", result)
 		}
+		var reason string
+		if resp.Error != nil || !result {
+			reason = c.rejectShare(resp, jobID, oprHash, target)
+		}
+		if done != nil {
+			done(reason == "", reason)
+		}
 	}
 	c.Unlock()
 	err := c.Encode(req)
@@ -270,15 +456,28 @@ func (c *Client) Submit(username, jobID, nonce, oprHash, target string) error {
 
 // Subscribe to stratum pool
 func (c *Client) Subscribe() error {
-	req := SubscribeRequest(c.version)
 	c.Lock()
+	req := SubscribeRequest(c.version, c.sessionID)
 	c.requestsMade[req.ID] = func(resp Response) {
+		if resp.Error != nil && resp.Error.Code == ErrorOutdatedMiner {
+			log.Errorf("Subscribe refused: %v. This miner is too old for the pool, shutting down client.", resp.Error.Data)
+			c.Close()
+			return
+		}
 		var subscriptions []Subscription
 		if err := resp.FitResult(&subscriptions); err == nil {
 			log.Println("Subscriptions Results:")
 			for _, subscription := range subscriptions {
 				log.Println("...", subscription)
 
+				// The notify subscription id is the session
+				if subscription.Type == "mining.notify" {
+					if c.sessionID != "" && c.sessionID == subscription.Id {
+						log.WithField("session", c.sessionID).Info("resumed session")
+					}
+					c.sessionID = subscription.Id
+				}
+
 				// Set nonce if provided here
 				if subscription.Type == "mining.set_nonce" {
 					nonce, err := strconv.ParseUint(subscription.Id, 10, 32)
@@ -287,7 +486,7 @@ func (c *Client) Subscribe() error {
 						continue
 					}
 
-					c.SetNewNonce(uint32(nonce))
+					c.SetNewNonce(uint32(nonce), nil)
 				}
 			}
 		} else {
@@ -304,7 +503,21 @@ func (c *Client) Subscribe() error {
 
 // Suggest preferred mining target to server
 func (c *Client) SuggestTarget(preferredTarget string) error {
-	err := c.Encode(SuggestTargetRequest(preferredTarget))
+	req := SuggestTargetRequest(preferredTarget)
+	c.Lock()
+	c.requestsMade[req.ID] = func(resp Response) {
+		if resp.Error != nil {
+			log.WithField("target", preferredTarget).Errorf("Suggested target rejected: %s", resp.Error.Message)
+			return
+		}
+		var result bool
+		if err := resp.FitResult(&result); err == nil {
+			// The server will follow up with the target it chose
+			log.WithField("target", preferredTarget).Infof("SuggestTarget result: %t\n", result)
+		}
+	}
+	c.Unlock()
+	err := c.Encode(req)
 	if err != nil {
 		return err
 	}
@@ -312,10 +525,13 @@ func (c *Client) SuggestTarget(preferredTarget string) error {
 }
 
 func (c *Client) Close() error {
-	c.autoreconnect = false
-	if !reflect.ValueOf(c.conn).IsNil() {
+	c.autoreconnect.Store(false)
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+	if !reflect.ValueOf(conn).IsNil() {
 		log.Infof("shutting down stratum client")
-		return c.conn.Close()
+		return conn.Close()
 	}
 	return nil
 }
@@ -333,18 +549,34 @@ func (c *Client) Listen(ctx context.Context) {
 
 	log.Printf("Stratum client listening to server at %s\n", c.conn.RemoteAddr().String())
 	originalServerAddress := c.conn.RemoteAddr().String()
+	c.RLock()
+	if c.address != "" {
+		originalServerAddress = c.address
+	}
+	c.RUnlock()
 
 	r := bufio.NewReader(c.conn)
 
 	for {
 		readBytes, _, err := r.ReadLine()
 		if err != nil {
-			if !c.autoreconnect {
+			if !c.autoreconnect.Load() {
 				return // Stop trying to reconnect
 			}
 			_ = c.conn.Close()
-			log.WithError(err).Errorf("client lost connection to the server, reconnect attempt in 5s")
-			err := c.BlockTillConnected(originalServerAddress, "5")
+			c.Lock()
+			address, waittime := c.redirect, c.redirectWait
+			c.redirect, c.redirectWait = "", ""
+			c.Unlock()
+			if address != "" {
+				// The pool sent us elsewhere, which is now our server
+				log.Infof("reconnecting to %s in %ss as the pool asked", address, waittime)
+				originalServerAddress = address
+			} else {
+				log.WithError(err).Errorf("client lost connection to the server, reconnect attempt in 5s")
+				address, waittime = originalServerAddress, "5"
+			}
+			err := c.BlockTillConnected(address, waittime)
 			if err != nil {
 				log.WithError(err).Error("miner reconnect failed")
 				return
@@ -403,9 +635,19 @@ func (c *Client) HandleRequest(req Request) {
 			}
 		}
 
-		if err := c.WaitThenConnect(params[0]+":"+params[1], waittime); err != nil {
-			log.WithField("method", req.Method).WithError(err).Error("failed to reconnect")
+		// An empty host is the current server. The connection is closed,
+		// and Listen connects to the new address after the wait.
+		c.Lock()
+		c.redirect = params[0] + ":" + params[1]
+		if params[0] == "" {
+			c.redirect = c.address
+			if c.redirect == "" {
+				c.redirect = c.conn.RemoteAddr().String()
+			}
 		}
+		c.redirectWait = waittime
+		c.Unlock()
+		_ = c.conn.Close()
 	case "client.show_message":
 		if len(params) < 1 {
 			log.Errorln("No message to show")
@@ -423,33 +665,44 @@ func (c *Client) HandleRequest(req Request) {
 		jobID := params[0]
 		oprHash := params[1]
 
-		newJobID, err := strconv.ParseInt(jobID, 10, 64)
+		newJobID, newSeq, err := ParseJobID(jobID)
 		if err != nil {
 			log.Error("Not a valid new JobID")
 			return
 		}
-		existingJobID, _ := strconv.ParseInt(c.currentJobID, 10, 64)
-		if newJobID >= existingJobID {
+		existingJobID, existingSeq, _ := ParseJobID(c.currentJobID)
+		if newJobID > existingJobID || (newJobID == existingJobID && newSeq >= existingSeq) {
 			myHexBytes, err := hex.DecodeString(oprHash)
 			if err != nil {
 				log.Error(err)
 				return
 			}
-			if newJobID > existingJobID {
-				c.currentJobID = jobID
-			}
+			c.currentJobID = jobID
 			c.currentOPRHash = oprHash
 			stats := make(chan *mining.SingleMinerStats, len(c.miners))
-			command := mining.BuildCommand().
+			builder := mining.BuildCommand().
 				SubmitStats(stats).
 				ResetRecords().
 				NewOPRHash(myHexBytes).
-				MinimumDifficulty(c.currentTarget).
-				ResumeMining().
-				Build()
-			c.SendCommand(command)
+				MinimumDifficulty(c.currentTarget)
+			if c.oprVerification == VerifyRefuse {
+				// Mining resumes once the opr is verified
+				builder = builder.PauseMining()
+			} else {
+				builder = builder.ResumeMining()
+			}
+			c.SendCommand(builder.Build())
 
-			go c.AggregateStats(int32(existingJobID), stats, len(c.miners))
+			if c.oprVerification != VerifyOff {
+				if err := c.GetOPR(jobID, oprHash); err != nil {
+					log.WithError(err).Error("failed to request opr")
+				}
+			}
+
+			go c.AggregateStats(existingJobID, stats, len(c.miners))
+			if c.relay != nil {
+				c.relay.RelayNotify(jobID, oprHash)
+			}
 
 			log.Printf("JobID: %s ... OPR Hash: %s\n", jobID, oprHash)
 		} else {
@@ -474,6 +727,9 @@ func (c *Client) HandleRequest(req Request) {
 			MinimumDifficulty(c.currentTarget).
 			Build()
 		c.SendCommand(command)
+		if c.relay != nil {
+			c.relay.RelayTarget(c.currentTarget)
+		}
 	case "mining.set_nonce":
 		if len(params) < 1 {
 			log.Errorf("Not enough parameters from set_nonce: %s\n", params)
@@ -487,7 +743,17 @@ func (c *Client) HandleRequest(req Request) {
 			return
 		}
 
-		c.SetNewNonce(uint32(nonce))
+		// Proxies extend the nonce, to split it between their rigs
+		var extension []byte
+		if len(params) > 1 {
+			extension, err = hex.DecodeString(params[1])
+			if err != nil {
+				log.Errorln("Nonce extension is not hex: ", err)
+				return
+			}
+		}
+
+		c.SetNewNonce(uint32(nonce), extension)
 	case "mining.stop_mining":
 		log.Println("Request to stop mining received")
 		command := mining.BuildCommand().
@@ -499,12 +765,18 @@ func (c *Client) HandleRequest(req Request) {
 	}
 }
 
-func (c *Client) SetNewNonce(nonce uint32) {
-	log.Printf("New Nonce: %d\n", nonce)
+// SetNewNonce sets the nonce space the miners search. The extension follows
+// the nonce, if a proxy assigned one.
+func (c *Client) SetNewNonce(nonce uint32, extension []byte) {
+	log.Printf("New Nonce: %d %x\n", nonce, extension)
 	command := mining.BuildCommand().
+		NewNonceExtension(extension).
 		NewNoncePrefix(uint32(nonce)).
 		Build()
 	c.SendCommand(command)
+	if c.relay != nil {
+		c.relay.RelayNonce(nonce)
+	}
 }
 
 func (c *Client) AggregateStats(job int32, stats chan *mining.SingleMinerStats, l int) {
@@ -520,7 +792,11 @@ func (c *Client) AggregateStats(job int32, stats chan *mining.SingleMinerStats,
 		}
 	}
 
-	log.WithFields(groupStats.LogFields()).Info("job miner stats")
+	fields := groupStats.LogFields()
+	for reason, count := range c.Rejections() {
+		fields["rejected_"+reason] = count
+	}
+	log.WithFields(fields).Info("job miner stats")
 }
 
 func (c *Client) HandleResponse(resp Response) {
@@ -551,6 +827,47 @@ func (c *Client) ListenForSuccess() {
 	}
 }
 
+// rejectShare logs and tallies a rejected share, and returns the reason the
+// pool gave. The requests lock must be held.
+func (c *Client) rejectShare(resp Response, jobID, oprHash, target string) string {
+	name := "unknown" // Older pools do not send a reason
+	if resp.Error != nil && resp.Error.Data != nil {
+		name = fmt.Sprintf("%v", resp.Error.Data)
+	}
+	c.rejections[name]++
+
+	description := "no reason given"
+	if reason, ok := ParseRejectReason(name); ok {
+		description = reason.Description()
+	}
+	log.WithFields(log.Fields{
+		"job":     jobID,
+		"oprhash": oprHash,
+		"target":  target,
+		"reason":  name,
+		"total":   c.rejections[name],
+	}).Warnf("share rejected: %s", description)
+	return name
+}
+
+// Rejections returns the rejected share count by the reason the pool gave
+func (c *Client) Rejections() map[string]uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	rejections := make(map[string]uint64, len(c.rejections))
+	for reason, count := range c.rejections {
+		rejections[reason] = count
+	}
+	return rejections
+}
+
+// SessionID is the session the pool gave, which is resumed on reconnect
+func (c *Client) SessionID() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.sessionID
+}
+
 func (c *Client) TotalSuccesses() uint64 {
 	return c.totalSuccesses
 }
@@ -2,12 +2,17 @@ package stratum_test
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
 	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/pegnet/pegnet/modules/opr"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,25 +51,23 @@ func TestClient_Authorize(t *testing.T) {
 
 func TestClient_GetOPRHash(t *testing.T) {
 	require := require.New(t)
-	_, miner, _, cli := serverAndClient(t)
+	srv, miner, _, cli := serverAndClient(t)
 
 	err := miner.Subscribe()
 	require.NoError(err)
 
-	r := bufio.NewReader(cli)
-	data, isPrefix, err := r.ReadLine()
-	require.NoError(err)
-	require.False(isPrefix)
+	lines := readLines(cli)
+	<-lines // Subscribe response
 
-	err = miner.GetOPRHash("exampleJobId")
-	require.NoError(err)
+	oprHash := "00011111af870a1f49129f9c82d935665d352fffffea3296208f6f7b16faaabc"
+	srv.UpdateCurrentJob(&Job{JobID: 10, OPRHash: oprHash})
+	require.True(waitForLine(lines, `"mining.notify"`))
 
-	data, isPrefix, err = r.ReadLine()
+	err = miner.GetOPRHash("10")
 	require.NoError(err)
-	require.False(isPrefix)
 
 	var resp Response
-	err = json.Unmarshal(data, &resp)
+	err = json.Unmarshal([]byte(nextResponse(t, lines)), &resp)
 	require.NoError(err)
 	require.NotZero(resp.ID)
 	require.Nil(resp.Error)
@@ -72,10 +75,17 @@ func TestClient_GetOPRHash(t *testing.T) {
 	// Check the response
 	var oprHashResponse string
 	err = resp.FitResult(&oprHashResponse)
+	require.NoError(err)
+	require.Equal(oprHash, oprHashResponse)
 
+	// Unknown jobs get an error
+	err = miner.GetOPRHash("exampleJobId")
 	require.NoError(err)
-	require.NotEmpty(oprHashResponse)
-	require.EqualValues(len(oprHashResponse), 64)
+
+	err = json.Unmarshal([]byte(nextResponse(t, lines)), &resp)
+	require.NoError(err)
+	require.NotNil(resp.Error)
+	require.Equal(ErrorJobNotFound, resp.Error.Code)
 }
 
 func TestClient_Submit(t *testing.T) {
@@ -155,15 +165,201 @@ func TestClient_SuggestTarget(t *testing.T) {
 	err := miner.Subscribe()
 	require.NoError(err)
 
-	r := bufio.NewReader(cli)
-	_, isPrefix, err := r.ReadLine()
-	require.NoError(err)
-	require.False(isPrefix)
+	lines := readLines(cli)
+	<-lines // Subscribe response
 
-	err = miner.SuggestTarget("ffeabea") // 268348394 in decimal
+	err = miner.SuggestTarget("fffff00000000000") // 18446726481523507200 in decimal
 	require.NoError(err)
+
+	// The server should reply, then confirm the target
+	exp := []string{`"result":true`, `"mining.set_target"`}
+	for _, e := range exp {
+		require.True(waitForLine(lines, e), "expected %s", e)
+	}
+
 	actualMiner, err := srv.Miners.GetMiner(srv.Miners.ListMiners()[0])
 	require.NoError(err)
-	time.Sleep(1 * time.Second)
-	require.True(strings.Contains(actualMiner.ToString(), "Preferred Target: 268348394"))
+	require.True(strings.Contains(actualMiner.ToString(), "Preferred Target: 18446726481523507200"))
+
+	// Targets are clamped to the pool bounds
+	err = miner.SuggestTarget("ffeabea")
+	require.NoError(err)
+	require.True(waitForLine(lines, `"result":true`))
+	require.True(waitForLine(lines, `"ffff000000000000"`))
+
+	// Bad targets are rejected
+	err = miner.SuggestTarget("not hex")
+	require.NoError(err)
+	require.True(waitForLine(lines, `"error"`))
+}
+
+func TestClient_Rejections(t *testing.T) {
+	require := require.New(t)
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+
+	dec := json.NewDecoder(srv)
+	submit := func(resp func(id int32) Response) {
+		go func() { _ = miner.Submit("user", "10", "aa", "bb", "ff") }()
+		var req Request
+		require.NoError(dec.Decode(&req))
+		miner.HandleResponse(resp(req.ID))
+	}
+
+	submit(func(id int32) Response { return SubmitResponse(id, ShareAccepted) })
+	submit(func(id int32) Response { return SubmitResponse(id, RejectDuplicate) })
+	submit(func(id int32) Response { return SubmitResponse(id, RejectDuplicate) })
+	submit(func(id int32) Response { return SubmitResponse(id, RejectStale) })
+	// Older pools give no reason, and newer pools might have new reasons
+	submit(func(id int32) Response { return Response{ID: id}.SetResult(false) })
+	submit(func(id int32) Response { return HelpfulRPCError(id, ErrorShareRejected, "newreason") })
+
+	require.Equal(map[string]uint64{
+		"duplicate": 2, "stale": 1, "unknown": 1, "newreason": 1,
+	}, miner.Rejections())
+}
+
+func TestClient_ResumeSession(t *testing.T) {
+	require := require.New(t)
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+
+	dec := json.NewDecoder(srv)
+	subscribe := func() RPCParams {
+		go func() { _ = miner.Subscribe() }()
+		var req Request
+		require.NoError(dec.Decode(&req))
+		var params RPCParams
+		require.NoError(req.FitParams(&params))
+		miner.HandleResponse(SubscribeResponse(req.ID, "abcd", 5))
+		return params
+	}
+
+	require.Equal(RPCParams{"prosper/0.0.1"}, subscribe())
+	require.Equal("abcd", miner.SessionID())
+	// The session is sent when subscribing again, like on a reconnect
+	require.Equal(RPCParams{"prosper/0.0.1", "abcd"}, subscribe())
+}
+
+// readLines will read all lines written by the server. net.Pipe is
+// synchronous, so the server blocks until we read what it writes.
+func readLines(conn net.Conn) <-chan string {
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReader(conn)
+		for {
+			data, _, err := r.ReadLine()
+			if err != nil {
+				return
+			}
+			lines <- string(data)
+		}
+	}()
+	return lines
+}
+
+// waitForLine consumes lines until one contains the substring
+func waitForLine(lines <-chan string, sub string) bool {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			if strings.Contains(line, sub) {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+// nextResponse returns the next line that is not a request
+func nextResponse(t *testing.T, lines <-chan string) string {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			require.True(t, ok, "connection closed")
+			var u UnknownRPC
+			require.NoError(t, json.Unmarshal([]byte(line), &u))
+			if !u.IsRequest() {
+				return line
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a response")
+		}
+	}
+}
+
+func TestClient_GetOPR(t *testing.T) {
+	require := require.New(t)
+	srv, miner, _, cli := serverAndClient(t)
+
+	err := miner.Subscribe()
+	require.NoError(err)
+
+	lines := readLines(cli)
+	<-lines // Subscribe response
+
+	coinbase := "FA2jK2HcLnRdS94dEcU27rF3meoJfpUcZPSinpb7AwQvPRY6RL1Q"
+	record := opr.V4Content{V2Content: opr.V2Content{
+		Address: coinbase,
+		ID:      "Prosper",
+		Height:  10,
+		Assets:  make([]uint64, len(opr.V4Assets)),
+	}}
+	data, err := record.Marshal()
+	require.NoError(err)
+	oprHash := sha256.Sum256(data)
+
+	srv.UpdateCurrentJob(&Job{JobID: 10, OPRHash: fmt.Sprintf("%x", oprHash), OPRv4: record})
+	require.True(waitForLine(lines, `"mining.notify"`))
+
+	err = miner.GetOPR("10", fmt.Sprintf("%x", oprHash))
+	require.NoError(err)
+
+	var resp Response
+	err = json.Unmarshal([]byte(nextResponse(t, lines)), &resp)
+	require.NoError(err)
+	require.Nil(resp.Error)
+
+	var result string
+	require.NoError(resp.FitResult(&result))
+	content, err := hex.DecodeString(result)
+	require.NoError(err)
+	require.NoError(VerifyOPR(fmt.Sprintf("%x", oprHash), content, coinbase))
+
+	// Unknown jobs get an error
+	err = miner.GetOPR("11", fmt.Sprintf("%x", oprHash))
+	require.NoError(err)
+
+	err = json.Unmarshal([]byte(nextResponse(t, lines)), &resp)
+	require.NoError(err)
+	require.NotNil(resp.Error)
+	require.Equal(ErrorJobNotFound, resp.Error.Code)
+}
+
+func TestVerifyOPR(t *testing.T) {
+	require := require.New(t)
+	coinbase := "FA2jK2HcLnRdS94dEcU27rF3meoJfpUcZPSinpb7AwQvPRY6RL1Q"
+	record := opr.V4Content{V2Content: opr.V2Content{Address: coinbase, ID: "Prosper", Height: 10}}
+	data, err := record.Marshal()
+	require.NoError(err)
+	hash := sha256.Sum256(data)
+	oprHash := fmt.Sprintf("%x", hash)
+
+	require.NoError(VerifyOPR(oprHash, data, coinbase))
+	require.NoError(VerifyOPR(oprHash, data, ""))
+	require.Error(VerifyOPR(oprHash, data, "FA3EPZYqodgyEGXNMbiZKE5TS2x2J9wF8J9MvPZb52iGR78xMgCb"))
+	require.Error(VerifyOPR(oprHash, append(data, 0x00), coinbase))
 }
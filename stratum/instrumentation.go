@@ -0,0 +1,76 @@
+package stratum
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sharesAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_shares_accepted",
+		Help: "Shares accepted from miners",
+	})
+	sharesGrace = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_shares_grace",
+		Help: "Shares for the previous job accepted in the grace window, which would otherwise be rejected as stale",
+	})
+	sharesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_stratum_shares_rejected",
+		Help: "Shares rejected from miners by RejectReason",
+	}, []string{"reason"})
+	sharesSampled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_stratum_shares_sampled",
+		Help: "Shares picked for validation when sampling, by result",
+	}, []string{"result"})
+	sharesForfeited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_shares_forfeited",
+		Help: "Credited shares taken back from miners caught with invalid work",
+	})
+
+	broadcastLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pool_stratum_broadcast_latency_seconds",
+		Help:    "Time from a job notify until it is written to each miner",
+		Buckets: []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	notifyFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_notify_failures",
+		Help: "Job notifies that were dropped or failed to write to a miner",
+	})
+	slowDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_slow_disconnects",
+		Help: "Miners disconnected for failing too many notifies in a row",
+	})
+
+	bansIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "pool_stratum_bans",
+		Help: "Ips and usernames banned, automatically or by an admin",
+	})
+	connectionsRefused = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_stratum_connections_refused",
+		Help: "Connections refused because the ip is banned, or over its connection limit",
+	}, []string{"reason"})
+
+	outdatedMiners = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pool_stratum_outdated_miners",
+		Help: "Subscribes from miners older than the minimum version, by whether they were notified or refused",
+	}, []string{"action"})
+)
+
+var prom sync.Once
+
+func RegisterPrometheus() {
+	prom.Do(func() {
+		prometheus.MustRegister(sharesAccepted)
+		prometheus.MustRegister(sharesGrace)
+		prometheus.MustRegister(sharesRejected)
+		prometheus.MustRegister(sharesSampled)
+		prometheus.MustRegister(sharesForfeited)
+		prometheus.MustRegister(broadcastLatency)
+		prometheus.MustRegister(notifyFailures)
+		prometheus.MustRegister(slowDisconnects)
+		prometheus.MustRegister(bansIssued)
+		prometheus.MustRegister(connectionsRefused)
+		prometheus.MustRegister(outdatedMiners)
+	})
+}
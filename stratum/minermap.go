@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 )
@@ -15,12 +16,25 @@ type MinerMap struct {
 	// nextNonce is the nonce to hand out to the next miner
 	// This sets their search space
 	nextNonce uint32
+	// extend gives every miner the same nonce, and splits it with a nonce
+	// extension instead. Proxies split their upstream nonce this way. The
+	// extensions in use are tracked both ways, so they are never handed out
+	// twice.
+	extend        bool
+	nextExtension uint16
+	extensions    map[uint16]*Miner
+	extensionOf   map[*Miner]uint16
 	sync.RWMutex
 }
 
+// ErrNoExtensions is returned when every nonce extension is in use
+var ErrNoExtensions = fmt.Errorf("every nonce extension is in use")
+
 func NewMinerMap() *MinerMap {
 	m := new(MinerMap)
 	m.miners = make(map[string]*Miner)
+	m.extensions = make(map[uint16]*Miner)
+	m.extensionOf = make(map[*Miner]uint16)
 
 	// Seed the nonce
 	buf := make([]byte, 4)
@@ -48,7 +62,6 @@ func (m *MinerMap) Notify(msg json.RawMessage) []NotifyError {
 	var errs []NotifyError
 	m.RLock()
 	for session, m := range m.miners {
-		m.ResetNonceHistory()
 		err := m.Broadcast(msg)
 		if err != nil {
 			errs = append(errs, NotifyError{
@@ -61,29 +74,110 @@ func (m *MinerMap) Notify(msg json.RawMessage) []NotifyError {
 	return errs
 }
 
-// AddMiner will add a miner to the map, and return a unique session id
-func (m *MinerMap) AddMiner(u *Miner) string {
+// ExtendNonces gives every new miner the nonce, followed by its own nonce
+// extension
+func (m *MinerMap) ExtendNonces(nonce uint32) {
+	m.Lock()
+	defer m.Unlock()
+	m.extend = true
+	m.nextNonce = nonce
+}
+
+// AddMiner will add a miner to the map, and return a unique session id. If
+// nonces are extended and every extension is in use, the miner is not added.
+func (m *MinerMap) AddMiner(u *Miner) (string, error) {
 	session := make([]byte, 16)
 	_, _ = crand.Read(session)
 	u.sessionID = fmt.Sprintf("%x", session)
 	u.joined = time.Now()
 	m.Lock()
+	defer m.Unlock()
 	u.nonce = m.nextNonce
-	m.nextNonce++
+	if m.extend {
+		extension, ok := m.freeExtension()
+		if !ok {
+			return "", ErrNoExtensions
+		}
+		m.claimExtension(u, extension)
+		u.nonceExtension = extensionBytes(extension)
+		m.nextExtension = extension + 1
+	} else {
+		m.nextNonce++
+	}
 	m.miners[u.sessionID] = u
+	return u.sessionID, nil
+}
+
+// MoveMiner moves the miner to a resumed session id. The resumed session
+// takes back its nonce extension if it is still free. If it was handed out
+// again, the miner keeps the extension it was added with.
+func (m *MinerMap) MoveMiner(u *Miner, session string) {
+	m.Lock()
+	delete(m.miners, u.sessionID)
+	u.sessionID = session
+	m.miners[session] = u
+	if current, ok := m.extensionOf[u]; ok {
+		restored := u.NonceExtension()
+		if len(restored) != NonceExtensionLength {
+			u.setNonceExtension(extensionBytes(current))
+		} else if extension := binary.BigEndian.Uint16(restored); extension != current {
+			if _, taken := m.extensions[extension]; taken {
+				u.setNonceExtension(extensionBytes(current))
+			} else {
+				m.releaseExtension(u)
+				m.claimExtension(u, extension)
+			}
+		}
+	}
 	m.Unlock()
-	return u.sessionID
 }
 
 func (m *MinerMap) DisconnectMiner(u *Miner) {
 	m.Lock()
 	defer m.Unlock()
 
-	delete(m.miners, u.sessionID)
+	// A resumed session may already be under the id
+	if m.miners[u.sessionID] == u {
+		delete(m.miners, u.sessionID)
+	}
+	m.releaseExtension(u)
 	// Close the connection if they are still listening.
 	u.conn.Close()
 }
 
+// freeExtension finds the next extension not in use. Must hold the lock.
+func (m *MinerMap) freeExtension() (uint16, bool) {
+	extension := m.nextExtension
+	for i := 0; i <= math.MaxUint16; i++ {
+		if _, ok := m.extensions[extension]; !ok {
+			return extension, true
+		}
+		extension++
+	}
+	return 0, false
+}
+
+// claimExtension marks the extension as the miner's. Must hold the lock.
+func (m *MinerMap) claimExtension(u *Miner, extension uint16) {
+	m.extensions[extension] = u
+	m.extensionOf[u] = extension
+}
+
+// releaseExtension frees the miner's extension, if it has one. Must hold
+// the lock.
+func (m *MinerMap) releaseExtension(u *Miner) {
+	if extension, ok := m.extensionOf[u]; ok {
+		delete(m.extensions, extension)
+		delete(m.extensionOf, u)
+	}
+}
+
+func extensionBytes(extension uint16) []byte {
+	buf := make([]byte, NonceExtensionLength)
+	binary.BigEndian.PutUint16(buf, extension)
+	return buf
+}
+
 // GetMiner returns a pointer to the miner in the MinerMap under the 'name' key
 func (m *MinerMap) GetMiner(name string) (*Miner, error) {
 	m.Lock()
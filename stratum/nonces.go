@@ -0,0 +1,81 @@
+package stratum
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// NoncePrefixLength is the number of leading nonce bytes that must be the
+// session's assigned nonce, big endian. Miners search the space after it, so
+// no two sessions can submit the same work.
+const NoncePrefixLength = 4
+
+// NonceExtensionLength is the number of bytes a proxy adds after its own
+// nonce prefix, to give each of its rigs their own nonce space
+const NonceExtensionLength = 2
+
+// NoncePrefix is the prefix every share nonce from the session must start with
+func NoncePrefix(nonce uint32) []byte {
+	buf := make([]byte, NoncePrefixLength)
+	binary.BigEndian.PutUint32(buf, nonce)
+	return buf
+}
+
+// NonceSet is every share submitted to the pool for the current height, so
+// the same work is never credited twice, even across sessions. The previous
+// height is kept for shares in the grace window.
+type NonceSet struct {
+	current  map[string]struct{}
+	previous map[string]struct{}
+	sync.Mutex
+}
+
+func NewNonceSet() *NonceSet {
+	n := new(NonceSet)
+	n.current = make(map[string]struct{})
+	return n
+}
+
+// Seen returns true if the share was already submitted
+func (n *NonceSet) Seen(oprHash, nonce []byte) bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.seen(string(oprHash) + string(nonce))
+}
+
+// Add records the share, and returns true if it was already submitted
+func (n *NonceSet) Add(oprHash, nonce []byte) bool {
+	key := string(oprHash) + string(nonce)
+	n.Lock()
+	defer n.Unlock()
+	if n.seen(key) {
+		return true
+	}
+	n.current[key] = struct{}{}
+	return false
+}
+
+// seen checks both heights for the key. Must hold the lock.
+func (n *NonceSet) seen(key string) bool {
+	if _, ok := n.current[key]; ok {
+		return true
+	}
+	_, ok := n.previous[key]
+	return ok
+}
+
+// Rotate starts a new height. The last height's shares are still checked
+// until the next rotation.
+func (n *NonceSet) Rotate() {
+	n.Lock()
+	n.previous = n.current
+	n.current = make(map[string]struct{})
+	n.Unlock()
+}
+
+// Len is the number of shares remembered
+func (n *NonceSet) Len() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.current) + len(n.previous)
+}
@@ -0,0 +1,188 @@
+package stratum
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Relay is told about the requests the pool sends a client, so a proxy can
+// pass them on to its rigs
+type Relay interface {
+	RelayNotify(jobID, oprHash string)
+	RelayTarget(target uint64)
+	RelayNonce(nonce uint32)
+}
+
+// Proxy serves many local rigs over a single connection to the pool. Every
+// rig is given the proxy's own nonce, followed by a nonce extension, so the
+// rigs never search the same space. Jobs and targets from the pool are passed
+// on to the rigs, and the shares they find are relayed to the pool under the
+// proxy's username.
+type Proxy struct {
+	Upstream *Client
+	Server   *Server
+
+	shares <-chan *ShareSubmission
+
+	sync.Mutex
+	rigs map[string]*RigStats
+}
+
+// RigStats are the shares of a rig behind the proxy. Shares the proxy
+// rejects itself are on the rig's MinerSnapShot.
+type RigStats struct {
+	Rig       string            // 'username,minerid' the rig authorized with
+	Relayed   uint64            // Shares relayed to the pool
+	Accepted  uint64            // Relayed shares the pool accepted
+	Rejected  map[string]uint64 // Relayed shares the pool rejected, by reason
+	LastShare time.Time
+}
+
+// NewProxy creates the stratum server the rigs connect to, and hooks it up to
+// the upstream client. Vardiff is disabled, as every rig mines at the target
+// the pool gives the proxy.
+func NewProxy(conf *viper.Viper, upstream *Client) (*Proxy, error) {
+	s, err := NewServer(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.VarDiff.Enabled = false
+	s.Miners.ExtendNonces(0)
+
+	p := new(Proxy)
+	p.Server = s
+	p.Upstream = upstream
+	p.shares = s.GetSubmissionExport()
+	p.rigs = make(map[string]*RigStats)
+	upstream.SetRelay(p)
+	return p, nil
+}
+
+// RelayNotify passes a new job from the pool on to the rigs
+func (p *Proxy) RelayNotify(jobID, oprHash string) {
+	height, seq, err := ParseJobID(jobID)
+	if err != nil {
+		log.WithError(err).WithField("job", jobID).Error("pool sent a bad job id")
+		return
+	}
+	p.Server.UpdateCurrentJob(&Job{JobID: height, Seq: seq, OPRHash: oprHash})
+}
+
+// RelayTarget sets every rig to the target the pool gave the proxy
+func (p *Proxy) RelayTarget(target uint64) {
+	p.Server.SetInitialTarget(target)
+	now := time.Now()
+	p.eachSubscribed(func(miner *Miner) error {
+		miner.retarget(target, now)
+		return miner.enc.Encode(SetTargetRequest(fmt.Sprintf("%x", target)))
+	})
+}
+
+// RelayNonce moves every rig into the new nonce the pool gave the proxy. The
+// rigs keep their nonce extensions.
+func (p *Proxy) RelayNonce(nonce uint32) {
+	p.Server.Miners.ExtendNonces(nonce)
+	p.eachSubscribed(func(miner *Miner) error {
+		miner.setNonce(nonce)
+		return miner.enc.Encode(SetNonceExtensionRequest(fmt.Sprintf("%d", nonce), miner.NonceExtension()))
+	})
+}
+
+// eachSubscribed calls f with each subscribed rig's encSync held
+func (p *Proxy) eachSubscribed(f func(miner *Miner) error) {
+	for _, session := range p.Server.Miners.ListMiners() {
+		miner, err := p.Server.Miners.GetMiner(session)
+		if err != nil {
+			continue // Disconnected
+		}
+		miner.encSync.Lock()
+		if miner.subscribed {
+			if err := f(miner); err != nil {
+				miner.log.WithError(err).Warn("failed to relay to rig")
+			}
+		}
+		miner.encSync.Unlock()
+	}
+}
+
+// Run relays the shares the rigs find to the pool, until the context is
+// cancelled
+func (p *Proxy) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case share := <-p.shares:
+			if share.Forfeit != nil {
+				continue // Not a share
+			}
+			p.relay(share)
+		}
+	}
+}
+
+// relay submits the rig's share to the pool, under the proxy's username
+func (p *Proxy) relay(share *ShareSubmission) {
+	rig := share.Username + "," + share.MinerID
+	done := func(accepted bool, reason string) {
+		p.Lock()
+		defer p.Unlock()
+		stats := p.rig(rig)
+		if accepted {
+			stats.Accepted++
+		} else {
+			stats.Rejected[reason]++
+		}
+	}
+
+	err := p.Upstream.SubmitWithResult(p.Upstream.username,
+		fmt.Sprintf("%d", share.JobID),
+		hex.EncodeToString(share.Nonce),
+		hex.EncodeToString(share.OPRHash),
+		fmt.Sprintf("%x", share.Target),
+		done)
+	if err != nil {
+		log.WithError(err).WithField("rig", rig).Error("failed to relay share to the pool")
+		return
+	}
+
+	p.Lock()
+	stats := p.rig(rig)
+	stats.Relayed++
+	stats.LastShare = time.Now()
+	p.Unlock()
+}
+
+// rig returns the rig's stats. Must hold the lock.
+func (p *Proxy) rig(rig string) *RigStats {
+	stats, ok := p.rigs[rig]
+	if !ok {
+		stats = &RigStats{Rig: rig, Rejected: make(map[string]uint64)}
+		p.rigs[rig] = stats
+	}
+	return stats
+}
+
+// Rigs returns the stats of every rig that found a share, by rig name
+func (p *Proxy) Rigs() []RigStats {
+	p.Lock()
+	defer p.Unlock()
+	rigs := make([]RigStats, 0, len(p.rigs))
+	for _, stats := range p.rigs {
+		c := *stats
+		c.Rejected = make(map[string]uint64, len(stats.Rejected))
+		for reason, count := range stats.Rejected {
+			c.Rejected[reason] = count
+		}
+		rigs = append(rigs, c)
+	}
+	sort.Slice(rigs, func(i, j int) bool { return rigs[i].Rig < rigs[j].Rig })
+	return rigs
+}
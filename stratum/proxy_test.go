@@ -0,0 +1,166 @@
+package stratum_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Relay(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumInitialTarget, "fffff00000000000")
+	pool, err := NewServer(conf)
+	require.NoError(err)
+	poolShares := pool.GetSubmissionExport()
+
+	upstream, err := NewClient("proxy", "farm", "", "", "", "0.0.1")
+	require.NoError(err)
+	srv, cli := net.Pipe()
+	upstream.InitConn(cli)
+	pool.NewConn(srv)
+
+	proxyConf := viper.New()
+	config.SetDefaults(proxyConf)
+	proxyConf.Set(config.ConfigStratumCheckAllWork, false)
+	proxyConf.Set(config.ConfigStratumRequireAuth, false)
+	p, err := NewProxy(proxyConf, upstream)
+	require.NoError(err)
+	go p.Run(ctx)
+	go upstream.Listen(ctx)
+	// The client holds its lock while writing, so over a pipe the authorize
+	// waits for the subscribe to be handled
+	require.NoError(upstream.Subscribe())
+
+	// The pool's nonce and target are passed on to the rigs
+	var farm *Miner
+	require.Eventually(func() bool {
+		for _, session := range pool.Miners.ListMiners() {
+			farm, _ = pool.Miners.GetMiner(session)
+		}
+		return farm != nil && farm.SnapShot().Subscribed && p.Server.InitialTarget() == 0xfffff00000000000
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(upstream.Authorize("proxy,farm", "", "", ""))
+	a, b := subscribedMiner(t, p.Server), subscribedMiner(t, p.Server)
+	require.Equal(farm.Nonce(), a.Nonce())
+	require.Equal(farm.Nonce(), b.Nonce())
+	require.Len(a.NonceExtension(), NonceExtensionLength)
+	require.NotEqual(a.NonceExtension(), b.NonceExtension())
+	require.Equal(uint64(0xfffff00000000000), a.SnapShot().PrefferedTarget)
+
+	// Jobs are passed on to the rigs
+	oprHash, target := fmt.Sprintf("%064d", 1), "ffffffffffffffff"
+	pool.UpdateCurrentJob(&Job{JobID: 10, OPRHash: oprHash})
+	nonce := func(m *Miner, suffix string) string {
+		return fmt.Sprintf("%s%x%s", n(m, ""), m.NonceExtension(), suffix)
+	}
+	require.Eventually(func() bool {
+		return p.Server.ProcessSubmission(a, "10", nonce(a, "aa"), oprHash, target) == ShareAccepted
+	}, time.Second, 10*time.Millisecond)
+
+	// Rigs must stay in their own extension
+	require.Equal(RejectNoncePrefix, p.Server.ProcessSubmission(a, "10", nonce(b, "bb"), oprHash, target))
+	require.Equal(RejectNoncePrefix, p.Server.ProcessSubmission(a, "10", n(a, "bb"), oprHash, target))
+
+	// The share reaches the pool under the proxy's name
+	share := <-poolShares
+	require.Equal("proxy", share.Username)
+	require.Equal(int32(10), share.JobID)
+	require.Eventually(func() bool {
+		rigs := p.Rigs()
+		return len(rigs) == 1 && rigs[0].Accepted == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(uint64(1), p.Rigs()[0].Relayed)
+
+	// A new nonce from the pool keeps the rigs' extensions
+	extension := a.NonceExtension()
+	require.NoError(pool.SetNonce(farm.SnapShot().SessionID, "77"))
+	require.Eventually(func() bool {
+		return a.Nonce() == 77
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(extension, a.NonceExtension())
+}
+
+func TestMinerMap_Extensions(t *testing.T) {
+	require := require.New(t)
+	m := NewMinerMap()
+	m.ExtendNonces(0)
+	_, conn := net.Pipe()
+
+	// Every extension can be handed out once
+	miners := make([]*Miner, 0, 1<<16)
+	seen := make(map[string]bool)
+	for i := 0; i < 1<<16; i++ {
+		miner := InitMiner(conn)
+		_, err := m.AddMiner(miner)
+		require.NoError(err)
+		require.False(seen[fmt.Sprintf("%x", miner.NonceExtension())])
+		seen[fmt.Sprintf("%x", miner.NonceExtension())] = true
+		miners = append(miners, miner)
+	}
+	_, err := m.AddMiner(InitMiner(conn))
+	require.Equal(ErrNoExtensions, err)
+
+	// A disconnected miner's extension is handed out again, and only that one
+	m.DisconnectMiner(miners[10])
+	miner := InitMiner(conn)
+	_, err = m.AddMiner(miner)
+	require.NoError(err)
+	require.Equal(miners[10].NonceExtension(), miner.NonceExtension())
+	_, err = m.AddMiner(InitMiner(conn))
+	require.Equal(ErrNoExtensions, err)
+}
+
+func TestServer_SessionResumeExtension(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumSessionTTL, time.Minute)
+	s, err := NewServer(conf)
+	require.NoError(err)
+	s.Miners.ExtendNonces(0)
+
+	connect := func(session string) (net.Conn, *Miner) {
+		srv, cli := net.Pipe()
+		s.NewConn(srv)
+		lines := readLines(cli)
+		require.NoError(json.NewEncoder(cli).Encode(SubscribeRequest("0.0.1", session)))
+		var resp Response
+		require.NoError(json.Unmarshal([]byte(<-lines), &resp))
+		var subs []Subscription
+		require.NoError(resp.FitResult(&subs))
+		require.True(waitForLine(lines, `"method":"mining.set_target"`))
+		m, err := s.Miners.GetMiner(subs[0].Id)
+		require.NoError(err)
+		return cli, m
+	}
+
+	cli, a := connect("")
+	session, extension := a.SnapShot().SessionID, a.NonceExtension()
+	require.NoError(cli.Close())
+	require.Eventually(func() bool { return s.Sessions.Len() == 1 && s.Miners.Len() == 0 }, time.Second, 10*time.Millisecond)
+
+	// The resumed session takes back its extension, which is not handed
+	// out again while it is in use
+	_, b := connect("")
+	require.NotEqual(extension, b.NonceExtension())
+	_, a = connect(session)
+	require.Equal(extension, a.NonceExtension())
+	_, c := connect("")
+	require.NotEqual(extension, c.NonceExtension())
+	require.NotEqual(b.NonceExtension(), c.NonceExtension())
+}
@@ -0,0 +1,112 @@
+package stratum
+
+import "fmt"
+
+// RejectReason is why a share was not accepted. The reason is sent back to
+// the miner in the data of the submit error, so rigs with a bad setup can be
+// diagnosed.
+type RejectReason int
+
+const (
+	ShareAccepted RejectReason = iota
+	// RejectStale is a share for a job that is no longer being accepted
+	RejectStale
+	// RejectWrongOPRHash is a share for an oprhash the job does not have
+	RejectWrongOPRHash
+	// RejectLowTarget is a share below the miner's target
+	RejectLowTarget
+	// RejectDuplicate is a nonce the miner already submitted for the job
+	RejectDuplicate
+	// RejectInvalidWork is a share that does not hash to the target
+	RejectInvalidWork
+	// RejectGate is a share submitted while the pool is not accepting
+	// shares, like around minute 0
+	RejectGate
+	// RejectMalformed is a share with a field that could not be parsed
+	RejectMalformed
+	// RejectNoncePrefix is a share outside the session's nonce space
+	RejectNoncePrefix
+	// RejectShutdown is a share submitted while the pool is shutting down
+	RejectShutdown
+)
+
+// RejectReasons is every rejection reason, in order
+var RejectReasons = []RejectReason{
+	RejectStale,
+	RejectWrongOPRHash,
+	RejectLowTarget,
+	RejectDuplicate,
+	RejectInvalidWork,
+	RejectGate,
+	RejectMalformed,
+	RejectNoncePrefix,
+	RejectShutdown,
+}
+
+// String is the short name of the reason. It is the data of the submit error
+// and the metric label.
+func (r RejectReason) String() string {
+	switch r {
+	case ShareAccepted:
+		return "accepted"
+	case RejectStale:
+		return "stale"
+	case RejectWrongOPRHash:
+		return "oprhash"
+	case RejectLowTarget:
+		return "lowtarget"
+	case RejectDuplicate:
+		return "duplicate"
+	case RejectInvalidWork:
+		return "invalid"
+	case RejectGate:
+		return "gate"
+	case RejectMalformed:
+		return "malformed"
+	case RejectNoncePrefix:
+		return "nonceprefix"
+	case RejectShutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// Description explains the reason to an operator
+func (r RejectReason) Description() string {
+	switch r {
+	case ShareAccepted:
+		return "share accepted"
+	case RejectStale:
+		return "share is for a job that is no longer accepted"
+	case RejectWrongOPRHash:
+		return "share oprhash does not match the job"
+	case RejectLowTarget:
+		return "share is below the miner's target"
+	case RejectDuplicate:
+		return "nonce was already submitted for the job"
+	case RejectInvalidWork:
+		return "share does not hash to the target"
+	case RejectGate:
+		return "pool is not accepting shares right now"
+	case RejectMalformed:
+		return "share has a malformed field"
+	case RejectNoncePrefix:
+		return "nonce does not start with the assigned nonce"
+	case RejectShutdown:
+		return "pool is shutting down"
+	default:
+		return "unknown rejection reason"
+	}
+}
+
+// ParseRejectReason is the reverse of String. Unknown names are returned
+// with ok false, so clients can still tally reasons from newer pools.
+func ParseRejectReason(name string) (RejectReason, bool) {
+	for _, r := range RejectReasons {
+		if r.String() == name {
+			return r, true
+		}
+	}
+	return 0, false
+}
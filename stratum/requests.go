@@ -0,0 +1,93 @@
+package stratum
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRequestTimeout = fmt.Errorf("miner did not respond in time")
+	ErrRequestDropped = fmt.Errorf("miner disconnected before responding")
+)
+
+// ResponseHandler is called with the miner's response to a request the pool
+// sent. If no response arrives, it is called with an error instead. Handlers
+// run on their own goroutine, not the miner's message handler, so they can
+// send to the miner.
+type ResponseHandler func(resp Response, err error)
+
+// pendingRequests are the requests the pool sent a miner that are waiting on
+// a response, by request id. It works like the client's requestsMade, but
+// requests that are never answered time out.
+type pendingRequests struct {
+	sync.Mutex
+	handlers map[int32]ResponseHandler
+	timers   map[int32]*time.Timer
+}
+
+func newPendingRequests() *pendingRequests {
+	p := new(pendingRequests)
+	p.handlers = make(map[int32]ResponseHandler)
+	p.timers = make(map[int32]*time.Timer)
+	return p
+}
+
+// add registers the handler for the request id. The handler is called with
+// ErrRequestTimeout if there is no response after the timeout.
+func (p *pendingRequests) add(id int32, timeout time.Duration, handler ResponseHandler) {
+	p.Lock()
+	defer p.Unlock()
+	p.handlers[id] = handler
+	if timeout > 0 {
+		p.timers[id] = time.AfterFunc(timeout, func() {
+			if h := p.take(id); h != nil {
+				h(Response{ID: id}, ErrRequestTimeout)
+			}
+		})
+	}
+}
+
+// take removes the request and returns its handler, or nil if the request
+// is not pending
+func (p *pendingRequests) take(id int32) ResponseHandler {
+	p.Lock()
+	defer p.Unlock()
+	h, ok := p.handlers[id]
+	if !ok {
+		return nil
+	}
+	delete(p.handlers, id)
+	if t, ok := p.timers[id]; ok {
+		t.Stop()
+		delete(p.timers, id)
+	}
+	return h
+}
+
+// respond passes the response to the handler of its request. Returns false
+// if the response is not for a pending request. The handler is called on a
+// new goroutine, as the miner's encSync is held while responses are handled.
+func (p *pendingRequests) respond(resp Response) bool {
+	h := p.take(resp.ID)
+	if h == nil {
+		return false
+	}
+	go h(resp, nil)
+	return true
+}
+
+// drop fails every pending request with ErrRequestDropped
+func (p *pendingRequests) drop() {
+	p.Lock()
+	ids := make([]int32, 0, len(p.handlers))
+	for id := range p.handlers {
+		ids = append(ids, id)
+	}
+	p.Unlock()
+	for _, id := range ids {
+		if h := p.take(id); h != nil {
+			h(Response{ID: id}, ErrRequestDropped)
+		}
+	}
+}
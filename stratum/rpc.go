@@ -1,6 +1,7 @@
 package stratum
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -61,6 +62,13 @@ func GetOPRHashRequest(jobID string) Request {
 	}.SetParams(RPCParams{jobID})
 }
 
+func GetOPRRequest(jobID string) Request {
+	return Request{
+		ID:     rand.Int31(),
+		Method: "mining.get_opr",
+	}.SetParams(RPCParams{jobID})
+}
+
 func SubmitRequest(username, jobID, nonce, oprHash, target string) Request {
 	return Request{
 		ID:     rand.Int31(),
@@ -68,11 +76,17 @@ func SubmitRequest(username, jobID, nonce, oprHash, target string) Request {
 	}.SetParams(RPCParams{username, jobID, nonce, oprHash, target})
 }
 
-func SubscribeRequest(version string) Request {
+// SubscribeRequest subscribes to the pool. If the session id is set, the pool
+// resumes that session if it still has it.
+func SubscribeRequest(version, session string) Request {
+	params := RPCParams{"prosper/" + version}
+	if session != "" {
+		params = append(params, session)
+	}
 	return Request{
 		ID:     rand.Int31(),
 		Method: "mining.subscribe",
-	}.SetParams(RPCParams{"prosper/" + version})
+	}.SetParams(params)
 }
 
 func SuggestTargetRequest(preferredTarget string) Request {
@@ -105,6 +119,10 @@ func ShowMessageRequest(message string) Request {
 	}.SetParams(RPCParams{message})
 }
 
+// CleanJobs is the notify flag telling miners to drop their current work and
+// start on the new job immediately.
+const CleanJobs = "true"
+
 func NotifyRequest(jobID, oprHash, cleanjobs string) Request {
 	return Request{
 		ID:     rand.Int31(),
@@ -126,6 +144,15 @@ func SetNonceRequest(nonce string) Request {
 	}.SetParams(RPCParams{nonce})
 }
 
+// SetNonceExtensionRequest sets the nonce, followed by the hex extension
+// bytes. A proxy uses the extension to split its nonce between rigs.
+func SetNonceExtensionRequest(nonce string, extension []byte) Request {
+	return Request{
+		ID:     rand.Int31(),
+		Method: "mining.set_nonce",
+	}.SetParams(RPCParams{nonce, hex.EncodeToString(extension)})
+}
+
 func StopMiningRequest() Request {
 	return Request{
 		ID:     rand.Int31(),
@@ -157,16 +184,26 @@ type Subscription struct {
 // SubscribeResult is [session id, nonce]
 type SubscribeResult []Subscription
 
-func AuthorizeResponse(id int32, result bool, err error) Response {
+// AuthorizeResponse is true if the miner is authorized. A failed authorize is
+// an error with the reason as the data.
+func AuthorizeResponse(id int32, err error) Response {
+	if err != nil {
+		return HelpfulRPCError(id, ErrorUnauthorizedWorker, err.Error())
+	}
 	return Response{
 		ID: id,
-	}.SetResult(result)
+	}.SetResult(true)
 }
 
-func SubmitResponse(id int32, result bool, err error) Response {
+// SubmitResponse is the result of a share. A rejected share is an error with
+// the RejectReason as the data, so the miner knows why.
+func SubmitResponse(id int32, reason RejectReason) Response {
+	if reason != ShareAccepted {
+		return HelpfulRPCError(id, ErrorShareRejected, reason.String())
+	}
 	return Response{
 		ID: id,
-	}.SetResult(result)
+	}.SetResult(true)
 }
 
 func SubscribeResponse(id int32, session string, nonce uint32) Response {
@@ -189,6 +226,19 @@ func GetVersionResponse(id int32, version string) Response {
 	}.SetResult(version)
 }
 
+// GetOPRResponse returns the hex encoded, serialized opr
+func GetOPRResponse(id int32, opr string) Response {
+	return Response{
+		ID: id,
+	}.SetResult(opr)
+}
+
+func SuggestTargetResponse(id int32, result bool) Response {
+	return Response{
+		ID: id,
+	}.SetResult(result)
+}
+
 func GetOPRHashResponse(id int32, oprHash string) Response {
 	return Response{
 		ID: id,
@@ -216,6 +266,12 @@ const (
 	ErrorSignatureUnavailable = 21
 	ErrorUnknownSignatureType = 22
 	ErrorBadSignature         = 23
+
+	// Mining errors
+	ErrorUnauthorizedWorker = 24
+	ErrorOutdatedMiner      = 25
+	ErrorJobNotFound        = 30
+	ErrorShareRejected      = 31
 )
 
 func RPCErrorString(errorType int) string {
@@ -244,6 +300,14 @@ func RPCErrorString(errorType int) string {
 		return "ErrorUnknownSignatureType"
 	case ErrorBadSignature:
 		return "ErrorBadSignature"
+	case ErrorUnauthorizedWorker:
+		return "ErrorUnauthorizedWorker"
+	case ErrorOutdatedMiner:
+		return "ErrorOutdatedMiner"
+	case ErrorJobNotFound:
+		return "ErrorJobNotFound"
+	case ErrorShareRejected:
+		return "ErrorShareRejected"
 	default:
 		return "unknown error"
 	}
@@ -278,3 +342,7 @@ func HelpfulRPCError(id int32, errorType int, data interface{}) Response {
 // -21, “Signature unavailable”, when server rejects to sign response
 // -22, “Unknown signature type”, when server doesn’t understand any signature type from “sign_type”
 // -23, “Bad signature”, signature doesn’t match source data
+// -24, “Unauthorized worker”, the miner failed to authorize
+// -25, “Outdated miner”, the miner's version is below the pool's minimum
+// -30, “Job not found”, the job is unknown or no longer kept by the pool
+// -31, “Share rejected”, the data is the reason the share was rejected
@@ -0,0 +1,98 @@
+package stratum
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SubmitTargeter is the target a share must beat to be submitted to the
+// chain. The share submitter's ema implements it.
+type SubmitTargeter interface {
+	SubmitTarget() uint64
+}
+
+// ShareSampler picks the shares to validate when not every share is
+// validated. A fraction of each miner's shares are picked at random, along
+// with every share that would be submitted to the chain, and every share of a
+// miner that was caught with invalid work.
+type ShareSampler struct {
+	// Rate is the fraction of shares validated. 0 disables sampling.
+	Rate float64
+	// Target is the submit target. Shares above it are always validated.
+	Target SubmitTargeter
+
+	sync.Mutex
+	rand  *rand.Rand
+	stats SampleStats
+}
+
+func NewShareSampler(rate float64) *ShareSampler {
+	s := new(ShareSampler)
+	if rate > 1 {
+		rate = 1
+	}
+	s.Rate = rate
+	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return s
+}
+
+// Enabled returns if shares are sampled
+func (s *ShareSampler) Enabled() bool {
+	return s.Rate > 0
+}
+
+// Sample returns if the share should be validated. Suspect miners have
+// every share validated.
+func (s *ShareSampler) Sample(suspect bool, target uint64) bool {
+	if !s.Enabled() {
+		return false
+	}
+	if suspect {
+		return true
+	}
+	if s.Target != nil {
+		if ema := s.Target.SubmitTarget(); ema > 0 && target > ema {
+			return true
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.rand.Float64() < s.Rate
+}
+
+// record counts the result of validating a sampled share
+func (s *ShareSampler) record(valid bool) {
+	s.Lock()
+	s.stats.Sampled++
+	if !valid {
+		s.stats.Invalid++
+	}
+	s.Unlock()
+	if valid {
+		sharesSampled.WithLabelValues("valid").Inc()
+	} else {
+		sharesSampled.WithLabelValues("invalid").Inc()
+	}
+}
+
+// Stats are the pool wide sampling results since the pool started
+func (s *ShareSampler) Stats() SampleStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.stats
+}
+
+// SampleStats are the validation results of sampled shares
+type SampleStats struct {
+	Sampled uint64 // Shares validated
+	Invalid uint64 // Sampled shares that failed validation
+}
+
+// Forfeit is the credit a miner loses for a job after it was caught
+// submitting invalid work
+type Forfeit struct {
+	Shares     int
+	Difficulty float64
+}
@@ -0,0 +1,34 @@
+package stratum_test
+
+import (
+	"testing"
+
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareSampler_Sample(t *testing.T) {
+	require := require.New(t)
+	require.False(NewShareSampler(0).Sample(true, 0xffffffffffffffff), "disabled")
+
+	s := NewShareSampler(1)
+	for i := 0; i < 100; i++ {
+		require.True(s.Sample(false, 1))
+	}
+
+	s = NewShareSampler(1e-12)
+	require.True(s.Sample(true, 1), "suspects are always sampled")
+	require.False(s.Sample(false, 0xffffffffffffffff), "no submit target")
+	s.Target = fixedTarget(0xfff0000000000000)
+	require.True(s.Sample(false, 0xfff0000000000001))
+	require.False(s.Sample(false, 0xfff0000000000000))
+
+	s = NewShareSampler(0.5)
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if s.Sample(false, 1) {
+			sampled++
+		}
+	}
+	require.InDelta(500, sampled, 100)
+}
@@ -2,7 +2,9 @@ package stratum
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -19,6 +21,7 @@ import (
 	"github.com/pegnet/pegnet/modules/opr"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"go.uber.org/atomic"
 )
 
 type Server struct {
@@ -27,15 +30,49 @@ type Server struct {
 	config     *viper.Viper
 	currentJob *Job
 
+	// jobHistory is the most recent jobs, oldest first. The current job is
+	// the last job in the history.
+	jobHistory     []*Job
+	jobHistorySize int
+	jobLock        sync.RWMutex
+
+	// Shares for the previous job are accepted for jobGrace after the
+	// switch, so miners with some latency do not lose their work.
+	previousJobID int32
+	jobSwitched   time.Time
+	jobGrace      time.Duration
+
+	// nonces prevents the same share being credited twice, pool wide
+	nonces *NonceSet
+
 	// For any user authentication
 	Auth *authentication.Authenticator
+	// AuthLimiter locks out repeated failed authorizations
+	AuthLimiter *AuthLimiter
+	// Sessions keeps disconnected miners, so they can resume their session
+	Sessions *SessionStore
+	// Bans limits connections per ip, and bans misbehaving ips and users
+	Bans *BanManager
 
 	// Will assist in rejecting stale shares
 	ShareGate ShareCheck
 
+	// VarDiff controls the per miner targets
+	VarDiff *VarDiff
+	// initialTarget is given to new miners. It starts as the vardiff
+	// initial target, and a proxy moves it to the pool's target.
+	initialTarget atomic.Uint64
+
+	// Sampler picks shares to validate when not every share is validated
+	Sampler *ShareSampler
+
+	// Versions sends upgrade notices to outdated miners, and refuses them
+	Versions *VersionPolicy
+
 	configuration struct {
-		RequireAuth    bool // Require actual username from miners
-		ValidateShares bool
+		RequireAuth     bool // Require actual username from miners
+		RequirePassword bool // Require the user's password from miners
+		ValidateShares  bool
 	}
 
 	// We forward submissions to any listeners
@@ -43,6 +80,28 @@ type Server struct {
 
 	stratumPort    int
 	welcomeMessage string
+
+	// Writes to miners time out after writeTimeout. Miners that fail
+	// notifyMaxFailures notifies in a row are disconnected.
+	writeTimeout      time.Duration
+	notifyMaxFailures int
+
+	// Requests sent to miners fail if there is no response after
+	// requestTimeout
+	requestTimeout time.Duration
+
+	// tlsConfig is set if the tls listener is enabled. If tlsOnly is set,
+	// the plain listener is not started.
+	tlsConfig *tls.Config
+	tlsPort   int
+	tlsOnly   bool
+
+	// The listeners are kept so the pool can close them on shutdown
+	listenLock sync.Mutex
+	listeners  []net.Listener
+	closed     atomic.Bool
+	// sharesStopped rejects every share, while the pool shuts down
+	sharesStopped atomic.Bool
 }
 
 type ShareSubmission struct {
@@ -52,17 +111,39 @@ type ShareSubmission struct {
 	OPRHash  []byte `json:"oprhash,omitempty"` // Bytes to ensure valid oprhash
 	Nonce    []byte `json:"nonce,omitempty"`   // Bytes to ensure valid nonce
 	Target   uint64 `json:"target,omitempty"`  // Uint64 to ensure valid target
+
+	// MinerTarget is the target the pool assigned the miner when the share
+	// was accepted. Shares should be credited at this target, not the
+	// target of the hash itself.
+	MinerTarget uint64 `gorm:"-" json:"minertarget,omitempty"`
+
+	// Stale shares are for the previous job, accepted in the grace window.
+	// They are credited, but too late to submit.
+	Stale bool `gorm:"-" json:"stale,omitempty"`
+
+	// Forfeit is set when the miner was caught with invalid work. It is not
+	// a share, but the credit the miner loses for the job.
+	Forfeit *Forfeit `gorm:"-" json:"forfeit,omitempty"`
 }
 
 type Job struct {
-	JobID   int32         `json:"jobid"`
+	JobID int32 `json:"jobid"`
+	// Seq is the sub-job within the height. The pool issues sub-jobs when
+	// prices move mid-block. Shares for every sub-job of a height share the
+	// same JobID.
+	Seq     int32         `json:"seq,omitempty"`
 	OPRHash string        `json:"oprhash"`
 	OPR     opr.V2Content // This will be deprecated
 	OPRv4   opr.V4Content
 }
 
+// JobIDString is the job id sent to miners. The first job of a height is
+// just the height, and sub-jobs are 'height.seq'.
 func (j Job) JobIDString() string {
-	return fmt.Sprintf("%d", j.JobID)
+	if j.Seq == 0 {
+		return fmt.Sprintf("%d", j.JobID)
+	}
+	return fmt.Sprintf("%d.%d", j.JobID, j.Seq)
 }
 
 // JobIDFromHeight is just a standard function to get the jobid for a height.
@@ -72,21 +153,87 @@ func JobIDFromHeight(height int32) int32 {
 	return height
 }
 
+// ParseJobID parses a job id string in the form 'height' or 'height.seq'
+func ParseJobID(jobID string) (height int32, seq int32, err error) {
+	parts := strings.SplitN(jobID, ".", 2)
+	h, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad jobid height: %s", err.Error())
+	}
+	if len(parts) == 2 {
+		sq, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || sq < 0 {
+			return 0, 0, fmt.Errorf("bad jobid sequence '%s'", parts[1])
+		}
+		seq = int32(sq)
+	}
+	return int32(h), seq, nil
+}
+
 func NewServer(conf *viper.Viper) (*Server, error) {
 	s := new(Server)
 	s.config = conf
 	s.Miners = NewMinerMap()
+	s.nonces = NewNonceSet()
 
 	s.configuration.RequireAuth = conf.GetBool(config.ConfigStratumRequireAuth)
+	s.configuration.RequirePassword = conf.GetBool(config.ConfigStratumRequirePassword)
+	s.AuthLimiter = NewAuthLimiter(conf.GetInt(config.ConfigStratumAuthMaxFailures), conf.GetInt(config.ConfigStratumAuthMaxIPFailures), conf.GetDuration(config.ConfigStratumAuthLockout))
+	s.Sessions = NewSessionStore(conf.GetDuration(config.ConfigStratumSessionTTL))
 	// Stub this out so we don't get a nil dereference
 	s.ShareGate = new(AlwaysYesShareCheck)
 	s.stratumPort = conf.GetInt(config.ConfigStratumPort)
 	s.welcomeMessage = conf.GetString(config.ConfigStratumWelcomeMessage)
+	s.writeTimeout = conf.GetDuration(config.ConfigStratumWriteTimeout)
+	s.notifyMaxFailures = conf.GetInt(config.ConfigStratumNotifyMaxFailures)
+	s.requestTimeout = conf.GetDuration(config.ConfigStratumRequestTimeout)
+	s.tlsPort = conf.GetInt(config.ConfigStratumTLSPort)
+	s.tlsOnly = conf.GetBool(config.ConfigStratumTLSOnly)
+	s.jobGrace = conf.GetDuration(config.ConfigStratumPreviousJobGrace)
+	s.jobHistorySize = conf.GetInt(config.ConfigStratumJobHistory)
+	if s.jobHistorySize <= 0 {
+		s.jobHistorySize = 1
+	}
 	s.configuration.ValidateShares = conf.GetBool(config.ConfigStratumCheckAllWork)
 	if s.configuration.ValidateShares {
+		// Every share is validated, so there is nothing to sample
+		s.Sampler = NewShareSampler(0)
+	} else {
+		s.Sampler = NewShareSampler(conf.GetFloat64(config.ConfigStratumShareSampleRate))
+	}
+	if s.configuration.ValidateShares || s.Sampler.Enabled() {
 		InitLX()
 	}
 
+	var err error
+	s.VarDiff, err = NewVarDiff(conf)
+	if err != nil {
+		return nil, err
+	}
+	s.initialTarget.Store(s.VarDiff.InitialTarget)
+
+	s.Versions, err = NewVersionPolicy(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bans are in memory until a manager with a database is set
+	s.Bans, err = NewBanManager(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tlsConfig, err = NewServerTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if s.tlsOnly && s.tlsConfig == nil {
+		return nil, fmt.Errorf("stratum tlsonly is set, but no tlsport is configured")
+	}
+	if s.tlsConfig != nil && !s.tlsOnly && s.tlsPort == s.stratumPort {
+		return nil, fmt.Errorf("stratum tlsport must differ from the stratumport, or set tlsonly")
+	}
+
 	return s, nil
 }
 
@@ -98,57 +245,194 @@ func (s *Server) SetAuthenticator(auth *authentication.Authenticator) {
 	s.Auth = auth
 }
 
+func (s *Server) SetBanManager(bans *BanManager) {
+	s.Bans = bans
+}
+
+// SetSubmitTarget sets the target that shares are always validated above
+// when sampling
+func (s *Server) SetSubmitTarget(t SubmitTargeter) {
+	s.Sampler.Target = t
+}
+
 // UpdateCurrentJob sets currently-active job details on the stratum server
 // and automatically pushes a notification to all connected miners
 func (s *Server) UpdateCurrentJob(job *Job) {
+	s.jobLock.Lock()
+	// Sub-jobs of the same height still accept the older sub-job shares, so
+	// the duplicate nonces must be remembered until the height changes.
+	if s.currentJob == nil || s.currentJob.JobID != job.JobID {
+		s.nonces.Rotate()
+		if s.currentJob != nil {
+			s.previousJobID = s.currentJob.JobID
+			s.jobSwitched = time.Now()
+		}
+	}
 	s.currentJob = job
+
+	s.jobHistory = append(s.jobHistory, job)
+	// Sub-jobs of the current and previous height are always kept, as
+	// their shares can still be accepted.
+	for len(s.jobHistory) > s.jobHistorySize &&
+		s.jobHistory[0].JobID != job.JobID && s.jobHistory[0].JobID != s.previousJobID {
+		s.jobHistory = s.jobHistory[1:]
+	}
+	s.jobLock.Unlock()
+
 	s.Notify(job)
 }
 
+// InitialTarget returns the target new miners start at
+func (s *Server) InitialTarget() uint64 {
+	return s.initialTarget.Load()
+}
+
+// SetInitialTarget changes the target new miners start at. Connected miners
+// keep their targets.
+func (s *Server) SetInitialTarget(target uint64) {
+	s.initialTarget.Store(target)
+}
+
+// CurrentJob returns the job miners are notified of, or nil before the
+// first job
+func (s *Server) CurrentJob() *Job {
+	s.jobLock.RLock()
+	defer s.jobLock.RUnlock()
+	return s.currentJob
+}
+
+// GetJob returns a job from the recent job history. Nil is returned if the
+// job is unknown, or too old.
+func (s *Server) GetJob(jobID string) *Job {
+	s.jobLock.RLock()
+	defer s.jobLock.RUnlock()
+	for i := len(s.jobHistory) - 1; i >= 0; i-- {
+		if s.jobHistory[i].JobIDString() == jobID {
+			return s.jobHistory[i]
+		}
+	}
+	return nil
+}
+
+// getSubJob finds the sub-job of the height mining the oprhash
+func (s *Server) getSubJob(height int32, oprHash string) *Job {
+	s.jobLock.RLock()
+	defer s.jobLock.RUnlock()
+	for i := len(s.jobHistory) - 1; i >= 0; i-- {
+		if s.jobHistory[i].JobID == height && s.jobHistory[i].OPRHash == oprHash {
+			return s.jobHistory[i]
+		}
+	}
+	return nil
+}
+
 // Notify will notify all miners of a new block to mine
 func (s *Server) Notify(job *Job) {
-	jobReq := NotifyRequest(job.JobIDString(), job.OPRHash, "")
+	jobReq := NotifyRequest(job.JobIDString(), job.OPRHash, CleanJobs)
 	data, _ := json.Marshal(jobReq)
 	errs := s.Miners.Notify(json.RawMessage(data))
-	var _ = errs
-	// TODO: handle errs
+	for _, e := range errs {
+		miner, err := s.Miners.GetMiner(e.Session)
+		if err != nil {
+			continue // Already gone
+		}
+		s.notifyFailed(miner, e.Error)
+	}
+}
+
+// notifyFailed counts a failed notify for the miner. Miners that stay
+// unreachable are disconnected, rather than mining a stale job.
+func (s *Server) notifyFailed(miner *Miner, err error) {
+	notifyFailures.Inc()
+	miner.notifyLock.Lock()
+	miner.notifyFailures++
+	failures := miner.notifyFailures
+	miner.notifyLock.Unlock()
+
+	miner.log.WithError(err).WithField("failures", failures).Warn("failed to notify")
+	if s.notifyMaxFailures > 0 && failures >= s.notifyMaxFailures {
+		miner.log.Warn("disconnecting unreachable miner")
+		slowDisconnects.Inc()
+		s.Miners.DisconnectMiner(miner)
+	}
 }
 
 func (s *Server) Listen(ctx context.Context) {
-	host := fmt.Sprintf("0.0.0.0:%d", s.stratumPort)
-	addr, err := net.ResolveTCPAddr("tcp", host)
-	if err != nil {
-		log.WithError(err).Fatal("failed to launch stratum server")
+	var listeners []net.Listener
+	if !s.tlsOnly {
+		server, err := s.listenTCP(s.stratumPort)
+		if err != nil {
+			log.WithError(err).Fatal("failed to launch stratum server")
+		}
+		log.Printf("Stratum server listening on %s", server.Addr())
+		listeners = append(listeners, server)
 	}
 
-	server, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		log.WithError(err).Fatal("failed to launch stratum server")
+	if s.tlsConfig != nil {
+		server, err := s.listenTCP(s.tlsPort)
+		if err != nil {
+			log.WithError(err).Fatal("failed to launch stratum tls server")
+		}
+		log.Printf("Stratum tls server listening on %s", server.Addr())
+		listeners = append(listeners, tls.NewListener(server, s.tlsConfig))
 	}
 
-	// Capture a cancel and close the server
+	s.listenLock.Lock()
+	s.listeners = listeners
+	s.listenLock.Unlock()
+
+	// Capture a cancel and close the servers
 	go func() {
 		select {
 		case <-ctx.Done():
 			log.Infof("closing stratum server")
-			_ = server.Close()
+			for _, l := range listeners {
+				_ = l.Close()
+			}
 			return
 		}
 	}()
 
-	defer server.Close()
+	if s.VarDiff.Enabled {
+		go s.RetargetLoop(ctx)
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			s.accept(ctx, l)
+		}(l)
+	}
+	wg.Wait()
+}
 
-	log.Printf("Stratum server listening on %s", addr)
+func (s *Server) listenTCP(port int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return keepAliveListener{server}, nil
+}
 
+// accept hands every connection on the listener to the server until the
+// context is cancelled.
+func (s *Server) accept(ctx context.Context, server net.Listener) {
+	defer server.Close()
 	for {
-		conn, err := server.AcceptTCP()
+		conn, err := server.Accept()
 		if err != nil {
-			if ctx.Err() != nil {
+			if ctx.Err() != nil || s.closed.Load() {
 				return // Server was closed
 			}
 			continue
 		}
-		_ = conn.SetKeepAlive(true)
 		s.NewConn(conn)
 	}
 }
@@ -156,7 +440,15 @@ func (s *Server) Listen(ctx context.Context) {
 // NewConn handles all new conns from the listen. By factoring this out, we
 // can create unit tests using net.Pipe()
 func (s *Server) NewConn(conn net.Conn) {
+	if err := s.Bans.Admit(remoteHost(conn.RemoteAddr()), time.Now()); err != nil {
+		log.WithError(err).WithField("ip", conn.RemoteAddr().String()).Info("refused connection")
+		_ = conn.Close()
+		return
+	}
 	m := InitMiner(conn)
+	if s.writeTimeout > 0 {
+		m.enc = json.NewEncoder(deadlineWriter{conn: conn, timeout: s.writeTimeout})
+	}
 	go s.HandleClient(m)
 	go s.HandleBroadcasts(m)
 }
@@ -168,10 +460,19 @@ type Miner struct {
 	encSync sync.Mutex // All encodes should be synchronized
 	// TODO: Manage all miner state. Like authentication, jobs, shares, etc
 
-	preferredTarget uint64
+	// The target and vardiff state are guarded by the shareLock. The
+	// previousTarget is honored for a short time after a retarget.
+	preferredTarget     uint64
+	previousTarget      uint64
+	suggestedTarget     uint64 // Floor requested by the miner
+	lastRetarget        time.Time
+	sharesSinceRetarget int
 
 	// broadcast will broadcast any notify messages to this miner
-	broadcast chan interface{}
+	broadcast chan *broadcastMsg
+	// notifyFailures is the number of notifies in a row that failed
+	notifyFailures int
+	notifyLock     sync.Mutex
 
 	// State information
 	subscribed bool
@@ -179,16 +480,35 @@ type Miner struct {
 	ip         string
 	nonce      uint32
 	agent      string // Agent/version from subscribe
+	version    string // Version the miner reported to client.get_version
 	username   string
 	minerid    string
 	authorized bool
 
 	joined time.Time
 
-	// nonceHistory is used to prevent miners from submitting the same
-	// nonce for the same job.
-	nonceHistory map[string]struct{}
-	nonceLock    sync.RWMutex
+	// requests the pool sent the miner that are waiting on a response
+	requests *pendingRequests
+
+	// nonceLock guards the nonce, which can be changed by the pool with
+	// mining.set_nonce, and the version the miner reports
+	nonceLock sync.RWMutex
+	// nonceExtension follows the nonce in the session's nonce space. Only
+	// proxies assign one, to split their own nonce between rigs.
+	nonceExtension []byte
+
+	// Share counts for the admins, rejections are by reason. The shareLock
+	// also guards the targets.
+	accepted   uint64
+	rejections map[RejectReason]uint64
+	shareLock  sync.RWMutex
+
+	// Sampling state, also guarded by the shareLock. Credits are by job
+	// height, so they can be forfeited if the miner is caught with invalid
+	// work. Suspect miners have every share validated.
+	samples SampleStats
+	credits map[int32]*Forfeit
+	suspect bool
 }
 
 // InitMiner starts a new miner with the needed encoders and channels set up
@@ -200,36 +520,143 @@ func InitMiner(conn net.Conn) *Miner {
 	m.log = log.WithFields(log.Fields{"ip": m.conn.RemoteAddr().String()})
 	// To push the encoding time to the individual threads, rather than
 	// the looping over all miners
-	m.broadcast = make(chan interface{}, 2)
-	m.nonceHistory = make(map[string]struct{})
+	m.broadcast = make(chan *broadcastMsg, 2)
+	m.rejections = make(map[RejectReason]uint64)
+	m.credits = make(map[int32]*Forfeit)
+	m.requests = newPendingRequests()
 
 	return m
 }
 
-func (m *Miner) NewNonce(nonce string) bool {
+// Nonce is the session's assigned nonce, which prefixes all of its shares
+func (m *Miner) Nonce() uint32 {
+	m.nonceLock.RLock()
+	defer m.nonceLock.RUnlock()
+	return m.nonce
+}
+
+func (m *Miner) setNonce(nonce uint32) {
 	m.nonceLock.Lock()
-	_, ok := m.nonceHistory[nonce]
-	if !ok {
-		m.nonceHistory[nonce] = struct{}{}
-	}
+	m.nonce = nonce
 	m.nonceLock.Unlock()
-	return ok
 }
 
-func (m *Miner) ResetNonceHistory() {
+// Version is the version the miner last reported to client.get_version
+func (m *Miner) Version() string {
+	m.nonceLock.RLock()
+	defer m.nonceLock.RUnlock()
+	return m.version
+}
+
+func (m *Miner) setVersion(version string) {
+	m.nonceLock.Lock()
+	m.version = version
+	m.nonceLock.Unlock()
+}
+
+// NonceExtension is the session's assigned nonce extension, if it has one
+func (m *Miner) NonceExtension() []byte {
+	m.nonceLock.RLock()
+	defer m.nonceLock.RUnlock()
+	return m.nonceExtension
+}
+
+func (m *Miner) setNonceExtension(extension []byte) {
 	m.nonceLock.Lock()
-	m.nonceHistory = make(map[string]struct{})
+	m.nonceExtension = extension
 	m.nonceLock.Unlock()
 }
 
+// HasNoncePrefix returns if the nonce is in the session's nonce space
+func (m *Miner) HasNoncePrefix(nonce []byte) bool {
+	m.nonceLock.RLock()
+	prefix := append(NoncePrefix(m.nonce), m.nonceExtension...)
+	m.nonceLock.RUnlock()
+	return bytes.HasPrefix(nonce, prefix)
+}
+
+// countShare counts an accepted share, or a rejection by its reason
+func (m *Miner) countShare(reason RejectReason) {
+	m.shareLock.Lock()
+	if reason == ShareAccepted {
+		m.accepted++
+	} else {
+		m.rejections[reason]++
+	}
+	m.shareLock.Unlock()
+}
+
+// Rejections returns the miner's rejected share count by reason name
+func (m *Miner) Rejections() map[string]uint64 {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	rejections := make(map[string]uint64, len(m.rejections))
+	for reason, count := range m.rejections {
+		rejections[reason.String()] = count
+	}
+	return rejections
+}
+
+// credit records the credit for an accepted share. Only the current and
+// previous job are kept, as older jobs are paid out.
+func (m *Miner) credit(height int32, minerTarget uint64) {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	c, ok := m.credits[height]
+	if !ok {
+		c = new(Forfeit)
+		m.credits[height] = c
+		for h := range m.credits {
+			if h < height-1 {
+				delete(m.credits, h)
+			}
+		}
+	}
+	c.Shares++
+	c.Difficulty += difficulty.DifficultyFromTarget(minerTarget, difficulty.PDiff)
+}
+
+// forfeit marks the miner as suspect, and returns the credit it loses for
+// the job
+func (m *Miner) forfeit(height int32) Forfeit {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	m.suspect = true
+	var f Forfeit
+	if c, ok := m.credits[height]; ok {
+		f = *c
+		delete(m.credits, height)
+	}
+	return f
+}
+
+// countSample counts the result of validating a sampled share
+func (m *Miner) countSample(valid bool) {
+	m.shareLock.Lock()
+	m.samples.Sampled++
+	if !valid {
+		m.samples.Invalid++
+	}
+	m.shareLock.Unlock()
+}
+
+// Suspect returns if the miner was caught with invalid work, and has every
+// share validated
+func (m *Miner) Suspect() bool {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	return m.suspect
+}
+
 // Close shuts down miner's broadcast channel
 func (m *Miner) Close() {
 	close(m.broadcast)
+	m.requests.drop()
 }
 
 // ToString returns a string representation of the internal miner client state
 func (m *Miner) ToString() string {
-	return fmt.Sprintf("Session ID: %s\nIP: %s\nAgent: %s\nPreferred Target: %d\nSubscribed: %t\nAuthorized: %t\nNonce: %d", m.sessionID, m.conn.RemoteAddr().String(), m.agent, m.preferredTarget, m.subscribed, m.authorized, m.nonce)
+	return fmt.Sprintf("Session ID: %s\nIP: %s\nAgent: %s\nPreferred Target: %d\nSubscribed: %t\nAuthorized: %t\nNonce: %d", m.sessionID, m.conn.RemoteAddr().String(), m.agent, m.PreferredTarget(), m.subscribed, m.authorized, m.Nonce())
 }
 
 // Broadcast should accept the already json marshalled msg
@@ -241,41 +668,95 @@ func (m *Miner) Broadcast(msg json.RawMessage) (err error) {
 			err = fmt.Errorf("miner was closed")
 		}
 	}()
+	b := &broadcastMsg{msg: msg, sent: time.Now()}
 	select {
-	case m.broadcast <- msg:
+	case m.broadcast <- b:
 		return nil
+	default:
+	}
+
+	// The miner is behind. Every broadcast is a job, and only the latest
+	// matters, so the queued jobs are dropped and the latest is retried.
+	for {
+		select {
+		case <-m.broadcast:
+			continue
+		default:
+		}
+		break
+	}
+	select {
+	case m.broadcast <- b:
+		return fmt.Errorf("miner was behind, dropped older jobs")
 	default:
 		return fmt.Errorf("channel full")
 	}
 }
 
+// broadcastMsg is a message to send to a miner, and when it was sent
+type broadcastMsg struct {
+	msg  json.RawMessage
+	sent time.Time
+}
+
+// deadlineWriter sets a write deadline before every write, so a miner that
+// stopped reading cannot block the server forever.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	_ = w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
 // HandleBroadcasts will send out all pool broadcast messages to the miners.
 // This handles all notify messages
 func (s *Server) HandleBroadcasts(client *Miner) {
 	for {
 		select {
-		case msg, ok := <-client.broadcast:
+		case b, ok := <-client.broadcast:
 			if !ok {
 				return
 			}
 			client.encSync.Lock()
-			err := client.enc.Encode(msg)
+			err := client.enc.Encode(b.msg)
 			client.encSync.Unlock()
 			if err == io.EOF {
 				client.log.Infof("client disconnected")
 				return
 			}
 			if err != nil {
-				client.log.WithError(err).Warn("failed to notify")
+				s.notifyFailed(client, err)
+				continue
 			}
+			broadcastLatency.Observe(time.Since(b.sent).Seconds())
+			client.notifyLock.Lock()
+			client.notifyFailures = 0
+			client.notifyLock.Unlock()
 		}
 	}
 }
 
 func (s *Server) HandleClient(client *Miner) {
 	// Register this new miner
-	s.Miners.AddMiner(client)
-	defer s.Miners.DisconnectMiner(client)
+	_, err := s.Miners.AddMiner(client)
+	defer func() {
+		s.Miners.DisconnectMiner(client)
+		client.Close() // Stops the broadcasts
+		s.Bans.Release(remoteHost(client.conn.RemoteAddr()))
+		s.Sessions.Save(client, time.Now())
+	}()
+	if err != nil {
+		client.log.WithError(err).Warn("refused connection")
+		return
+	}
+
+	// Messages are counted each second, and every message over the limit
+	// is an offense.
+	var window time.Time
+	var messages int
 
 	reader := bufio.NewReader(client.conn)
 	for {
@@ -292,17 +773,56 @@ func (s *Server) HandleClient(client *Miner) {
 			break
 		}
 
+		if limit := s.Bans.MaxMessagesPerSecond; limit > 0 {
+			now := time.Now()
+			if now.Sub(window) >= time.Second {
+				window, messages = now, 0
+			}
+			messages++
+			if messages > limit {
+				s.punish(client, OffenseFlood)
+			}
+		}
+
 		client.encSync.Lock()
 		s.HandleMessage(client, data)
 		client.encSync.Unlock()
 	}
 }
 
+// punish scores the offense against the miner's ip and username, and
+// disconnects everyone under a new ban.
+func (s *Server) punish(client *Miner, o Offense) {
+	ban := s.Bans.Punish(remoteHost(client.conn.RemoteAddr()), client.username, o, time.Now())
+	if ban != nil {
+		s.DisconnectSubject(ban.Subject)
+	}
+}
+
+// DisconnectSubject disconnects every miner under the ban subject, and
+// returns how many were disconnected.
+func (s *Server) DisconnectSubject(subject string) int {
+	var count int
+	for _, session := range s.Miners.ListMiners() {
+		miner, err := s.Miners.GetMiner(session)
+		if err != nil {
+			continue
+		}
+		if IPSubject(remoteHost(miner.conn.RemoteAddr())) == subject || UserSubject(miner.username) == subject {
+			miner.log.WithField("subject", subject).Warn("disconnecting banned miner")
+			s.Miners.DisconnectMiner(miner)
+			count++
+		}
+	}
+	return count
+}
+
 func (s *Server) HandleMessage(client *Miner, data []byte) {
 	var u UnknownRPC
 	err := json.Unmarshal(data, &u)
 	if err != nil {
 		client.log.WithError(err).Warnf("client read failed")
+		s.punish(client, OffenseMalformed)
 	}
 
 	if u.IsRequest() {
@@ -310,18 +830,60 @@ func (s *Server) HandleMessage(client *Miner, data []byte) {
 		s.HandleRequest(client, req)
 	} else {
 		resp := u.GetResponse()
-		// TODO: Handle resp
-		var _ = resp
+		if !client.requests.respond(resp) {
+			client.log.WithField("id", resp.ID).Debug("response to an unknown request")
+		}
 	}
 
 	//client.log.Infof(string(data))
 }
 
+// authorize checks the miner is allowed to mine for the user. New users are
+// registered if they provide a password, invite code, and payout address.
+// Existing users are checked against their password.
+func (s *Server) authorize(client *Miner, username string, params RPCParams) error {
+	addr := client.conn.RemoteAddr()
+	if s.AuthLimiter.Locked(addr, username, time.Now()) {
+		return fmt.Errorf("too many failed attempts, try again later")
+	}
+
+	var password string
+	if len(params) >= 2 {
+		password = params[1]
+	}
+
+	var err error
+	register := !s.Auth.Exists(username)
+	if register {
+		// Did they provide a password, code, and payout addr?
+		if len(params) < 4 || !s.Auth.RegisterUser(username, params[1], params[2], params[3]) {
+			err = fmt.Errorf("unknown user, and registration failed")
+		}
+	} else if password != "" {
+		if !s.Auth.CheckPassword(username, password) {
+			err = fmt.Errorf("invalid password")
+		}
+	} else if s.configuration.RequirePassword || s.Auth.StratumPasswordRequired(username) {
+		err = fmt.Errorf("password required")
+	}
+
+	if err != nil {
+		if s.AuthLimiter.Fail(addr, username, register, time.Now()) {
+			client.log.Warnf("locked out for %s after repeated failures", s.AuthLimiter.Lockout)
+		}
+		return err
+	}
+
+	s.AuthLimiter.Success(addr, username)
+	return nil
+}
+
 func (s *Server) HandleRequest(client *Miner, req Request) {
 	var params RPCParams
 	if err := req.FitParams(&params); err != nil {
 		client.log.WithField("method", req.Method).Warnf("bad params %s", req.Method)
 		_ = client.enc.Encode(QuickRPCError(req.ID, ErrorInvalidParams))
+		s.punish(client, OffenseMalformed)
 		return
 	}
 
@@ -339,32 +901,39 @@ func (s *Server) HandleRequest(client *Miner, req Request) {
 			return
 		}
 
-		client.username = arr[0]
-		client.minerid = arr[1]
-		client.log = client.log.WithFields(log.Fields{"minerid": client.minerid, "username": client.username})
+		// The miner keeps its identity until the new one is authorized, so a
+		// failed authorize cannot take over another user
+		username, minerid := arr[0], arr[1]
+		attempt := client.log.WithFields(log.Fields{"minerid": minerid, "username": username})
+
+		if ban := s.Bans.Banned(remoteHost(client.conn.RemoteAddr()), username, time.Now()); ban != nil {
+			attempt.WithField("subject", ban.Subject).Warn("banned miner tried to authorize")
+			client.authorized = false
+			_ = client.enc.Encode(AuthorizeResponse(req.ID, fmt.Errorf("banned until %s", ban.Until.Format(time.RFC3339))))
+			s.Miners.DisconnectMiner(client)
+			return
+		}
 
 		if s.Auth != nil && s.configuration.RequireAuth {
-			if !s.Auth.Exists(client.username) {
-				// Did they provide a password, code, and payout addr?
-				if len(params) >= 4 && s.Auth.RegisterUser(client.username, params[1], params[2], params[3]) {
-					// User registered! Let them through by falling out of this if statement
-				} else {
-					// User rejected
-					// TODO: Provide a reason?
-					// TODO: Disconnect them?
-					if err := client.enc.Encode(AuthorizeResponse(req.ID, false, nil)); err != nil {
-						client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
-					}
-					return
+			if err := s.authorize(client, username, params); err != nil {
+				attempt.WithError(err).Warn("miner failed to authorize")
+				client.authorized = false
+				if err := client.enc.Encode(AuthorizeResponse(req.ID, err)); err != nil {
+					client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
 				}
+				return
 			}
 		}
 
-		if err := client.enc.Encode(AuthorizeResponse(req.ID, true, nil)); err != nil {
+		client.username = username
+		client.minerid = minerid
+		client.log = attempt
+
+		if err := client.enc.Encode(AuthorizeResponse(req.ID, nil)); err != nil {
 			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
 		} else {
 			client.authorized = true
-			s.ShowMessage(client.sessionID, s.welcomeMessage)
+			_ = client.enc.Encode(ShowMessageRequest(s.welcomeMessage))
 		}
 	case "mining.get_oprhash":
 		if len(params) < 1 {
@@ -372,10 +941,37 @@ func (s *Server) HandleRequest(client *Miner, req Request) {
 			return
 		}
 
-		// TODO: actually retrieve OPR hash for the given jobID (for now using dummy data)
-		dummyOPRHash := "00011111af870a1f49129f9c82d935665d352fffffea3296208f6f7b16faaabc"
+		job := s.GetJob(params[0])
+		if job == nil {
+			_ = client.enc.Encode(HelpfulRPCError(req.ID, ErrorJobNotFound, fmt.Sprintf("job %s is unknown or too old", params[0])))
+			return
+		}
+
+		if err := client.enc.Encode(GetOPRHashResponse(req.ID, job.OPRHash)); err != nil {
+			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
+		}
+	case "mining.get_opr":
+		if len(params) < 1 {
+			_ = client.enc.Encode(QuickRPCError(req.ID, ErrorInvalidParams))
+			return
+		}
+
+		job := s.GetJob(params[0])
+		if job == nil {
+			_ = client.enc.Encode(HelpfulRPCError(req.ID, ErrorJobNotFound, fmt.Sprintf("job %s is unknown or too old", params[0])))
+			return
+		}
+
+		// The oprhash is the sha256 of these bytes, so miners can verify
+		// the record they are mining.
+		data, err := job.OPRv4.Marshal()
+		if err != nil {
+			client.log.WithField("method", req.Method).WithError(err).Error("failed to marshal opr")
+			_ = client.enc.Encode(QuickRPCError(req.ID, ErrorInternalError))
+			return
+		}
 
-		if err := client.enc.Encode(GetOPRHashResponse(req.ID, dummyOPRHash)); err != nil {
+		if err := client.enc.Encode(GetOPRResponse(req.ID, hex.EncodeToString(data))); err != nil {
 			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
 		}
 	case "mining.submit":
@@ -390,14 +986,14 @@ func (s *Server) HandleRequest(client *Miner, req Request) {
 			return
 		}
 
-		if !s.ProcessSubmission(client, params[1], params[2], params[3], params[4]) {
+		if reason := s.ProcessSubmission(client, params[1], params[2], params[3], params[4]); reason != ShareAccepted {
 			// Rejected share
 			// ignore errors on reject shares
-			_ = client.enc.Encode(SubmitResponse(req.ID, false, nil))
+			_ = client.enc.Encode(SubmitResponse(req.ID, reason))
 			return
 		}
 
-		if err := client.enc.Encode(SubmitResponse(req.ID, true, nil)); err != nil {
+		if err := client.enc.Encode(SubmitResponse(req.ID, ShareAccepted)); err != nil {
 			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
 		}
 	case "mining.subscribe":
@@ -405,23 +1001,52 @@ func (s *Server) HandleRequest(client *Miner, req Request) {
 			_ = client.enc.Encode(QuickRPCError(req.ID, ErrorInvalidParams))
 			return
 		}
-		// Ignore the session id if provided in the params
+		// "params": ["user-agent/version", "sessionID"]
 		client.agent = params[0]
+		if s.Versions.Outdated(client.agent) {
+			now := time.Now()
+			_ = client.enc.Encode(ShowMessageRequest(s.Versions.Notice(client.agent, now)))
+			if s.Versions.Refused(client.agent, now) {
+				outdatedMiners.WithLabelValues("refused").Inc()
+				client.log.WithField("agent", client.agent).Info("refused outdated miner")
+				_ = client.enc.Encode(HelpfulRPCError(req.ID, ErrorOutdatedMiner, fmt.Sprintf("minimum version is %s", s.Versions.Minimum)))
+				s.Miners.DisconnectMiner(client)
+				return
+			}
+			outdatedMiners.WithLabelValues("notified").Inc()
+		}
+		resumed := len(params) >= 2 && s.Sessions.Resume(client, params[1], s.Bans, time.Now())
+		if resumed {
+			s.Miners.MoveMiner(client, params[1])
+			client.log = client.log.WithFields(log.Fields{"minerid": client.minerid, "username": client.username})
+			client.log.WithField("session", client.sessionID).Info("miner resumed session")
+		}
 
-		if err := client.enc.Encode(SubscribeResponse(req.ID, client.sessionID, client.nonce)); err != nil {
+		if err := client.enc.Encode(SubscribeResponse(req.ID, client.sessionID, client.Nonce())); err != nil {
 			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
 		} else {
 			client.subscribed = true
 
-			// TODO: Use vardiff
-			client.preferredTarget = difficulty.PDiff
-			err = s.SetTarget(client.sessionID, fmt.Sprintf("%x", difficulty.PDiff))
+			// The subscription can only carry the nonce
+			if extension := client.NonceExtension(); len(extension) > 0 {
+				if err := client.enc.Encode(SetNonceExtensionRequest(fmt.Sprintf("%d", client.Nonce()), extension)); err != nil {
+					client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
+				}
+			}
+
+			// A resumed session keeps its target
+			var initial uint64
+			if !resumed {
+				initial = s.InitialTarget()
+			}
+			target := client.startWindow(initial, time.Now())
+			err = client.enc.Encode(SetTargetRequest(fmt.Sprintf("%x", target)))
 			if err != nil {
 				log.WithError(err).Error("failed to set target")
 			}
 			// Notify newly-subscribed client with current job details
-			if s.currentJob != nil {
-				err = s.SingleClientNotify(client.sessionID, s.currentJob.JobIDString(), s.currentJob.OPRHash, "")
+			if job := s.CurrentJob(); job != nil {
+				err = client.enc.Encode(NotifyRequest(job.JobIDString(), job.OPRHash, CleanJobs))
 				if err != nil {
 					log.WithError(err).Error("failed to send job")
 				}
@@ -433,65 +1058,116 @@ func (s *Server) HandleRequest(client *Miner, req Request) {
 			return
 		}
 
-		// We will not accept suggested targets from miners at this time
-		//preferredTarget, err := strconv.ParseUint(params[0], 16, 64)
-		//if err == nil {
-		//	client.preferredTarget = preferredTarget
-		//}
+		suggested, err := ParseTarget(params[0], 0)
+		if err != nil || suggested == 0 {
+			_ = client.enc.Encode(HelpfulRPCError(req.ID, ErrorInvalidParams, "target must be a hex uint64"))
+			return
+		}
+
+		// Large rigs can suggest a higher target to cut down on their share
+		// count. The suggestion is kept within the pool bounds, and vardiff
+		// will not lower the miner below it.
+		target := s.VarDiff.Clamp(suggested)
+		client.suggestTarget(target, time.Now())
+
+		if err := client.enc.Encode(SuggestTargetResponse(req.ID, true)); err != nil {
+			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
+			return
+		}
+
+		if err := client.enc.Encode(SetTargetRequest(fmt.Sprintf("%x", target))); err != nil {
+			client.log.WithField("method", req.Method).WithError(err).Error("failed to send message")
+		}
 	default:
 		client.log.Warnf("unknown method %s", req.Method)
 		_ = client.enc.Encode(QuickRPCError(req.ID, ErrorMethodNotFound))
 	}
 }
 
-// ProcessSubmission will forward the shares and return if the share was accepted
-func (s *Server) ProcessSubmission(miner *Miner, jobID, nonce, oprHash, target string) bool {
+// ProcessSubmission will forward the shares and return ShareAccepted, or
+// why the share was rejected.
+func (s *Server) ProcessSubmission(miner *Miner, jobID, nonce, oprHash, target string) RejectReason {
 	sLog := log.WithFields(log.Fields{"user": miner.username, "miner": miner.minerid, "job": jobID})
-	if s.currentJob == nil {
-		return false // No current job
+	reject := func(reason RejectReason) RejectReason {
+		sharesRejected.WithLabelValues(reason.String()).Inc()
+		miner.countShare(reason)
+		switch reason {
+		case RejectInvalidWork:
+			s.punish(miner, OffenseInvalidWork)
+		case RejectMalformed, RejectNoncePrefix:
+			s.punish(miner, OffenseMalformed)
+		}
+		return reason
+	}
+	if s.sharesStopped.Load() {
+		return reject(RejectShutdown)
 	}
 
-	if jobID != s.currentJob.JobIDString() || oprHash != s.currentJob.OPRHash {
-		return false // Only accepts current job
+	// Shares for any sub-job of the current height are accepted. Miners
+	// can submit a share for the previous sub-job under the new job id if
+	// it was found as the notify arrived, so the oprhash picks the sub-job.
+	height, _, err := ParseJobID(jobID)
+	if err != nil {
+		return reject(RejectMalformed)
+	}
+	stale, ok := s.acceptsJob(height, time.Now())
+	if !ok {
+		return reject(RejectStale) // Only accepts current job, or the previous in the grace, if there is one
+	}
+	job := s.getSubJob(height, oprHash)
+	if job == nil {
+		return reject(RejectWrongOPRHash)
 	}
 
 	// Double check the fields
 	oB, err := hex.DecodeString(oprHash)
 	if err != nil {
 		sLog.WithError(err).Errorf("miner provided bad oprhash")
-		return false
+		return reject(RejectMalformed)
 	}
 
 	nB, err := hex.DecodeString(nonce)
 	if err != nil {
 		sLog.WithError(err).Errorf("miner provided bad nonce")
-		return false
+		return reject(RejectMalformed)
 	}
 
 	tU, err := strconv.ParseUint(target, 16, 64)
 	if err != nil {
 		sLog.WithError(err).Errorf("miner provided bad target")
-		return false
+		return reject(RejectMalformed)
 	}
 
-	if tU < miner.preferredTarget {
-		return false
+	minerTarget := miner.acceptedTarget(tU, time.Now())
+	if minerTarget == 0 {
+		return reject(RejectLowTarget)
 	}
 
-	// Check if this is a duplicate nonce
-	if miner.NewNonce(nonce) {
-		return false
+	// Miners must search their own nonce space, so sessions can not
+	// submit each other's work.
+	if !miner.HasNoncePrefix(nB) {
+		return reject(RejectNoncePrefix)
 	}
 
-	jobHeight, err := strconv.ParseInt(jobID, 10, 32)
-	if err != nil {
-		sLog.WithError(err).Errorf("miner provided bad jobid")
-		return false
+	// Check if this is a duplicate nonce. The same nonce is new work on
+	// a different sub-job. The share is only recorded once it is accepted,
+	// so a share rejected for another reason can be submitted again.
+	if s.nonces.Seen(oB, nB) {
+		return reject(RejectDuplicate)
 	}
 
 	if s.configuration.ValidateShares {
 		if !Validate(oB, nB, tU) {
-			return false // Submitted a bad share
+			return reject(RejectInvalidWork) // Submitted a bad share
+		}
+	} else if s.Sampler.Sample(miner.Suspect(), tU) {
+		valid := Validate(oB, nB, tU)
+		s.Sampler.record(valid)
+		miner.countSample(valid)
+		if !valid {
+			// Unvalidated shares for the job could be fake too
+			s.forfeit(miner, height)
+			return reject(RejectInvalidWork)
 		}
 	}
 
@@ -499,18 +1175,48 @@ func (s *Server) ProcessSubmission(miner *Miner, jobID, nonce, oprHash, target s
 	// E.g: If we are between minute 0 and minute 1, the job is
 	// stale
 	if !s.ShareGate.CanSubmit() {
-		return false
+		return reject(RejectGate)
+	}
+
+	// Another session can submit the same share at the same time, only
+	// one of them is accepted
+	if s.nonces.Add(oB, nB) {
+		return reject(RejectDuplicate)
 	}
 
 	submit := &ShareSubmission{
 		Username: miner.username,
 		MinerID:  miner.minerid,
-		JobID:    int32(jobHeight),
+		JobID:    job.JobID,
 		OPRHash:  oB,
 		Nonce:    nB,
 		Target:   tU,
+
+		MinerTarget: minerTarget,
+		Stale:       stale,
+	}
+
+	s.export(submit, sLog)
+
+	sharesAccepted.Inc()
+	if stale {
+		sharesGrace.Inc()
+	}
+
+	miner.countShare(ShareAccepted)
+	if s.Sampler.Enabled() {
+		miner.credit(height, minerTarget)
 	}
+	miner.countWindowShare()
+	if s.VarDiff.Enabled {
+		s.checkRetarget(miner, time.Now())
+	}
+
+	return ShareAccepted
+}
 
+// export forwards the submission to the listeners
+func (s *Server) export(submit *ShareSubmission, sLog *log.Entry) {
 	for _, export := range s.submissionExports {
 		select { // Non blocking
 		case export <- submit:
@@ -518,17 +1224,144 @@ func (s *Server) ProcessSubmission(miner *Miner, jobID, nonce, oprHash, target s
 			sLog.Warnf("failed to export share")
 		}
 	}
+}
+
+// forfeit takes back the miner's credit for the job, after a sampled share
+// was invalid. The miner has every share validated from now on.
+func (s *Server) forfeit(miner *Miner, height int32) {
+	f := miner.forfeit(height)
+	miner.log.WithFields(log.Fields{"job": height, "shares": f.Shares}).Warn("miner caught with invalid work, forfeiting job credit")
+	if f.Shares == 0 {
+		return
+	}
+	sharesForfeited.Add(float64(f.Shares))
+	s.export(&ShareSubmission{
+		Username: miner.username,
+		MinerID:  miner.minerid,
+		JobID:    height,
+		Forfeit:  &f,
+	}, miner.log)
+}
 
-	return true
+// acceptsJob returns if shares for the height are accepted. Stale is true
+// for shares on the previous job inside the grace window. Nothing is
+// accepted before the first job.
+func (s *Server) acceptsJob(height int32, now time.Time) (stale bool, ok bool) {
+	s.jobLock.RLock()
+	defer s.jobLock.RUnlock()
+	if s.currentJob == nil {
+		return false, false
+	}
+	if height == s.currentJob.JobID {
+		return false, true
+	}
+	if s.jobGrace > 0 && height == s.previousJobID && now.Sub(s.jobSwitched) < s.jobGrace {
+		return true, true
+	}
+	return false, false
 }
 
+// RetargetLoop will periodically retarget all miners. Miners that submit
+// shares are retargeted as their shares come in, but miners that stop
+// submitting need their target eased from here.
+func (s *Server) RetargetLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.VarDiff.RetargetInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, session := range s.Miners.ListMiners() {
+			miner, err := s.Miners.GetMiner(session)
+			if err != nil {
+				continue // Miner disconnected
+			}
+			miner.encSync.Lock()
+			if miner.subscribed {
+				s.checkRetarget(miner, time.Now())
+			}
+			miner.encSync.Unlock()
+		}
+	}
+}
+
+// checkRetarget will retarget the miner if their vardiff window is complete.
+// The caller must hold the miner's encSync lock.
+func (s *Server) checkRetarget(miner *Miner, now time.Time) {
+	current, started, shares := miner.window()
+	elapsed := now.Sub(started)
+	if elapsed < s.VarDiff.RetargetInterval {
+		return
+	}
+
+	target, change := s.VarDiff.Retarget(current, shares, elapsed)
+	if _, suggested := miner.targets(); target < suggested {
+		// Never go below what the miner asked for
+		target = suggested
+		change = target != current
+	}
+	if !change {
+		miner.startWindow(0, now)
+		return
+	}
+
+	miner.log.WithFields(log.Fields{"old": fmt.Sprintf("%x", current), "new": fmt.Sprintf("%x", target), "shares": shares}).Debugf("vardiff retarget")
+	miner.retarget(target, now)
+	if err := miner.enc.Encode(SetTargetRequest(fmt.Sprintf("%x", target))); err != nil {
+		miner.log.WithError(err).Warn("failed to set target")
+	}
+}
+
+// send encodes a message to the miner. It must not be called while holding
+// the miner's encSync lock, like from the message handlers.
+func (m *Miner) send(x interface{}) error {
+	m.encSync.Lock()
+	defer m.encSync.Unlock()
+	return m.enc.Encode(x)
+}
+
+// SendRequest sends the request to the miner, and calls the handler with the
+// miner's response, or an error if the miner does not respond in time.
+func (s *Server) SendRequest(miner *Miner, req Request, handler ResponseHandler) error {
+	miner.requests.add(req.ID, s.requestTimeout, handler)
+	err := miner.send(req)
+	if err != nil {
+		miner.requests.take(req.ID)
+	}
+	return err
+}
+
+// GetVersion asks the miner for its version. The version is kept on the
+// miner, and shows in its snapshot.
 func (s *Server) GetVersion(clientName string) error {
 	miner, err := s.Miners.GetMiner(clientName)
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(GetVersionRequest())
-	return err
+	return s.SendRequest(miner, GetVersionRequest(), func(resp Response, err error) {
+		if err == nil && resp.Error != nil {
+			err = fmt.Errorf("%s: %v", resp.Error.Message, resp.Error.Data)
+		}
+		// The version is a string, or a [name, version] pair
+		var version string
+		if err == nil {
+			var pair []string
+			if resp.FitResult(&pair) == nil {
+				version = strings.Join(pair, "/")
+			} else {
+				err = resp.FitResult(&version)
+			}
+		}
+		if err != nil {
+			miner.log.WithError(err).Warn("failed to get version")
+			return
+		}
+		miner.setVersion(version)
+		miner.log.WithField("version", version).Info("miner version")
+	})
 }
 
 func (s *Server) SingleClientNotify(clientName, jobID, oprHash, cleanjobs string) error {
@@ -536,7 +1369,7 @@ func (s *Server) SingleClientNotify(clientName, jobID, oprHash, cleanjobs string
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(NotifyRequest(jobID, oprHash, cleanjobs))
+	err = miner.send(NotifyRequest(jobID, oprHash, cleanjobs))
 	return err
 }
 
@@ -545,7 +1378,7 @@ func (s *Server) ReconnectClient(clientName, hostname, port, waittime string) er
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(ReconnectRequest(hostname, port, waittime))
+	err = miner.send(ReconnectRequest(hostname, port, waittime))
 	return err
 }
 
@@ -554,16 +1387,23 @@ func (s *Server) SetTarget(clientName, target string) error {
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(SetTargetRequest(target))
+	err = miner.send(SetTargetRequest(target))
 	return err
 }
 
+// SetNonce assigns the miner a new nonce space. The nonce is in decimal. Shares
+// must have the new prefix once it is sent.
 func (s *Server) SetNonce(clientName, nonce string) error {
 	miner, err := s.Miners.GetMiner(clientName)
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(SetNonceRequest(nonce))
+	n, err := strconv.ParseUint(nonce, 10, 32)
+	if err != nil {
+		return fmt.Errorf("nonce must be a decimal uint32: %s", err.Error())
+	}
+	miner.setNonce(uint32(n))
+	err = miner.send(SetNonceRequest(nonce))
 	return err
 }
 
@@ -572,7 +1412,7 @@ func (s *Server) ShowMessage(clientName, message string) error {
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(ShowMessageRequest(message))
+	err = miner.send(ShowMessageRequest(message))
 	return err
 }
 
@@ -581,7 +1421,7 @@ func (s *Server) StopMining(clientName string) error {
 	if err != nil {
 		return err
 	}
-	err = miner.enc.Encode(StopMiningRequest())
+	err = miner.send(StopMiningRequest())
 	return err
 }
 
@@ -3,12 +3,20 @@ package stratum_test
 import (
 	"bufio"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/FactomWyomingEntity/prosper-pool/authentication"
+	"github.com/FactomWyomingEntity/prosper-pool/config"
 	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 )
@@ -61,6 +69,69 @@ func TestServer_GetVersion(t *testing.T) {
 		err := s.GetVersion(k)
 		require.NoError(err)
 	}
+
+	// The reply is kept on the miner
+	require.Eventually(func() bool {
+		snaps := s.MinersSnapShot()
+		return len(snaps) == 1 && snaps[0].Version == "0.0.1"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_RequestTimeout(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumRequestTimeout, 200*time.Millisecond)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	srv, cli := net.Pipe()
+	s.NewConn(srv)
+	lines := readLines(cli)
+	for s.Miners.Len() == 0 {
+		time.Sleep(20 * time.Millisecond)
+	}
+	m, err := s.Miners.GetMiner(s.Miners.ListMiners()[0])
+	require.NoError(err)
+
+	results := make(chan error, 2)
+	handler := func(resp Response, err error) { results <- err }
+
+	// No response
+	require.NoError(s.SendRequest(m, GetVersionRequest(), handler))
+	require.True(waitForLine(lines, `"method":"client.get_version"`))
+	require.Equal(ErrRequestTimeout, <-results)
+
+	// Answered, and a late or unknown response is ignored
+	req := GetVersionRequest()
+	require.NoError(s.SendRequest(m, req, handler))
+	require.True(waitForLine(lines, `"method":"client.get_version"`))
+	enc := json.NewEncoder(cli)
+	require.NoError(enc.Encode(GetVersionResponse(req.ID, "miner/1.0")))
+	require.NoError(<-results)
+	require.NoError(enc.Encode(GetVersionResponse(req.ID, "miner/1.0")))
+
+	// Handlers can send to the miner
+	req = GetVersionRequest()
+	require.NoError(s.SendRequest(m, req, func(resp Response, err error) {
+		results <- s.ShowMessage(s.Miners.ListMiners()[0], "thanks")
+	}))
+	require.True(waitForLine(lines, `"method":"client.get_version"`))
+	require.NoError(enc.Encode(GetVersionResponse(req.ID, "miner/1.0")))
+	require.True(waitForLine(lines, `"method":"client.show_message"`))
+	require.NoError(<-results)
+
+	// Pending requests fail when the miner disconnects
+	require.NoError(s.SendRequest(m, GetVersionRequest(), handler))
+	require.True(waitForLine(lines, `"method":"client.get_version"`))
+	require.NoError(cli.Close())
+	select {
+	case err := <-results:
+		require.Equal(ErrRequestDropped, err)
+	case <-time.After(time.Second):
+		t.Fatal("pending request was not dropped")
+	}
 }
 
 func TestServer_ReconnectClient(t *testing.T) {
@@ -133,8 +204,14 @@ func TestServer_SetNonce(t *testing.T) {
 	require.NoError(err)
 	require.False(isPrefix)
 
-	err = srv.SetNonce(srv.Miners.ListMiners()[0], "ffeabea") // 268348394 in decimal
+	err = srv.SetNonce(srv.Miners.ListMiners()[0], "268348394") // ffeabea in hex
+	require.NoError(err)
+	actualMiner, err := srv.Miners.GetMiner(srv.Miners.ListMiners()[0])
 	require.NoError(err)
+	require.Equal(uint32(268348394), actualMiner.Nonce())
+	require.True(actualMiner.HasNoncePrefix([]byte{0x0f, 0xfe, 0xab, 0xea, 0x01}))
+
+	require.Error(srv.SetNonce(srv.Miners.ListMiners()[0], "ffeabea"), "nonce is decimal")
 	// TODO: ensure client miner has updated nonce internally (once this is being done)
 }
 
@@ -157,3 +234,564 @@ func TestServer_SetTarget(t *testing.T) {
 	require.NoError(err)
 	// TODO: ensure client miner has updated target internally (once this is being done)
 }
+
+func TestServer_ConcurrentSends(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	srv, cli := net.Pipe()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+	s.NewConn(srv)
+	require.NoError(miner.Subscribe())
+	lines := readLines(cli)
+	require.True(waitForLine(lines, `"method":"mining.set_target"`))
+	session := s.Miners.ListMiners()[0]
+
+	// Admin messages race the job broadcasts, and must not interleave
+	const sends = 20
+	go func() {
+		for i := 0; i < 5; i++ {
+			s.UpdateCurrentJob(&Job{JobID: int32(i + 10), OPRHash: fmt.Sprintf("%064d", i)})
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	for i := 0; i < sends; i++ {
+		go func() { _ = s.ShowMessage(session, "message") }()
+		go func() { _ = s.SetTarget(session, "ffff000000000000") }()
+	}
+
+	var sent int
+	for sent < sends*2 {
+		select {
+		case line, ok := <-lines:
+			require.True(ok, "connection closed")
+			require.True(json.Valid([]byte(line)), line)
+			if !strings.Contains(line, `"method":"mining.notify"`) {
+				sent++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of %d messages arrived", sent, sends*2)
+		}
+	}
+}
+
+func TestServer_GetJob(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	conf.Set(config.ConfigStratumJobHistory, 3)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	for i := int32(1); i <= 5; i++ {
+		s.UpdateCurrentJob(&Job{JobID: i, OPRHash: fmt.Sprintf("%064d", i)})
+	}
+
+	// Only the last 3 jobs are kept
+	require.Nil(s.GetJob("1"))
+	require.Nil(s.GetJob("2"))
+	for i := 3; i <= 5; i++ {
+		job := s.GetJob(fmt.Sprintf("%d", i))
+		require.NotNil(job)
+		require.Equal(fmt.Sprintf("%064d", i), job.OPRHash)
+	}
+}
+
+func TestServer_Authorize(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumAuthMaxFailures, 3)
+	conf.Set(config.ConfigStratumAuthMaxIPFailures, 8)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	auth, err := authentication.NewAuthenticator(conf, db)
+	require.NoError(err)
+	require.NoError(auth.NewCode("code"))
+	require.True(auth.RegisterUser("user", "secret", "code", "FA2jK2HcLnRdS94dEcU27rF3meoJfpUcZPSinpb7AwQvPRY6RL1Q"))
+	s.SetAuthenticator(auth)
+
+	authorize := func(username, password string) Response {
+		srv, cli := net.Pipe()
+		defer cli.Close()
+		miner, err := NewClient(username, "miner", password, "", "", "0.0.1")
+		require.NoError(err)
+		miner.InitConn(cli)
+		s.NewConn(srv)
+
+		lines := readLines(cli)
+		require.NoError(miner.Authorize(username+",miner", password, "", ""))
+		var resp Response
+		require.NoError(json.Unmarshal([]byte(nextResponse(t, lines)), &resp))
+		return resp
+	}
+
+	// A failed authorize is an error, never a result
+	authorized := func(resp Response) bool {
+		if resp.Error != nil {
+			require.Equal(ErrorUnauthorizedWorker, resp.Error.Code)
+			require.Equal("null", string(resp.Result))
+			return false
+		}
+		var result bool
+		require.NoError(resp.FitResult(&result))
+		return result
+	}
+
+	require.True(authorized(authorize("user", "secret")))
+	// No password is fine if the user does not require one
+	require.True(authorized(authorize("user", "")))
+
+	resp := authorize("user", "wrong")
+	require.False(authorized(resp))
+	require.NotNil(resp.Error)
+	require.Equal(ErrorUnauthorizedWorker, resp.Error.Code)
+
+	require.False(authorized(authorize("unknown", "")))
+
+	// The user opts in to requiring a password
+	require.NoError(db.Model(&authentication.User{}).Where("uid = ?", "user").Update("stratum_password_required", true).Error)
+	require.False(authorized(authorize("user", "")))
+	require.True(authorized(authorize("user", "secret")))
+
+	// Repeated failures lock out even the right password
+	for i := 0; i < 3; i++ {
+		require.False(authorized(authorize("user", "wrong")))
+	}
+	resp = authorize("user", "secret")
+	require.False(authorized(resp))
+	require.Contains(resp.Error.Data, "too many")
+
+	// Spraying usernames locks out the ip, for every user
+	require.False(authorized(authorize("unknown2", "")))
+	require.False(authorized(authorize("unknown3", "")))
+	resp = authorize("unknown4", "")
+	require.False(authorized(resp))
+	require.Contains(resp.Error.Data, "too many")
+}
+
+func TestServer_ReauthorizeFailure(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+	require.NoError(err)
+	defer db.Close()
+	auth, err := authentication.NewAuthenticator(conf, db)
+	require.NoError(err)
+	for _, user := range []string{"user", "victim"} {
+		require.NoError(auth.NewCode(user))
+		require.True(auth.RegisterUser(user, "secret", user, "FA2jK2HcLnRdS94dEcU27rF3meoJfpUcZPSinpb7AwQvPRY6RL1Q"))
+	}
+	s.SetAuthenticator(auth)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	miner, err := NewClient("user", "miner", "secret", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+	s.NewConn(srv)
+	lines := readLines(cli)
+	response := func() Response {
+		var resp Response
+		require.NoError(json.Unmarshal([]byte(nextResponse(t, lines)), &resp))
+		return resp
+	}
+
+	require.NoError(miner.Authorize("user,miner", "secret", "", ""))
+	require.Nil(response().Error)
+
+	// A failed authorize as another user does not take over that user
+	require.NoError(miner.Authorize("victim,x", "wrong", "", ""))
+	require.NotNil(response().Error)
+	require.NoError(miner.Submit("victim", "10", "aa", fmt.Sprintf("%064d", 1), "ff"))
+	resp := response()
+	require.NotNil(resp.Error)
+	require.Contains(resp.Error.Data, "username not as expected")
+
+	snap := s.Miners.SnapShot()
+	require.Len(snap, 1)
+	require.Equal("user", snap[0].Username)
+	require.False(snap[0].Authorized)
+}
+
+func TestParseJobID(t *testing.T) {
+	require := require.New(t)
+
+	h, seq, err := ParseJobID("210500")
+	require.NoError(err)
+	require.Equal(int32(210500), h)
+	require.Equal(int32(0), seq)
+
+	h, seq, err = ParseJobID("210500.3")
+	require.NoError(err)
+	require.Equal(int32(210500), h)
+	require.Equal(int32(3), seq)
+	require.Equal("210500.3", Job{JobID: h, Seq: seq}.JobIDString())
+
+	for _, bad := range []string{"", "abc", "10.", "10.x", "10.-1"} {
+		_, _, err = ParseJobID(bad)
+		require.Error(err, bad)
+	}
+}
+
+// subscribedMiner returns the server side of a subscribed miner, which can
+// submit shares with ProcessSubmission.
+func subscribedMiner(t *testing.T, s *Server) *Miner {
+	require := require.New(t)
+	srv, cli := net.Pipe()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+	existing := make(map[string]bool)
+	for _, session := range s.Miners.ListMiners() {
+		existing[session] = true
+	}
+	s.NewConn(srv)
+
+	require.NoError(miner.Subscribe())
+	lines := readLines(cli)
+	require.True(waitForLine(lines, `"method":"mining.set_target"`))
+	for _, session := range s.Miners.ListMiners() {
+		if !existing[session] {
+			m, err := s.Miners.GetMiner(session)
+			require.NoError(err)
+			return m
+		}
+	}
+	t.Fatal("subscribed miner not found")
+	return nil
+}
+
+// n is the nonce in the miner's nonce space
+func n(m *Miner, suffix string) string {
+	return fmt.Sprintf("%x%s", NoncePrefix(m.Nonce()), suffix)
+}
+
+func TestServer_SubJobs(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumPreviousJobGrace, 0)
+	s, err := NewServer(conf)
+	require.NoError(err)
+	shares := s.GetSubmissionExport()
+	m := subscribedMiner(t, s)
+
+	first, second := fmt.Sprintf("%064d", 1), fmt.Sprintf("%064d", 2)
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: first})
+	s.UpdateCurrentJob(&Job{JobID: 10, Seq: 1, OPRHash: second})
+
+	target := "ffffffffffffffff"
+	// Both sub-jobs of the height are accepted, even if the share for the
+	// first arrives with the new job id.
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10.1", n(m, "aa"), second, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10.1", n(m, "aa"), first, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "bb"), first, target))
+	require.Equal(int32(10), (<-shares).JobID)
+
+	// Duplicates across sub-jobs are still rejected
+	require.Equal(RejectDuplicate, s.ProcessSubmission(m, "10", n(m, "aa"), first, target))
+	// Unknown oprhash for the height
+	require.Equal(RejectWrongOPRHash, s.ProcessSubmission(m, "10.1", n(m, "cc"), fmt.Sprintf("%064d", 3), target))
+
+	// A new height drops the old sub-jobs
+	s.UpdateCurrentJob(&Job{JobID: 11, OPRHash: fmt.Sprintf("%064d", 4)})
+	require.Equal(RejectStale, s.ProcessSubmission(m, "10.1", n(m, "dd"), second, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "11", n(m, "aa"), fmt.Sprintf("%064d", 4), target))
+}
+
+func TestServer_PreviousJobGrace(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumPreviousJobGrace, 300*time.Millisecond)
+	s, err := NewServer(conf)
+	require.NoError(err)
+	shares := s.GetSubmissionExport()
+	m := subscribedMiner(t, s)
+
+	first, second := fmt.Sprintf("%064d", 1), fmt.Sprintf("%064d", 2)
+	target := "ffffffffffffffff"
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: first})
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "aa"), first, target))
+	require.False((<-shares).Stale)
+
+	s.UpdateCurrentJob(&Job{JobID: 11, OPRHash: second})
+	// The previous job is accepted as stale, but not a duplicate
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "bb"), first, target))
+	require.True((<-shares).Stale)
+	require.Equal(RejectDuplicate, s.ProcessSubmission(m, "10", n(m, "aa"), first, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "11", n(m, "aa"), second, target))
+	require.False((<-shares).Stale)
+
+	// Once the window is over, the previous job is stale
+	time.Sleep(300 * time.Millisecond)
+	require.Equal(RejectStale, s.ProcessSubmission(m, "10", n(m, "cc"), first, target))
+
+	// Only the immediately previous job
+	s.UpdateCurrentJob(&Job{JobID: 12, OPRHash: fmt.Sprintf("%064d", 3)})
+	require.Equal(RejectStale, s.ProcessSubmission(m, "10", n(m, "dd"), first, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "11", n(m, "dd"), second, target))
+}
+
+// closedGate never accepts shares, like the pool around minute 0
+type closedGate struct{}
+
+func (closedGate) CanSubmit() bool              { return false }
+func (closedGate) CanSubmitHeight(h int32) bool { return false }
+
+func TestServer_RejectReasons(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumPreviousJobGrace, 0)
+	s, err := NewServer(conf)
+	require.NoError(err)
+	m := subscribedMiner(t, s)
+
+	first, second := fmt.Sprintf("%064d", 1), fmt.Sprintf("%064d", 2)
+	target := "ffffffffffffffff"
+	require.Equal(RejectStale, s.ProcessSubmission(m, "10", n(m, "aa"), first, target), "no job yet")
+
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: first})
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "aa"), first, target))
+	require.Equal(RejectDuplicate, s.ProcessSubmission(m, "10", n(m, "aa"), first, target))
+	require.Equal(RejectStale, s.ProcessSubmission(m, "9", n(m, "bb"), first, target))
+	require.Equal(RejectWrongOPRHash, s.ProcessSubmission(m, "10", n(m, "bb"), second, target))
+	require.Equal(RejectLowTarget, s.ProcessSubmission(m, "10", n(m, "bb"), first, "0001"))
+	require.Equal(RejectMalformed, s.ProcessSubmission(m, "ten", n(m, "bb"), first, target))
+	require.Equal(RejectMalformed, s.ProcessSubmission(m, "10", n(m, "zz"), first, target))
+	require.Equal(RejectMalformed, s.ProcessSubmission(m, "10", n(m, "bb"), first, "target"))
+
+	s.ShareGate = closedGate{}
+	require.Equal(RejectGate, s.ProcessSubmission(m, "10", n(m, "bb"), first, target))
+	// A rejected share is not a duplicate once the gate opens
+	s.ShareGate = new(AlwaysYesShareCheck)
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "bb"), first, target))
+
+	snap := m.SnapShot()
+	require.Equal(uint64(2), snap.Accepted)
+	require.Equal(map[string]uint64{
+		"stale": 2, "duplicate": 1, "oprhash": 1, "lowtarget": 1, "malformed": 3, "gate": 1,
+	}, snap.Rejections)
+
+	// The reason is sent to the miner as the error data
+	data, err := json.Marshal(SubmitResponse(1, RejectDuplicate))
+	require.NoError(err)
+	require.Contains(string(data), `"result":null`)
+	require.Contains(string(data), `"code":31`)
+	require.Contains(string(data), `"data":"duplicate"`)
+	data, err = json.Marshal(SubmitResponse(1, ShareAccepted))
+	require.NoError(err)
+	require.Contains(string(data), `"result":true`)
+	require.NotContains(string(data), `"error"`)
+}
+
+func TestServer_NoncePrefix(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	s, err := NewServer(conf)
+	require.NoError(err)
+	a, b := subscribedMiner(t, s), subscribedMiner(t, s)
+	require.NotEqual(a.Nonce(), b.Nonce())
+
+	oprHash, target := fmt.Sprintf("%064d", 1), "ffffffffffffffff"
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: oprHash})
+
+	// Shares must be in the session's own nonce space
+	require.Equal(RejectNoncePrefix, s.ProcessSubmission(a, "10", n(b, "aa"), oprHash, target))
+	require.Equal(RejectNoncePrefix, s.ProcessSubmission(a, "10", "aa", oprHash, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(a, "10", n(a, "aa"), oprHash, target))
+
+	// Duplicates are pool wide, even if another session is given the nonce
+	require.NoError(s.SetNonce(b.SnapShot().SessionID, fmt.Sprintf("%d", a.Nonce())))
+	require.Equal(RejectDuplicate, s.ProcessSubmission(b, "10", n(a, "aa"), oprHash, target))
+	// Hex case does not make it a new share
+	require.Equal(RejectDuplicate, s.ProcessSubmission(b, "10", strings.ToUpper(n(a, "aa")), oprHash, target))
+	require.Equal(ShareAccepted, s.ProcessSubmission(b, "10", n(a, "bb"), oprHash, target))
+}
+
+func TestServer_SessionResume(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumSessionTTL, time.Minute)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	// connect subscribes over a new connection, and returns the server side
+	// miner and the session and nonce it was given.
+	connect := func(session string) (net.Conn, *Miner, []Subscription) {
+		srv, cli := net.Pipe()
+		s.NewConn(srv)
+		lines := readLines(cli)
+		require.NoError(json.NewEncoder(cli).Encode(SubscribeRequest("0.0.1", session)))
+
+		var resp Response
+		require.NoError(json.Unmarshal([]byte(<-lines), &resp))
+		var subs []Subscription
+		require.NoError(resp.FitResult(&subs))
+		require.True(waitForLine(lines, `"method":"mining.set_target"`))
+		m, err := s.Miners.GetMiner(subs[0].Id)
+		require.NoError(err)
+		return cli, m, subs
+	}
+
+	cli, m, first := connect("")
+	require.NoError(json.NewEncoder(cli).Encode(AuthorizeRequest("user,miner", "", "", "")))
+	require.NoError(json.NewEncoder(cli).Encode(SuggestTargetRequest("fffff00000000000")))
+	require.Eventually(func() bool { return m.SnapShot().PrefferedTarget == 0xfffff00000000000 }, time.Second, 10*time.Millisecond)
+	require.True(m.SnapShot().Authorized)
+
+	// The session is kept once the miner disconnects
+	require.NoError(cli.Close())
+	require.Eventually(func() bool { return s.Sessions.Len() == 1 && s.Miners.Len() == 0 }, time.Second, 10*time.Millisecond)
+
+	cli, m, resumed := connect(first[0].Id)
+	require.Equal(first, resumed, "same session and nonce")
+	snap := m.SnapShot()
+	require.True(snap.Authorized)
+	require.Equal("user", snap.Username)
+	require.Equal("miner", snap.Minerid)
+	require.Equal(uint64(0xfffff00000000000), snap.PrefferedTarget)
+	require.Equal(0, s.Sessions.Len())
+
+	// A user banned after the session was saved can not resume it
+	require.NoError(cli.Close())
+	require.Eventually(func() bool { return s.Sessions.Len() == 1 }, time.Second, 10*time.Millisecond)
+	_, err = s.Bans.Ban(UserSubject("user"), time.Hour, "test", time.Now())
+	require.NoError(err)
+	cli, m, banned := connect(first[0].Id)
+	require.NotEqual(first[0].Id, banned[0].Id)
+	require.False(m.SnapShot().Authorized)
+	require.Equal(0, s.Sessions.Len())
+	require.NoError(s.Bans.Unban(UserSubject("user")))
+
+	// Sessions expire after the ttl
+	s.Sessions.TTL = 10 * time.Millisecond
+	require.NoError(cli.Close())
+	require.Eventually(func() bool { return s.Sessions.Len() == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	_, m, fresh := connect(first[0].Id)
+	require.NotEqual(first[0].Id, fresh[0].Id)
+	require.NotEqual(first[2].Id, fresh[2].Id, "new nonce")
+	require.False(m.SnapShot().Authorized)
+}
+
+func TestServer_SlowConsumer(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumWriteTimeout, 50*time.Millisecond)
+	conf.Set(config.ConfigStratumNotifyMaxFailures, 2)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	// A miner that keeps reading gets every job
+	reading := subscribedMiner(t, s)
+
+	// A miner that stops reading after subscribing
+	srv, cli := net.Pipe()
+	s.NewConn(srv)
+	go func() { _ = json.NewEncoder(cli).Encode(SubscribeRequest("0.0.1", "")) }()
+	r := bufio.NewReader(cli)
+	for { // Read until subscribed, then stop reading so writes block
+		line, _, err := r.ReadLine()
+		require.NoError(err)
+		if strings.Contains(string(line), `"method":"mining.set_target"`) {
+			break
+		}
+	}
+	require.Equal(2, s.Miners.Len())
+
+	for i := int32(1); ; i++ {
+		s.UpdateCurrentJob(&Job{JobID: i, OPRHash: fmt.Sprintf("%064d", i)})
+		if s.Miners.Len() == 1 {
+			break
+		}
+		require.True(i < 100, "stuck miner was never disconnected")
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The reading miner is still connected
+	_, err = s.Miners.GetMiner(reading.SnapShot().SessionID)
+	require.NoError(err)
+}
+
+// fixedTarget is a submit target that never moves
+type fixedTarget uint64
+
+func (f fixedTarget) SubmitTarget() uint64 { return uint64(f) }
+
+func TestServer_SampleShares(t *testing.T) {
+	require := require.New(t)
+	// A small lxrhash map, so the test does not build the full one
+	os.Setenv("LXRBITSIZE", "10")
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumShareSampleRate, 1e-12)
+	conf.Set(config.ConfigStratumVarDiff, false)
+	conf.Set(config.ConfigStratumMinimumTarget, "0000000000000001")
+	conf.Set(config.ConfigStratumInitialTarget, "0000000000000001")
+	s, err := NewServer(conf)
+	require.NoError(err)
+	ema := uint64(0xfff0000000000000)
+	s.SetSubmitTarget(fixedTarget(ema))
+	shares := s.GetSubmissionExport()
+	m := subscribedMiner(t, s)
+
+	oprHash := fmt.Sprintf("%064d", 1)
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: oprHash})
+
+	// Below the ema, the odds a share is validated are tiny
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "aa"), oprHash, "0000000000000100"))
+	require.Nil((<-shares).Forfeit)
+	require.False(m.Suspect())
+
+	// Above the ema, the share is always validated. The miner loses the
+	// credit for the job.
+	require.Equal(RejectInvalidWork, s.ProcessSubmission(m, "10", n(m, "bb"), oprHash, "ffffffffffffffff"))
+	forfeit := <-shares
+	require.Equal(int32(10), forfeit.JobID)
+	require.Equal(1, forfeit.Forfeit.Shares)
+	require.True(m.Suspect())
+
+	// Suspect miners have every share validated
+	require.Equal(RejectInvalidWork, s.ProcessSubmission(m, "10", n(m, "cc"), oprHash, "0000000000000100"))
+	oB, _ := hex.DecodeString(oprHash)
+	for i := 0; ; i++ {
+		nonce := n(m, fmt.Sprintf("%04x", i))
+		nB, _ := hex.DecodeString(nonce)
+		if target := ComputeTarget(oB, nB); target < ema {
+			require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", nonce, oprHash, fmt.Sprintf("%x", target)))
+			break
+		}
+	}
+
+	require.Equal(SampleStats{Sampled: 3, Invalid: 2}, m.SnapShot().Samples)
+	require.Equal(SampleStats{Sampled: 3, Invalid: 2}, s.SampleStats())
+}
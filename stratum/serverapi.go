@@ -8,6 +8,16 @@ func (s *Server) MinersSnapShot() []MinerSnapShot {
 	return s.Miners.SnapShot()
 }
 
+// AgentCounts is the distribution of agents among the connected miners
+func (s *Server) AgentCounts() []AgentCount {
+	return s.Versions.AgentCounts(s.MinersSnapShot())
+}
+
+// SampleStats are the pool wide results of validating sampled shares
+func (s *Server) SampleStats() SampleStats {
+	return s.Sampler.Stats()
+}
+
 type MinerSnapShot struct {
 	IP              string
 	SessionID       string
@@ -15,21 +25,34 @@ type MinerSnapShot struct {
 	Subscribed      bool
 	Nonce           uint32
 	Agent           string // Agent/version from subscribe
+	Version         string // Version reported to client.get_version
 	Username        string
 	Minerid         string
 	Authorized      bool
+	Accepted        uint64            // Accepted shares
+	Rejections      map[string]uint64 // Rejected shares by reason
+	Samples         SampleStats       // Shares validated when sampling
+	Suspect         bool              // Caught with invalid work
 }
 
 func (m *Miner) SnapShot() (snap MinerSnapShot) {
+	m.shareLock.RLock()
+	accepted, samples, suspect, target := m.accepted, m.samples, m.suspect, m.preferredTarget
+	m.shareLock.RUnlock()
 	return MinerSnapShot{
 		IP:              m.conn.RemoteAddr().String(),
 		SessionID:       m.sessionID,
-		PrefferedTarget: m.preferredTarget,
+		PrefferedTarget: target,
 		Subscribed:      m.subscribed,
-		Nonce:           m.nonce,
+		Nonce:           m.Nonce(),
 		Agent:           m.agent,
+		Version:         m.Version(),
 		Username:        m.username,
 		Minerid:         m.minerid,
 		Authorized:      m.authorized,
+		Accepted:        accepted,
+		Rejections:      m.Rejections(),
+		Samples:         samples,
+		Suspect:         suspect,
 	}
 }
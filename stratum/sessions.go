@@ -0,0 +1,119 @@
+package stratum
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// SessionStore keeps the state of recently disconnected miners, so a miner
+// that reconnects with its old session id keeps its nonce space, target and
+// authorization.
+type SessionStore struct {
+	// TTL is how long a disconnected session can be resumed. 0 disables
+	// resuming.
+	TTL time.Duration
+
+	sync.Mutex
+	sessions map[string]*savedSession
+}
+
+type savedSession struct {
+	host    string // Sessions can only be resumed from the same ip
+	expires time.Time
+
+	nonce           uint32
+	nonceExtension  []byte
+	preferredTarget uint64
+	suggestedTarget uint64
+	username        string
+	minerid         string
+	authorized      bool
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	s := new(SessionStore)
+	s.TTL = ttl
+	s.sessions = make(map[string]*savedSession)
+	return s
+}
+
+// Save keeps the disconnected miner's session until the ttl expires. Only
+// subscribed miners are kept.
+func (s *SessionStore) Save(m *Miner, now time.Time) {
+	if s.TTL <= 0 || !m.subscribed {
+		return
+	}
+
+	preferred, suggested := m.targets()
+	s.Lock()
+	defer s.Unlock()
+	s.prune(now)
+	s.sessions[m.sessionID] = &savedSession{
+		host:            remoteHost(m.conn.RemoteAddr()),
+		expires:         now.Add(s.TTL),
+		nonce:           m.Nonce(),
+		nonceExtension:  m.NonceExtension(),
+		preferredTarget: preferred,
+		suggestedTarget: suggested,
+		username:        m.username,
+		minerid:         m.minerid,
+		authorized:      m.authorized,
+	}
+}
+
+// Resume restores the saved session onto the miner, and returns true if it
+// was restored. A session can only be resumed once, and not if its ip or
+// user has been banned since it was saved. The miner must still be moved to
+// the session id in the MinerMap.
+func (s *SessionStore) Resume(m *Miner, sessionID string, bans *BanManager, now time.Time) bool {
+	if s.TTL <= 0 || sessionID == "" {
+		return false
+	}
+
+	host := remoteHost(m.conn.RemoteAddr())
+	s.Lock()
+	saved, ok := s.sessions[sessionID]
+	if !ok || now.After(saved.expires) || saved.host != host {
+		s.Unlock()
+		return false
+	}
+	delete(s.sessions, sessionID)
+	s.Unlock()
+
+	if bans != nil && bans.Banned(host, saved.username, now) != nil {
+		return false
+	}
+
+	m.setNonce(saved.nonce)
+	m.setNonceExtension(saved.nonceExtension)
+	m.setTargets(saved.preferredTarget, saved.suggestedTarget)
+	m.username = saved.username
+	m.minerid = saved.minerid
+	m.authorized = saved.authorized
+	return true
+}
+
+// Len is the number of sessions that can be resumed
+func (s *SessionStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sessions)
+}
+
+// prune drops expired sessions. Must hold the lock.
+func (s *SessionStore) prune(now time.Time) {
+	for id, saved := range s.sessions {
+		if now.After(saved.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
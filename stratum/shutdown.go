@@ -0,0 +1,64 @@
+package stratum
+
+import (
+	"fmt"
+	"time"
+)
+
+// StopShares rejects every share from now on. The pool stops taking shares
+// before it shuts down, so all the accepted work can be flushed to the
+// accountant.
+func (s *Server) StopShares() {
+	s.sharesStopped.Store(true)
+}
+
+// RedirectMiners sends every miner a client.reconnect to the host and port,
+// after the wait. An empty host has the miners reconnect to the server they
+// are connected to, and a port of 0 is the stratum port. Returns the number
+// of miners sent the request.
+func (s *Server) RedirectMiners(host string, port int, wait time.Duration) int {
+	var p string
+	if host != "" {
+		if port <= 0 {
+			port = s.stratumPort
+		}
+		p = fmt.Sprintf("%d", port)
+	}
+	req := ReconnectRequest(host, p, fmt.Sprintf("%d", int(wait.Seconds())))
+
+	var count int
+	for _, session := range s.Miners.ListMiners() {
+		miner, err := s.Miners.GetMiner(session)
+		if err != nil {
+			continue // Disconnected
+		}
+		miner.encSync.Lock()
+		err = miner.enc.Encode(req)
+		miner.encSync.Unlock()
+		if err != nil {
+			miner.log.WithError(err).Warn("failed to redirect miner")
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Close stops the listeners, and disconnects every miner. Their sessions
+// are kept until they expire.
+func (s *Server) Close() error {
+	s.closed.Store(true)
+	s.listenLock.Lock()
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.listeners = nil
+	s.listenLock.Unlock()
+
+	for _, session := range s.Miners.ListMiners() {
+		if miner, err := s.Miners.GetMiner(session); err == nil {
+			s.Miners.DisconnectMiner(miner)
+		}
+	}
+	return nil
+}
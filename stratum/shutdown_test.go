@@ -0,0 +1,108 @@
+package stratum_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func listeningServer(t *testing.T, ctx context.Context) (*Server, int, <-chan struct{}) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	port := freePort(t)
+	conf.Set(config.ConfigStratumPort, port)
+	s, err := NewServer(conf)
+	require.NoError(err)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Listen(ctx)
+		close(stopped)
+	}()
+	require.Eventually(func() bool {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+	return s, port, stopped
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, port, stopped := listeningServer(t, ctx)
+
+	srv, cli := net.Pipe()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+	s.NewConn(srv)
+	require.NoError(miner.Subscribe())
+	lines := readLines(cli)
+	require.True(waitForLine(lines, `"method":"mining.set_target"`))
+	require.Eventually(func() bool { return s.Miners.Len() == 1 }, time.Second, 10*time.Millisecond)
+	m, err := s.Miners.GetMiner(s.Miners.ListMiners()[0])
+	require.NoError(err)
+
+	oprHash := fmt.Sprintf("%064d", 1)
+	target := "ffffffffffffffff"
+	s.UpdateCurrentJob(&Job{JobID: 10, OPRHash: oprHash})
+	require.True(waitForLine(lines, `"method":"mining.notify"`))
+	require.Equal(ShareAccepted, s.ProcessSubmission(m, "10", n(m, "aa"), oprHash, target))
+
+	// No shares are taken once they are stopped
+	s.StopShares()
+	require.Equal(RejectShutdown, s.ProcessSubmission(m, "10", n(m, "bb"), oprHash, target))
+
+	// The miners are sent to the other pool, on the stratum port by default
+	require.Equal(1, s.RedirectMiners("pool2.example.com", 0, 5*time.Second))
+	require.True(waitForLine(lines, fmt.Sprintf(`"params":["pool2.example.com","%d","5"]`, port)))
+	require.Equal(1, s.RedirectMiners("", 0, 0))
+	require.True(waitForLine(lines, `"params":["","","0"]`))
+
+	// Closing stops the listener and disconnects the miners
+	require.NoError(s.Close())
+	for range lines {
+	} // Closed by the server
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener was not closed")
+	}
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.Error(err)
+}
+
+func TestClient_Redirect(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first, _, _ := listeningServer(t, ctx)
+	second, port, _ := listeningServer(t, ctx)
+
+	srv, cli := net.Pipe()
+	miner, err := NewClient("user", "miner", "", "", "", "0.0.1")
+	require.NoError(err)
+	miner.InitConn(cli)
+	first.NewConn(srv)
+	go miner.Listen(ctx)
+	require.NoError(miner.Subscribe())
+	require.Eventually(func() bool { return first.Miners.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The miner follows the pool to the other server
+	require.Equal(1, first.RedirectMiners("127.0.0.1", port, 0))
+	require.Eventually(func() bool { return second.Miners.Len() == 1 }, 3*time.Second, 20*time.Millisecond)
+}
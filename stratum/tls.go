@@ -0,0 +1,104 @@
+package stratum
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/spf13/viper"
+)
+
+// NewServerTLSConfig loads the stratum certificate and key from the config.
+// If no TLS port is set, TLS is disabled and nil is returned.
+func NewServerTLSConfig(conf *viper.Viper) (*tls.Config, error) {
+	if conf.GetInt(config.ConfigStratumTLSPort) <= 0 {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.GetString(config.ConfigStratumTLSCertFile), conf.GetString(config.ConfigStratumTLSKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stratum tls certificate: %s", err.Error())
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewClientTLSConfig returns the tls config for connecting to a pool.
+// If caFile is set, the pool certificate must be signed by a CA in the file
+// instead of the system CAs. If pin is set, the pool certificate must have
+// that sha256 fingerprint. A pinned certificate does not need to be signed
+// by a trusted CA, so pools can use self signed certificates.
+func NewClientTLSConfig(caFile, pin string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if pin != "" {
+		expected, err := ParseFingerprint(pin)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a CA, the pin is the only verification
+		cfg.InsecureSkipVerify = caFile == ""
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("pool did not provide a certificate")
+			}
+			found := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(found[:]) != expected {
+				return fmt.Errorf("pool certificate fingerprint %x does not match the pinned %s", found, expected)
+			}
+			return nil
+		}
+	}
+
+	return cfg, nil
+}
+
+// ParseFingerprint accepts a sha256 fingerprint as hex, with or without the
+// colons openssl adds.
+func ParseFingerprint(pin string) (string, error) {
+	pin = strings.ToLower(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+	data, err := hex.DecodeString(pin)
+	if err != nil || len(data) != sha256.Size {
+		return "", fmt.Errorf("certificate pin must be a hex sha256 fingerprint")
+	}
+	return pin, nil
+}
+
+// keepAliveListener sets keep alive on accepted tcp connections, so dead
+// miners are eventually noticed.
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetKeepAlive(true)
+	_ = conn.SetKeepAlivePeriod(3 * time.Minute)
+	return conn, nil
+}
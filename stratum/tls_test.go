@@ -0,0 +1,157 @@
+package stratum_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// selfSignedCert writes a self signed localhost cert and key to dir, and
+// returns the paths and the cert fingerprint.
+func selfSignedCert(t *testing.T, dir string) (certFile, keyFile, fingerprint string) {
+	require := require.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	sum := sha256.Sum256(der)
+	return certFile, keyFile, fmt.Sprintf("%x", sum)
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServer_TLS(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "stratum-tls")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, fingerprint := selfSignedCert(t, dir)
+
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	port := freePort(t)
+	conf.Set(config.ConfigStratumTLSPort, port)
+	conf.Set(config.ConfigStratumTLSCertFile, certFile)
+	conf.Set(config.ConfigStratumTLSKeyFile, keyFile)
+	conf.Set(config.ConfigStratumTLSOnly, true)
+
+	s, err := NewServer(conf)
+	require.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Listen(ctx)
+
+	address := fmt.Sprintf("localhost:%d", port)
+	connect := func(ca, pin string) error {
+		cfg, err := NewClientTLSConfig(ca, pin)
+		require.NoError(err)
+		c, err := NewClient("user", "miner", "", "", "", "0.0.1")
+		require.NoError(err)
+		c.SetTLS(cfg)
+		var connErr error
+		for i := 0; i < 50; i++ { // Wait for the listener
+			if connErr = c.Connect(address); connErr == nil {
+				go c.Close()
+				return nil
+			}
+			if _, ok := connErr.(*net.OpError); !ok {
+				return connErr
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return connErr
+	}
+
+	t.Run("pinned", func(t *testing.T) {
+		require.NoError(connect("", fingerprint))
+		for s.Miners.Len() == 0 { // Wait for miner to be added
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("pin with colons", func(t *testing.T) {
+		var colons string
+		for i := 0; i < len(fingerprint); i += 2 {
+			if i > 0 {
+				colons += ":"
+			}
+			colons += fingerprint[i : i+2]
+		}
+		require.NoError(connect("", colons))
+	})
+
+	t.Run("custom ca", func(t *testing.T) {
+		require.NoError(connect(certFile, ""))
+	})
+
+	t.Run("wrong pin", func(t *testing.T) {
+		require.Error(connect("", fmt.Sprintf("%064x", 1)))
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		require.Error(connect("", ""))
+	})
+}
+
+func TestNewServer_TLSConfig(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+
+	conf.Set(config.ConfigStratumTLSOnly, true)
+	_, err := NewServer(conf)
+	require.Error(err, "tlsonly without a tls port")
+
+	conf.Set(config.ConfigStratumTLSPort, 1235)
+	conf.Set(config.ConfigStratumTLSCertFile, "/does/not/exist.pem")
+	_, err = NewServer(conf)
+	require.Error(err, "missing certificate")
+
+	_, err = NewClientTLSConfig("", "abcd")
+	require.Error(err, "short pin")
+}
@@ -0,0 +1,220 @@
+package stratum
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/FactomWyomingEntity/prosper-pool/difficulty"
+	"github.com/spf13/viper"
+)
+
+const (
+	// MaxVarDiffAdjustment is the largest factor a single retarget can move a
+	// miner's difficulty in either direction. It keeps one noisy window from
+	// swinging a miner wildly.
+	MaxVarDiffAdjustment = 4
+
+	// RetargetGrace is how long shares that meet the previous target are still
+	// accepted after a retarget. Miners will have work in flight when the
+	// new target arrives.
+	RetargetGrace = 5 * time.Second
+)
+
+// VarDiff retargets each miner so they submit shares at a steady rate,
+// regardless of their hashrate. A large rig and a laptop should both submit
+// roughly SharesPerMinute shares.
+type VarDiff struct {
+	Enabled bool
+
+	// SharesPerMinute is the share rate we aim for each miner to have
+	SharesPerMinute float64
+	// RetargetInterval is the window of shares we look at to retarget
+	RetargetInterval time.Duration
+	// Variance is the hysteresis. If the share rate is within +/- this
+	// fraction of the goal, the miner's target is left alone.
+	Variance float64
+
+	// All targets are kept within these bounds
+	InitialTarget uint64
+	MinTarget     uint64
+	MaxTarget     uint64
+}
+
+func NewVarDiff(conf *viper.Viper) (*VarDiff, error) {
+	v := new(VarDiff)
+	var err error
+	v.Enabled = conf.GetBool(config.ConfigStratumVarDiff)
+	v.SharesPerMinute = conf.GetFloat64(config.ConfigStratumVarDiffSharesPerMinute)
+	v.RetargetInterval = conf.GetDuration(config.ConfigStratumVarDiffRetarget)
+	v.Variance = conf.GetFloat64(config.ConfigStratumVarDiffVariance)
+
+	v.MinTarget, err = ParseTarget(conf.GetString(config.ConfigStratumMinimumTarget), difficulty.PDiff)
+	if err != nil {
+		return nil, fmt.Errorf("minimum target: %s", err.Error())
+	}
+	v.MaxTarget, err = ParseTarget(conf.GetString(config.ConfigStratumMaximumTarget), difficulty.BDiff)
+	if err != nil {
+		return nil, fmt.Errorf("maximum target: %s", err.Error())
+	}
+	v.InitialTarget, err = ParseTarget(conf.GetString(config.ConfigStratumInitialTarget), difficulty.PDiff)
+	if err != nil {
+		return nil, fmt.Errorf("initial target: %s", err.Error())
+	}
+
+	if v.MinTarget > v.MaxTarget {
+		return nil, fmt.Errorf("minimum target %x is above the maximum target %x", v.MinTarget, v.MaxTarget)
+	}
+	v.InitialTarget = v.Clamp(v.InitialTarget)
+
+	if v.Enabled {
+		if v.SharesPerMinute <= 0 {
+			return nil, fmt.Errorf("vardiff shares per minute must be greater than 0")
+		}
+		if v.RetargetInterval <= 0 {
+			return nil, fmt.Errorf("vardiff retarget time must be greater than 0")
+		}
+	}
+
+	return v, nil
+}
+
+// ParseTarget parses a hex target, with or without the '0x'. An empty string
+// will return the default.
+func ParseTarget(target string, def uint64) (uint64, error) {
+	if target == "" {
+		return def, nil
+	}
+	return strconv.ParseUint(strings.TrimPrefix(target, "0x"), 16, 64)
+}
+
+// Clamp keeps the target within the pool bounds
+func (v VarDiff) Clamp(target uint64) uint64 {
+	if target < v.MinTarget {
+		return v.MinTarget
+	}
+	if target > v.MaxTarget {
+		return v.MaxTarget
+	}
+	return target
+}
+
+// Retarget returns the new target for a miner that has submitted 'shares'
+// on the 'current' target over the 'elapsed' duration. The bool is false
+// if the target should not change.
+func (v VarDiff) Retarget(current uint64, shares int, elapsed time.Duration) (uint64, bool) {
+	if elapsed <= 0 {
+		return current, false
+	}
+
+	rate := float64(shares) / elapsed.Minutes()
+	if rate >= v.SharesPerMinute*(1-v.Variance) && rate <= v.SharesPerMinute*(1+v.Variance) {
+		return current, false // Close enough
+	}
+
+	// Difficulty scales linearly with the expected time to find a share.
+	// So scale the difficulty by how far we are off the goal.
+	factor := rate / v.SharesPerMinute
+	if factor > MaxVarDiffAdjustment {
+		factor = MaxVarDiffAdjustment
+	}
+	if factor < 1/float64(MaxVarDiffAdjustment) {
+		factor = 1 / float64(MaxVarDiffAdjustment)
+	}
+
+	diff := difficulty.DifficultyFromTarget(current, difficulty.PDiff) * factor
+	target := v.Clamp(difficulty.TargetFromDifficulty(diff, difficulty.PDiff))
+	return target, target != current
+}
+
+// PreferredTarget is the target the miner is currently assigned
+func (m *Miner) PreferredTarget() uint64 {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	return m.preferredTarget
+}
+
+// setTargets sets the miner's target and suggested floor, like when a
+// session is resumed
+func (m *Miner) setTargets(preferred, suggested uint64) {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	m.preferredTarget = preferred
+	m.suggestedTarget = suggested
+}
+
+// targets returns the miner's target and suggested floor
+func (m *Miner) targets() (preferred, suggested uint64) {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	return m.preferredTarget, m.suggestedTarget
+}
+
+// startWindow starts a new vardiff window, and returns the miner's target. A
+// target of 0 keeps the miner on their current target.
+func (m *Miner) startWindow(target uint64, now time.Time) uint64 {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	if target != 0 {
+		m.preferredTarget = target
+	}
+	m.lastRetarget = now
+	m.sharesSinceRetarget = 0
+	return m.preferredTarget
+}
+
+// window returns the miner's current target, when the vardiff window
+// started, and the shares submitted since
+func (m *Miner) window() (target uint64, started time.Time, shares int) {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	return m.preferredTarget, m.lastRetarget, m.sharesSinceRetarget
+}
+
+// countWindowShare counts an accepted share towards the vardiff window
+func (m *Miner) countWindowShare() {
+	m.shareLock.Lock()
+	m.sharesSinceRetarget++
+	m.shareLock.Unlock()
+}
+
+// retarget resets the miner's vardiff window and moves them onto the new
+// target. The previous target is still honored for a short grace period.
+func (m *Miner) retarget(target uint64, now time.Time) {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	m.previousTarget = m.preferredTarget
+	m.preferredTarget = target
+	m.lastRetarget = now
+	m.sharesSinceRetarget = 0
+}
+
+// suggestTarget moves the miner onto the target they asked for, and keeps
+// vardiff from lowering them below it. There is no grace for the previous
+// target, the miner asked for this.
+func (m *Miner) suggestTarget(target uint64, now time.Time) {
+	m.shareLock.Lock()
+	defer m.shareLock.Unlock()
+	m.suggestedTarget = target
+	m.previousTarget = 0
+	m.preferredTarget = target
+	m.lastRetarget = now
+	m.sharesSinceRetarget = 0
+}
+
+// acceptedTarget returns the target the share is credited against. If the
+// share meets neither the current target, nor the previous target during
+// the grace period, 0 is returned.
+func (m *Miner) acceptedTarget(target uint64, now time.Time) uint64 {
+	m.shareLock.RLock()
+	defer m.shareLock.RUnlock()
+	if target >= m.preferredTarget {
+		return m.preferredTarget
+	}
+	if m.previousTarget != 0 && target >= m.previousTarget && now.Sub(m.lastRetarget) < RetargetGrace {
+		return m.previousTarget
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package stratum_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/FactomWyomingEntity/prosper-pool/difficulty"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func testVarDiff(t *testing.T) *VarDiff {
+	conf := viper.New()
+	config.SetDefaults(conf)
+	v, err := NewVarDiff(conf)
+	require.NoError(t, err)
+	return v
+}
+
+func TestNewVarDiff(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		require := require.New(t)
+		v := testVarDiff(t)
+		require.True(v.Enabled)
+		require.Equal(difficulty.PDiff, v.InitialTarget)
+		require.Equal(difficulty.PDiff, v.MinTarget)
+		require.Equal(uint64(0xffffffff00000000), v.MaxTarget)
+	})
+
+	t.Run("bad bounds", func(t *testing.T) {
+		conf := viper.New()
+		config.SetDefaults(conf)
+		conf.Set(config.ConfigStratumMinimumTarget, "ffffffff00000000")
+		conf.Set(config.ConfigStratumMaximumTarget, "ffff000000000000")
+		_, err := NewVarDiff(conf)
+		require.Error(t, err)
+	})
+
+	t.Run("hex prefix", func(t *testing.T) {
+		conf := viper.New()
+		config.SetDefaults(conf)
+		conf.Set(config.ConfigStratumInitialTarget, "0xfffff00000000000")
+		v, err := NewVarDiff(conf)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0xfffff00000000000), v.InitialTarget)
+	})
+}
+
+func TestVarDiff_Retarget(t *testing.T) {
+	v := testVarDiff(t)
+	start := uint64(0xfffff00000000000)
+
+	t.Run("on goal", func(t *testing.T) {
+		shares := int(v.SharesPerMinute * v.RetargetInterval.Minutes())
+		target, change := v.Retarget(start, shares, v.RetargetInterval)
+		require.False(t, change)
+		require.Equal(t, start, target)
+	})
+
+	t.Run("too many shares", func(t *testing.T) {
+		shares := int(2 * v.SharesPerMinute * v.RetargetInterval.Minutes())
+		target, change := v.Retarget(start, shares, v.RetargetInterval)
+		require.True(t, change)
+		require.Greater(t, target, start)
+
+		// Difficulty should roughly double
+		ratio := difficulty.DifficultyFromTarget(target, difficulty.PDiff) / difficulty.DifficultyFromTarget(start, difficulty.PDiff)
+		require.InDelta(t, 2, ratio, 0.01)
+	})
+
+	t.Run("too few shares", func(t *testing.T) {
+		shares := int(v.SharesPerMinute * v.RetargetInterval.Minutes() / 2)
+		target, change := v.Retarget(start, shares, v.RetargetInterval)
+		require.True(t, change)
+		require.Less(t, target, start)
+	})
+
+	t.Run("adjustment is limited", func(t *testing.T) {
+		target, change := v.Retarget(start, 10000, time.Minute)
+		require.True(t, change)
+		ratio := difficulty.DifficultyFromTarget(target, difficulty.PDiff) / difficulty.DifficultyFromTarget(start, difficulty.PDiff)
+		require.InDelta(t, MaxVarDiffAdjustment, ratio, 0.01)
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		target, _ := v.Retarget(v.MinTarget, 0, time.Hour)
+		require.Equal(t, v.MinTarget, target)
+
+		target, _ = v.Retarget(v.MaxTarget, 10000, time.Minute)
+		require.Equal(t, v.MaxTarget, target)
+	})
+}
@@ -0,0 +1,201 @@
+package stratum
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	"github.com/spf13/viper"
+)
+
+// MinerName is the agent name prosper-miner subscribes with. Agents without a
+// name are treated as prosper-miner.
+const MinerName = "prosper"
+
+// rxVersion matches 'v1.2.3', with an optional pre-release and build. A
+// 'git describe' suffix like '-4-gabc1234' is a build on top of the tag.
+var rxVersion = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+var rxDescribe = regexp.MustCompile(`^(?:(.*)-)?\d+-g[0-9a-f]+(-dirty)?$`)
+
+// Version is the semantic version of a miner
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string // Pre-release, sorts before the release
+}
+
+// ParseVersion parses a semantic version, as 'git describe --tags' prints it
+func ParseVersion(s string) (Version, error) {
+	var v Version
+	m := rxVersion.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return v, fmt.Errorf("'%s' is not a semantic version", s)
+	}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	v.Pre = strings.TrimPrefix(m[4], "-")
+	if d := rxDescribe.FindStringSubmatch(v.Pre); d != nil {
+		v.Pre = d[1]
+	}
+	return v, nil
+}
+
+// ParseAgent splits a 'name/version' agent. Agents without a slash are the
+// bare version.
+func ParseAgent(agent string) (name string, v Version, err error) {
+	version := agent
+	if i := strings.LastIndex(agent, "/"); i >= 0 {
+		name, version = agent[:i], agent[i+1:]
+	}
+	v, err = ParseVersion(version)
+	return name, v, err
+}
+
+// Less returns if v is older than o
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	if v.Patch != o.Patch {
+		return v.Patch < o.Patch
+	}
+	// A pre-release is older than the release
+	if v.Pre == "" || o.Pre == "" {
+		return v.Pre != "" && o.Pre == ""
+	}
+	return lessPre(v.Pre, o.Pre)
+}
+
+// lessPre compares pre-releases by their dot separated identifiers. Numeric
+// identifiers compare as numbers, and sort before alphanumeric ones.
+func lessPre(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			return an < bn
+		case aerr == nil || berr == nil:
+			return aerr == nil
+		default:
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// VersionPolicy decides what to do with prosper-miners older than the
+// minimum version. Outdated miners are sent an upgrade notice. Once the
+// deadline has passed, they can be refused. The deadline is a fixed time, so
+// restarting the pool does not put it off. Agents of other miners, and
+// versions that cannot be parsed, are left alone.
+type VersionPolicy struct {
+	// Minimum is nil if there is no minimum version
+	Minimum *Version
+	// Refuse outdated miners from the deadline. A zero deadline refuses
+	// them right away.
+	Refuse   bool
+	Deadline time.Time
+	// Message is added to the upgrade notice
+	Message string
+}
+
+func NewVersionPolicy(conf *viper.Viper) (*VersionPolicy, error) {
+	p := new(VersionPolicy)
+	p.Refuse = conf.GetBool(config.ConfigStratumRefuseOutdatedMiners)
+	if deadline := conf.GetString(config.ConfigStratumMinVersionDeadline); deadline != "" {
+		var err error
+		p.Deadline, err = time.Parse(time.RFC3339, deadline)
+		if err != nil {
+			return nil, fmt.Errorf("minimum version deadline: %s", err.Error())
+		}
+	}
+	p.Message = conf.GetString(config.ConfigStratumUpgradeMessage)
+	if min := conf.GetString(config.ConfigStratumMinimumMinerVersion); min != "" {
+		v, err := ParseVersion(min)
+		if err != nil {
+			return nil, fmt.Errorf("minimum miner version: %s", err.Error())
+		}
+		p.Minimum = &v
+	}
+	return p, nil
+}
+
+// Outdated returns if the agent is a prosper-miner older than the minimum
+func (p *VersionPolicy) Outdated(agent string) bool {
+	if p.Minimum == nil {
+		return false
+	}
+	name, v, err := ParseAgent(agent)
+	if err != nil || (name != "" && name != MinerName) {
+		return false
+	}
+	return v.Less(*p.Minimum)
+}
+
+// Refused returns if the outdated agent should be refused at the time
+func (p *VersionPolicy) Refused(agent string, now time.Time) bool {
+	return p.Refuse && !now.Before(p.Deadline) && p.Outdated(agent)
+}
+
+// Notice is the upgrade notice sent to outdated miners
+func (p *VersionPolicy) Notice(agent string, now time.Time) string {
+	notice := fmt.Sprintf("Your miner version %s is older than the minimum supported version %s.", agent, p.Minimum)
+	if p.Refuse {
+		if now.Before(p.Deadline) {
+			notice += fmt.Sprintf(" Outdated miners will be refused after %s.", p.Deadline.UTC().Format("2006-01-02 15:04 MST"))
+		} else {
+			notice += " Outdated miners are refused."
+		}
+	}
+	if p.Message != "" {
+		notice += " " + p.Message
+	}
+	return notice
+}
+
+// AgentCount is the number of connected miners with an agent
+type AgentCount struct {
+	Agent    string
+	Miners   int
+	Outdated bool
+}
+
+// AgentCounts is the distribution of agents among the miners, the most
+// common first
+func (p *VersionPolicy) AgentCounts(miners []MinerSnapShot) []AgentCount {
+	counts := make(map[string]int)
+	for _, m := range miners {
+		counts[m.Agent]++
+	}
+	agents := make([]AgentCount, 0, len(counts))
+	for agent, count := range counts {
+		agents = append(agents, AgentCount{Agent: agent, Miners: count, Outdated: p.Outdated(agent)})
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		if agents[i].Miners != agents[j].Miners {
+			return agents[i].Miners > agents[j].Miners
+		}
+		return agents[i].Agent < agents[j].Agent
+	})
+	return agents
+}
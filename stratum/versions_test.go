@@ -0,0 +1,139 @@
+package stratum_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/FactomWyomingEntity/prosper-pool/config"
+	. "github.com/FactomWyomingEntity/prosper-pool/stratum"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVersion(t *testing.T) {
+	require := require.New(t)
+	for s, exp := range map[string]Version{
+		"v1.2.3":                 {Major: 1, Minor: 2, Patch: 3},
+		"0.4.10":                 {Minor: 4, Patch: 10},
+		"v1.2.3-rc.1":            {Major: 1, Minor: 2, Patch: 3, Pre: "rc.1"},
+		"v1.2.3+build":           {Major: 1, Minor: 2, Patch: 3},
+		"v1.2.3-4-gabc1234":      {Major: 1, Minor: 2, Patch: 3},
+		"v1.2.3-rc1-4-gabc1234":  {Major: 1, Minor: 2, Patch: 3, Pre: "rc1"},
+		"v1.2.3-4-gabc123-dirty": {Major: 1, Minor: 2, Patch: 3},
+	} {
+		v, err := ParseVersion(s)
+		require.NoError(err, s)
+		require.Equal(exp, v, s)
+	}
+	for _, bad := range []string{"", "Unknown", "1.2", "v1.2.3.4", "abc1234"} {
+		_, err := ParseVersion(bad)
+		require.Error(err, bad)
+	}
+
+	older := []string{"v0.9.9", "v1.0.0-alpha", "v1.0.0-alpha.1", "v1.0.0-alpha.beta", "v1.0.0-beta.2", "v1.0.0-beta.11", "v1.0.0", "v1.0.1", "v1.1.0", "v2.0.0"}
+	for i := 1; i < len(older); i++ {
+		a, _ := ParseVersion(older[i-1])
+		b, _ := ParseVersion(older[i])
+		require.True(a.Less(b), "%s < %s", a, b)
+		require.False(b.Less(a), "%s < %s", b, a)
+	}
+
+	name, v, err := ParseAgent("prosper/v1.2.3")
+	require.NoError(err)
+	require.Equal("prosper", name)
+	require.Equal(Version{Major: 1, Minor: 2, Patch: 3}, v)
+}
+
+func TestVersionPolicy(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	p, err := NewVersionPolicy(conf)
+	require.NoError(err)
+	require.False(p.Outdated("v0.0.1"), "no minimum")
+
+	conf.Set(config.ConfigStratumMinimumMinerVersion, "v1.0")
+	_, err = NewVersionPolicy(conf)
+	require.Error(err)
+
+	conf.Set(config.ConfigStratumMinimumMinerVersion, "v1.0.0")
+	conf.Set(config.ConfigStratumRefuseOutdatedMiners, true)
+	conf.Set(config.ConfigStratumMinVersionDeadline, "in a week")
+	_, err = NewVersionPolicy(conf)
+	require.Error(err)
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+	conf.Set(config.ConfigStratumMinVersionDeadline, deadline.Format(time.RFC3339))
+	p, err = NewVersionPolicy(conf)
+	require.NoError(err)
+	require.True(deadline.Equal(p.Deadline))
+
+	now := deadline.Add(-time.Minute)
+	require.True(p.Outdated("v0.9.0-2-gabc1234"))
+	require.True(p.Outdated("prosper/0.9.0"))
+	require.False(p.Outdated("v1.0.0"))
+	require.False(p.Outdated("other-miner/0.1.0"), "other miners are left alone")
+	require.False(p.Outdated("Unknown"), "unparsable versions are left alone")
+
+	// Refused only from the deadline, however long the pool has run
+	require.False(p.Refused("v0.9.0", now))
+	require.Contains(p.Notice("v0.9.0", now), "will be refused after")
+	require.True(p.Refused("v0.9.0", deadline))
+	require.Contains(p.Notice("v0.9.0", deadline), "are refused")
+	p, err = NewVersionPolicy(conf)
+	require.NoError(err)
+	require.True(p.Refused("v0.9.0", deadline), "a restart does not move the deadline")
+
+	// Without a deadline, outdated miners are refused right away
+	conf.Set(config.ConfigStratumMinVersionDeadline, "")
+	p, err = NewVersionPolicy(conf)
+	require.NoError(err)
+	require.True(p.Refused("v0.9.0", time.Now()))
+
+	agents := p.AgentCounts([]MinerSnapShot{{Agent: "v0.9.0"}, {Agent: "v1.0.0"}, {Agent: "v1.0.0"}})
+	require.Equal([]AgentCount{{Agent: "v1.0.0", Miners: 2}, {Agent: "v0.9.0", Miners: 1, Outdated: true}}, agents)
+}
+
+func TestServer_OutdatedMiner(t *testing.T) {
+	require := require.New(t)
+	conf := viper.New()
+	config.SetDefaults(conf)
+	conf.Set(config.ConfigStratumCheckAllWork, false)
+	conf.Set(config.ConfigStratumMinimumMinerVersion, "v1.0.0")
+	conf.Set(config.ConfigStratumRefuseOutdatedMiners, true)
+	conf.Set(config.ConfigStratumMinVersionDeadline, time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	subscribe := func(s *Server, version string) <-chan string {
+		srv, cli := net.Pipe()
+		miner, err := NewClient("user", "miner", "", "", "", version)
+		require.NoError(err)
+		miner.InitConn(cli)
+		s.NewConn(srv)
+		require.NoError(miner.Subscribe())
+		return readLines(cli)
+	}
+
+	// Before the deadline, outdated miners are notified
+	s, err := NewServer(conf)
+	require.NoError(err)
+	lines := subscribe(s, "v0.9.0")
+	require.True(waitForLine(lines, `"method":"client.show_message"`))
+	require.True(waitForLine(lines, `"method":"mining.set_target"`))
+
+	// Then refused and disconnected
+	conf.Set(config.ConfigStratumMinVersionDeadline, time.Now().Add(-time.Hour).Format(time.RFC3339))
+	s, err = NewServer(conf)
+	require.NoError(err)
+	lines = subscribe(s, "v0.9.0")
+	require.True(waitForLine(lines, `"method":"client.show_message"`))
+	require.True(waitForLine(lines, `"code":25`))
+	for range lines {
+	} // Closed by the server
+	require.Equal(0, s.Miners.Len())
+
+	// Up to date miners are not bothered
+	lines = subscribe(s, "v1.0.0")
+	require.Contains(<-lines, `"result"`)
+	require.True(waitForLine(lines, `"method":"mining.set_target"`))
+}
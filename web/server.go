@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -82,6 +83,7 @@ func (s *HttpServices) InitPrimary(auth *authentication.Authenticator) {
 	adminMux := http.NewServeMux()
 	adminMux.HandleFunc("/admin/links", s.AdminLinks)
 	adminMux.HandleFunc("/admin/miners", s.PoolMiners)
+	adminMux.HandleFunc("/admin/bans", s.PoolBans)
 	primaryMux.Handle("/admin/", s.Auth.Authority.Authorize("admin")(adminMux))
 
 	// Add /auth to primary mux
@@ -105,3 +107,9 @@ func (s *HttpServices) Close() error {
 	_ = s.Primary.Close()
 	return nil
 }
+
+// Shutdown stops the web server once the open requests finish, or the
+// context is done
+func (s *HttpServices) Shutdown(ctx context.Context) error {
+	return s.Primary.Shutdown(ctx)
+}
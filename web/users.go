@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"html"
 	"math"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/FactomWyomingEntity/prosper-pool/accounting"
 	"github.com/FactomWyomingEntity/prosper-pool/authentication"
 	"github.com/FactomWyomingEntity/prosper-pool/sharesubmit"
+	"github.com/FactomWyomingEntity/prosper-pool/stratum"
 )
 
 func (s *HttpServices) Nav() []byte {
@@ -31,6 +36,7 @@ func (s *HttpServices) AdminLinks(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`
 	<ul>
 		<li><a href="/admin/miners">Miners</a></li>
+		<li><a href="/admin/bans">Bans</a></li>
 	</ul>
 	`))
 }
@@ -119,9 +125,9 @@ func (s *HttpServices) PoolRewards(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("This page displays the last 100 pool rewards\n"))
 	for _, rew := range rewards {
-		buf.WriteString(fmt.Sprintf("\tHeight: %d, PEG: %s, Difficulty: %.2f, HashRate: %.2f h\\s\n",
+		buf.WriteString(fmt.Sprintf("\tHeight: %d, PEG: %s, Difficulty: %.2f, HashRate: %.2f h\\s, Scheme: %s\n",
 			rew.JobID, FactoshiToFactoid(uint64(rew.PoolReward)),
-			rew.PoolDifficuty, rew.TotalHashrate))
+			rew.PoolDifficuty, rew.TotalHashrate, rew.Scheme))
 	}
 	_, _ = w.Write(buf.Bytes())
 }
@@ -181,19 +187,126 @@ func (s *HttpServices) PoolMiners(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("This page displays all connected miners\n"))
 	buf.WriteString(fmt.Sprintf("  %d total miners\n", len(miners)))
+	if sampler := s.StratumServer.Sampler; sampler.Enabled() {
+		stats := sampler.Stats()
+		buf.WriteString(fmt.Sprintf("  Sampling %.2f%% of shares: %d validated, %d invalid\n", sampler.Rate*100, stats.Sampled, stats.Invalid))
+	}
+	if min := s.StratumServer.Versions.Minimum; min != nil {
+		buf.WriteString(fmt.Sprintf("  Minimum miner version %s\n", min))
+	}
+	buf.WriteString("  Agents:\n")
+	for _, agent := range s.StratumServer.AgentCounts() {
+		outdated := ""
+		if agent.Outdated {
+			outdated = " (outdated)"
+		}
+		buf.WriteString(fmt.Sprintf("\t%5d  %s%s\n", agent.Miners, html.EscapeString(agent.Agent), outdated))
+	}
 	for i, miner := range miners {
-		buf.WriteString(fmt.Sprintf("-------- %d:  Miner %s/%s --------\n", i, miner.Username, miner.Minerid))
-		buf.WriteString(fmt.Sprintf("\t%10s: %s\n", "Agent", miner.Agent))
+		// Everything the miner sent is escaped, as the page is served as html
+		buf.WriteString(fmt.Sprintf("-------- %d:  Miner %s/%s --------\n", i, html.EscapeString(miner.Username), html.EscapeString(miner.Minerid)))
+		buf.WriteString(fmt.Sprintf("\t%10s: %s\n", "Agent", html.EscapeString(miner.Agent)))
+		if miner.Version != "" {
+			buf.WriteString(fmt.Sprintf("\t%10s: %s\n", "Version", html.EscapeString(miner.Version)))
+		}
 		buf.WriteString(fmt.Sprintf("\t%10s: %s\n", "IP", miner.IP))
 		buf.WriteString(fmt.Sprintf("\t%10s: %s\n", "Session", miner.SessionID))
 		buf.WriteString(fmt.Sprintf("\t%10s: %t\n", "Auth", miner.Authorized))
 		buf.WriteString(fmt.Sprintf("\t%10s: %t\n", "Sub", miner.Subscribed))
 		buf.WriteString(fmt.Sprintf("\t%10s: %x\n", "PrefTarget", miner.PrefferedTarget))
 		buf.WriteString(fmt.Sprintf("\t%10s: %d\n", "Nonce", miner.Nonce))
+		buf.WriteString(fmt.Sprintf("\t%10s: %d\n", "Accepted", miner.Accepted))
+		for _, reason := range stratum.RejectReasons {
+			if count := miner.Rejections[reason.String()]; count > 0 {
+				buf.WriteString(fmt.Sprintf("\t%10s: %d\n", "Rej "+reason.String(), count))
+			}
+		}
+		if miner.Samples.Sampled > 0 {
+			buf.WriteString(fmt.Sprintf("\t%10s: %d (%d invalid)\n", "Sampled", miner.Samples.Sampled, miner.Samples.Invalid))
+		}
+		if miner.Suspect {
+			buf.WriteString(fmt.Sprintf("\t%10s: %t\n", "Suspect", miner.Suspect))
+		}
 	}
 	_, _ = w.Write(buf.Bytes())
 }
 
+// PoolBans lists the active stratum bans. Admins can ban and unban an ip
+// or username with the forms.
+func (s *HttpServices) PoolBans(w http.ResponseWriter, r *http.Request) {
+	w.Write(s.Nav())
+	if s.StratumServer == nil {
+		_, _ = w.Write([]byte("No stratum server hooked up"))
+		return
+	}
+
+	var buf bytes.Buffer
+	if r.Method == http.MethodPost && !sameOrigin(r) {
+		// Another site must not be able to ban or unban through the admin
+		buf.WriteString("<p>Refused a ban change from another site</p>")
+	} else if r.Method == http.MethodPost {
+		subject := r.FormValue("subject")
+		switch r.FormValue("action") {
+		case "ban":
+			duration, err := time.ParseDuration(r.FormValue("duration"))
+			if err != nil {
+				buf.WriteString(fmt.Sprintf("<p>Bad duration: %s</p>", html.EscapeString(err.Error())))
+				break
+			}
+			ban, err := s.StratumServer.Bans.Ban(subject, duration, r.FormValue("reason"), time.Now())
+			if err != nil {
+				buf.WriteString(fmt.Sprintf("<p>Ban failed: %s</p>", html.EscapeString(err.Error())))
+				break
+			}
+			kicked := s.StratumServer.DisconnectSubject(ban.Subject)
+			buf.WriteString(fmt.Sprintf("<p>Banned %s, disconnected %d miners</p>", html.EscapeString(ban.Subject), kicked))
+		case "unban":
+			if err := s.StratumServer.Bans.Unban(subject); err != nil {
+				buf.WriteString(fmt.Sprintf("<p>Unban failed: %s</p>", html.EscapeString(err.Error())))
+				break
+			}
+			buf.WriteString(fmt.Sprintf("<p>Unbanned %s</p>", html.EscapeString(subject)))
+		}
+	}
+
+	buf.WriteString(`<form method="post">
+	<input type="hidden" name="action" value="ban">
+	Subject <input name="subject" placeholder="ip:1.2.3.4 or user:name">
+	Duration <input name="duration" value="24h">
+	Reason <input name="reason">
+	<input type="submit" value="Ban">
+</form>
+<form method="post">
+	<input type="hidden" name="action" value="unban">
+	Subject <input name="subject" placeholder="ip:1.2.3.4 or user:name">
+	<input type="submit" value="Unban">
+</form>
+`)
+
+	bans := s.StratumServer.Bans.Bans(time.Now())
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	buf.WriteString("<pre>")
+	buf.WriteString(fmt.Sprintf("  %d active bans\n", len(bans)))
+	for _, ban := range bans {
+		buf.WriteString(fmt.Sprintf("\t%s until %s, strikes: %d, manual: %t, reason: %s\n",
+			html.EscapeString(ban.Subject), ban.Until.UTC().Format(time.RFC3339), ban.Strikes, ban.Manual, html.EscapeString(ban.Reason)))
+	}
+	buf.WriteString("</pre>")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// sameOrigin returns true if the request was sent by a page of the pool.
+// Browsers send the Origin with a post, older ones only the Referer. Requests
+// with neither are refused.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
 // MinuteKeeperInfo has the json endpoint to indicate if submissions are being
 // accepted.
 func (s *HttpServices) MinuteKeeperInfo(w http.ResponseWriter, r *http.Request) {